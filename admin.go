@@ -0,0 +1,113 @@
+package tbb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"slices"
+	"strings"
+)
+
+// Stats contains the key figures of the bot.
+type Stats struct {
+	Users       int64 // Number of users stored in the database
+	ActiveUsers int64 // Number of users with enabled notifications
+	BannedUsers int64 // Number of users banned by an admin
+	Sessions    int   // Number of currently active Bot sessions
+}
+
+// AdminAPI returns the API of the admin bot configured by Config.Admin.BotToken.
+// If no admin bot token is configured, the API of the bot itself is returned.
+func (tb *TBot) AdminAPI() API {
+	if tb.adminAPI != nil {
+		return *tb.adminAPI
+	}
+	return tb.api
+}
+
+// NotifyAdmins sends the given text to all users with the RoleAdmin via the AdminAPI.
+func (tb *TBot) NotifyAdmins(text string) error {
+	chatIDs, err := tb.adminChatIDs()
+	for _, chatID := range chatIDs {
+		if _, e := tb.AdminAPI().SendMessage(text, chatID, nil); e != nil {
+			err = errors.Join(err, fmt.Errorf("cannot notify admin %d: %w", chatID, e))
+		}
+	}
+	return err
+}
+
+// adminChatIDs returns the chatIDs of Config.Admin.ChatIDs and all users with the RoleAdmin.
+func (tb *TBot) adminChatIDs() ([]int64, error) {
+	var chatIDs []int64
+	admins := tb.db.Model(&UserInfo{}).Select("user_id").Where("role = ?", RoleAdmin)
+	err := tb.db.Model(&User{}).Where("id IN (?)", admins).Pluck("chat_id", &chatIDs).Error
+
+	for _, chatID := range tb.cfg.Admin.ChatIDs {
+		if !slices.Contains(chatIDs, chatID) {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs, err
+}
+
+// notifyAdminsAsync sends the given text to all admins in the background and logs failures.
+func (tb *TBot) notifyAdminsAsync(text string) {
+	tb.wg.Add(1)
+	go func() {
+		defer tb.wg.Done()
+		if err := tb.NotifyAdmins(text); err != nil {
+			tb.logger.Warn("Cannot notify admins", "error", err)
+		}
+	}()
+}
+
+// Stats returns the current key figures of the bot.
+func (tb *TBot) Stats() (*Stats, error) {
+	var s Stats
+	if err := tb.db.Model(&User{}).Count(&s.Users).Error; err != nil {
+		return nil, err
+	}
+	if err := tb.db.Model(&UserInfo{}).Where("is_active = ?", true).Count(&s.ActiveUsers).Error; err != nil {
+		return nil, err
+	}
+	if err := tb.db.Model(&UserInfo{}).Where("role = ?", RoleBanned).Count(&s.BannedUsers).Error; err != nil {
+		return nil, err
+	}
+
+	s.Sessions = tb.sessions.Len()
+	return &s, nil
+}
+
+// updateUserInfo applies fn to the user with the given chatID and saves the user.
+// If the user has an active Bot session, the session user is updated, so that the change is not overwritten later on.
+func (tb *TBot) updateUserInfo(chatID int64, fn func(*User)) error {
+	if b, ok := tb.sessions.Get(chatID); ok {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		fn(b.user)
+		if b.user.ID == 0 {
+			return nil
+		}
+		return b.saveUser()
+	}
+
+	u, err := tb.users.Find(chatID)
+	if err != nil {
+		return err
+	}
+	defer tb.users.forget(u)
+	if u.UserInfo == nil {
+		u.UserInfo = &UserInfo{}
+	}
+	fn(u)
+	return tb.users.Save(u)
+}
+
+// userLabel returns a short description of the Telegram user for admin notifications.
+func userLabel(u echotron.User) string {
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if u.Username != "" {
+		name += " (@" + u.Username + ")"
+	}
+	return fmt.Sprintf("%s [%d]", name, u.ID)
+}
@@ -0,0 +1,102 @@
+package tbb_test
+
+import (
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+type panicCommand struct {
+	tbb.DefaultCommandHandler
+}
+
+func (c *panicCommand) Handle() tbb.StateFn {
+	panic("boom")
+}
+
+func newAdminHarness(t *testing.T) *tbbtest.Harness {
+	cfg := &tbb.Config{}
+	cfg.Admin.ChatIDs = []int64{1}
+	return tbbtest.NewWithConfig(t, cfg, tbb.WithCommands([]tbb.Command{
+		{Name: "/stats", HandlerFn: command.NewStats, Roles: []tbb.Role{tbb.RoleAdmin}},
+		{Name: "/ban", HandlerFn: command.NewBan, Roles: []tbb.Role{tbb.RoleAdmin}},
+		{Name: "/unban", HandlerFn: command.NewUnban, Roles: []tbb.Role{tbb.RoleAdmin}},
+		{Name: "/broadcast", HandlerFn: command.NewBroadcast, Roles: []tbb.Role{tbb.RoleAdmin}},
+		{Name: "/language", Description: "Change the language", HandlerFn: command.NewLanguage},
+		{Name: "/panic", HandlerFn: func() tbb.CommandHandler { return &panicCommand{} }},
+	}))
+}
+
+// eventuallyMessage waits for an asynchronous message matching the pattern in the given chat.
+func eventuallyMessage(t *testing.T, h *tbbtest.Harness, chatID int64, pattern string) {
+	t.Helper()
+	re := regexp.MustCompile(pattern)
+	assert.Eventually(t, func() bool {
+		for _, m := range h.Messages(chatID) {
+			if re.MatchString(m) {
+				return true
+			}
+		}
+		return false
+	}, time.Second*5, time.Millisecond*10, "chat %d did not receive a message matching %q: %q", chatID, pattern, h.Messages(chatID))
+}
+
+func TestAdminCommands(t *testing.T) {
+	t.Run("should only be available for admins", func(t *testing.T) {
+		h := newAdminHarness(t)
+		h.SendMessage(42, "/stats")
+		h.AssertNoMessage(42, `Stats`)
+
+		h.SendMessage(1, "/stats")
+		h.AssertMessage(1, `Users: \d+`)
+	})
+
+	t.Run("should ban and unban users", func(t *testing.T) {
+		h := newAdminHarness(t)
+		h.SendMessage(42, "/language xx")
+		h.AssertMessage(42, `not available`)
+
+		h.SendMessage(1, "/ban 42")
+		h.AssertMessage(1, `^User 42 has been banned\.$`)
+		h.Server.Reset()
+		h.SendMessage(42, "/language xx")
+		h.AssertNoMessage(42, `.*`)
+
+		h.SendMessage(1, "/ban")
+		h.AssertMessage(1, `^Usage: /ban <chatID>$`)
+
+		h.SendMessage(1, "/unban 42")
+		h.AssertMessage(1, `^User 42 has been unbanned\.$`)
+		h.SendMessage(42, "/language xx")
+		h.AssertMessage(42, `not available`)
+	})
+
+	t.Run("should broadcast to all active users", func(t *testing.T) {
+		h := newAdminHarness(t)
+		createUsers(t, h.TBot.DB(), map[int64]bool{10: true, 11: true})
+
+		h.SendMessage(1, "/broadcast Hello \"everyone\"")
+		eventuallyMessage(t, h, 1, `^The broadcast has been delivered to 2 of 2 users`)
+		h.AssertMessage(10, `^Hello "everyone"$`)
+		h.AssertMessage(11, `^Hello "everyone"$`)
+	})
+}
+
+func TestAdminNotifications(t *testing.T) {
+	h := newAdminHarness(t)
+
+	h.SendMessage(42, "/panic")
+	eventuallyMessage(t, h, 1, `Recovered panic in update of chat 42: boom`)
+	eventuallyMessage(t, h, 1, `New user: Test \[42\]`)
+
+	h.SendMessage(1, "/ban 42")
+	u, err := h.TBot.DB().FindUserByChatID(42)
+	require.NoError(t, err)
+	assert.Equal(t, tbb.RoleBanned, u.UserInfo.Role)
+	assert.False(t, u.UserInfo.IsActive)
+}
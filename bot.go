@@ -1,19 +1,16 @@
 package tbb
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/NicoNex/echotron/v3"
-	"io"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 	"log/slog"
-	"net/http"
-	"regexp"
 	"runtime/debug"
-	"slices"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,15 +25,26 @@ const (
 type StateFn func(*echotron.Update) StateFn
 
 type Bot struct {
-	tbot    *TBot // Backreference to TBot instance
-	chatID  int64
-	cmd     *Command
-	handler UpdateHandler
-	state   StateFn
-	user    *User
-	logger  *slog.Logger
-	dTimer  *time.Timer // Destruction timer
-	mu      sync.Mutex
+	tbot        *TBot // Backreference to TBot instance
+	chatID      int64
+	cmd         *Command
+	cmdHandlers map[string]CommandHandler // CommandHandler instances of this session by command name
+	handler     UpdateHandler
+	state       StateFn
+	named       *ConversationState // Named state entered via NextState during the current update
+	convState   ConversationState  // Last persisted state of the conversation
+	stateData   string             // JSON encoded data of the current state
+	user        *User
+	chat        *Chat     // Group, supergroup or channel of the session, which is nil for private chats
+	countedAt   time.Time // Time of the last attempt to refresh the member count of the chat, guarded by mu
+	refreshing  bool      // Whether the user is being refreshed from Telegram, guarded by mu
+	logger      *slog.Logger
+	mu          sync.Mutex
+	umu         sync.Mutex                  // Serializes the processing of updates, so that state transitions never race
+	limiter     *rate.Limiter               // Limits the incoming updates of the chat, if configured
+	throttled   bool                        // Whether the chat exceeded the limit of incoming updates and has been asked to slow down
+	scope       atomic.Pointer[updateScope] // Context and logger of the update, which is currently processed
+	ended       bool                        // Whether the session has been ended by the SessionManager, guarded by umu
 }
 
 // ChatID returns the user chatID
@@ -54,9 +62,9 @@ func (b *Bot) User() *User {
 	return b.user
 }
 
-// Log can be used to access the logger.
+// Log can be used to access the logger. While an update is processed, the logger contains its trace and span ID.
 func (b *Bot) Log() *slog.Logger {
-	return b.logger
+	return b.currentScope().logger
 }
 
 // API returns the echotron.API
@@ -64,32 +72,63 @@ func (b *Bot) API() echotron.API {
 	return b.tbot.API()
 }
 
+// LimitedAPI returns the rate limited Telegram api, whose requests are traced within the span of the current update.
+func (b *Bot) LimitedAPI() API {
+	return b.tbot.LimitedAPI().WithContext(b.Context())
+}
+
 // TBot returns the TBot reference
 func (b *Bot) TBot() *TBot {
 	return b.tbot
 }
 
-// DB Returns the database reference
+// DB Returns the database reference, whose queries are traced within the span of the current update.
 func (b *Bot) DB() *DB {
+	if s := b.scope.Load(); s != nil {
+		return s.db(b.tbot)
+	}
 	return b.tbot.DB()
 }
 
 // IsUserActive returns true if the user is active or false otherwise
 func (b *Bot) IsUserActive() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.user.UserInfo.IsActive
 }
 
+// UpdateUser applies fn to the user of the session and saves the changes. Changes of the user should always be made
+// with UpdateUser, because the user is refreshed with data from Telegram in the background.
+func (b *Bot) UpdateUser(fn func(u *User)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn(b.user)
+	return b.saveUser()
+}
+
+// SaveUser saves the changes of the user of the session, e.g. after EnableUser or DisableUser.
+func (b *Bot) SaveUser() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.saveUser()
+}
+
+// saveUser saves the changes of the user of the session. The caller must hold mu.
+func (b *Bot) saveUser() error {
+	return b.tbot.users.Save(b.user)
+}
+
 // ReplaceMessage replaces the given CallbackQuery message with new Text and Keyboard
 func (b *Bot) ReplaceMessage(q *echotron.CallbackQuery, text string, buttons [][]echotron.InlineKeyboardButton) {
-	_, _ = b.tbot.API().EditMessageText(text, echotron.NewMessageID(b.chatID, q.Message.ID), &echotron.MessageTextOptions{ReplyMarkup: echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
+	_, _ = b.LimitedAPI().EditMessageText(text, echotron.NewMessageID(b.chatID, q.Message.ID), &echotron.MessageTextOptions{ReplyMarkup: echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
 }
 
 // DeleteMessage deletes the given CallbackQuery message
 func (b *Bot) DeleteMessage(q *echotron.CallbackQuery) {
-	_, _ = b.tbot.API().DeleteMessage(b.chatID, q.Message.ID)
+	_, _ = b.LimitedAPI().DeleteMessage(b.chatID, q.Message.ID)
 }
 
-// EnableUser enables the current user and updates the database
+// EnableUser enables the current user. Use SaveUser to update the database.
 func (b *Bot) EnableUser() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -97,7 +136,7 @@ func (b *Bot) EnableUser() {
 	b.user.UserInfo.Status = memberStatusJoin
 }
 
-// DisableUser disable the current user and update the database
+// DisableUser disables the current user. Use SaveUser to update the database.
 func (b *Bot) DisableUser() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -115,60 +154,210 @@ func (b *Bot) GetUsersTimezoneOffset() (int, error) {
 	return b.tbot.GetCurrentTimeOffset(uInfo.Latitude, uInfo.Longitude), nil
 }
 
-// Update is called whenever a Telegram update occurs
+// Update is called whenever a Telegram update occurs.
+// Updates of the same Bot session are processed one after another.
+// Updates, which have waited for a session that has been ended meanwhile, are passed to a new session of the chat.
 func (b *Bot) Update(u *echotron.Update) {
-	defer b.logRecoveredPanic()
+	b.umu.Lock()
+	if b.ended {
+		b.umu.Unlock()
+		b.tbot.session(b.chatID).Update(u)
+		return
+	}
+	defer b.umu.Unlock()
 
-	b.resetSessionTimeout()
+	// Idle sessions are ended after the timeout since their last update, which may have taken a while
+	defer b.tbot.sessions.touch(b.chatID, b)
+	defer b.tbot.metrics.observeUpdate(u, time.Now())
+	defer b.traceUpdate(u)()
 
-	// Allow only users from AllowedChatIDs to use the bot
-	if len(b.tbot.cfg.AllowedChatIDs) > 0 && !slices.Contains(b.tbot.cfg.AllowedChatIDs, u.ChatID()) {
-		if b.user.UserInfo.IsActive {
-			b.DisableUser()
-			b.DB().Save(b.user)
-		}
-		b.logger.Info("Access denied for user", "user", PrintAsJson(b.User(), false), "update", PrintAsJson(u, false))
-		return
+	b.tbot.updFn(b, u)
+}
+
+// handleUpdate is the innermost UpdateFunc, which is wrapped by the middlewares of the TBot.
+func (b *Bot) handleUpdate(u *echotron.Update) {
+	b.named = nil
+	b.handle(u)
+	b.persistState()
+}
+
+// NextState returns the StateFn registered under the given name by the handler of the current command
+// or by the UpdateHandler if there is no current command. In contrast to returning a StateFn directly,
+// a named state is persisted and therefore survives session timeouts and restarts.
+func (b *Bot) NextState(name string) StateFn {
+	var (
+		cmdName string
+		h       any = b.handler
+	)
+	if b.cmd != nil {
+		cmdName = b.cmd.Name
+		h = b.commandHandler(b.cmd)
 	}
 
-	// Check asynchronously if we need to update user information from Telegram
-	go b.updateUserData(u, updateDuration)
+	fn := lookupState(h, name)
+	if fn == nil {
+		b.Log().Error("Unknown state", "state", name, "command", cmdName)
+		return nil
+	}
+	b.named = &ConversationState{Command: cmdName, State: name}
+	return fn
+}
 
+// SetStateData stores JSON serializable data alongside the current named state.
+// The data is discarded as soon as the conversation ends.
+func (b *Bot) SetStateData(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.stateData = string(data)
+	return nil
+}
+
+// StateData decodes the data previously stored with SetStateData into v.
+func (b *Bot) StateData(v any) error {
+	if b.stateData == "" {
+		return errors.New("no state data available")
+	}
+	return json.Unmarshal([]byte(b.stateData), v)
+}
+
+func (b *Bot) handle(u *echotron.Update) {
 	// Commands always take the highest precedence
-	if cmd := b.getCommand(u); cmd != nil {
+	cmd, match := b.getCommand(u)
+	switch match {
+	case commandForeign:
+		b.Log().Debug("Ignoring command addressed to another bot", "update", PrintAsJson(u, false))
+		return
+	case commandNotPermitted:
+		// The command must neither run nor be passed to the current state or the UpdateHandler
+		return
+	case commandFound:
 		b.cmd = cmd
-		if b.cmd.Handler != nil {
-			b.cmd.Handler.SetBot(b)
-			b.state = b.cmd.Handler.Handle()
+		b.tbot.metrics.countCommand(cmd.Name)
+		b.traceAttributes(attrCommand.String(cmd.Name))
+		if h := b.commandHandler(cmd); h != nil {
+			b.traceSpan("tbb.command", func() { b.state = h.Handle() }, attrCommand.String(cmd.Name))
 		}
 		return
 	}
 
+	// Routed callback queries take precedence over the current state
+	if u.CallbackQuery != nil {
+		if state, ok := b.handleCallbackQuery(u.CallbackQuery); ok {
+			b.state = state
+			return
+		}
+	}
+
 	// This kind of message has precedence because it disables or enables the Bot
 	if u.MyChatMember != nil {
 		b.state = b.handler.HandleMyChatMember(*u.MyChatMember)
+		if u.MyChatMember.NewChatMember.Status == memberStatusLeave && GetChatTypeFromUpdate(u) == ChatTypePrivate {
+			b.tbot.notifyAdminsAsync("🚫 User blocked the bot: " + userLabel(u.MyChatMember.From))
+		}
 		return
 	}
 
 	// If bot state is nil, we set the initial state in relation to the received update
 	if b.state == nil {
 		b.cmd = nil
-		b.state = b.handleInitialState(u)
+		b.traceSpan("tbb.state", func() { b.state = b.handleInitialState(u) })
 		return
 	}
 
-	b.state = b.state(u)
+	var attrs []attribute.KeyValue
+	if b.cmd != nil {
+		attrs = append(attrs, attrCommand.String(b.cmd.Name))
+	}
+	if b.convState.State != "" {
+		attrs = append(attrs, attrState.String(b.convState.State))
+	}
+	b.traceSpan("tbb.state", func() { b.state = b.state(u) }, attrs...)
 }
 
-func (b *Bot) resetSessionTimeout() {
-	st := time.Duration(b.tbot.cfg.BotSessionTimeout) * time.Minute
-	b.dTimer.Reset(st)
-	b.logger.Debug(fmt.Sprintf("Bot istance with ChatID=%d will exire at %s", b.chatID, time.Now().Add(st)))
+// commandHandler returns the CommandHandler of this session for the given command.
+// The handler is created by Command.HandlerFn on first use and reused for all subsequent calls.
+func (b *Bot) commandHandler(c *Command) CommandHandler {
+	if c.HandlerFn == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.cmdHandlers[c.Name]
+	if !ok {
+		h = c.HandlerFn()
+		h.SetBot(b)
+		b.cmdHandlers[c.Name] = h
+	}
+	return h
+}
+
+// persistState saves the current named state of the conversation or deletes it,
+// if the conversation has ended or continues with an unnamed StateFn, which cannot be restored.
+func (b *Bot) persistState() {
+	var cs ConversationState
+	if b.state != nil && b.named != nil {
+		cs = *b.named
+		cs.Payload = b.stateData
+	} else {
+		b.stateData = ""
+	}
+
+	if cs.Command == b.convState.Command && cs.State == b.convState.State && cs.Payload == b.convState.Payload {
+		return
+	}
+
+	var err error
+	if cs.State == "" {
+		err = b.DB().DeleteConversationState(b.chatID)
+	} else {
+		cs.ChatID = b.chatID
+		cs.CreatedAt = b.convState.CreatedAt
+		err = b.DB().SaveConversationState(&cs)
+	}
+	if err != nil {
+		b.Log().Error(err.Error())
+		return
+	}
+	b.convState = cs
+}
+
+// restoreState restores the persisted named state of the conversation if there is one.
+func (b *Bot) restoreState() {
+	cs, err := b.DB().FindConversationState(b.chatID)
+	if err != nil {
+		return
+	}
+	b.convState = *cs
+
+	var h any = b.handler
+	if cs.Command != "" {
+		if b.cmd = b.tbot.getRegistryCommand(cs.Command); b.cmd == nil {
+			b.Log().Warn("Cannot restore conversation state of unknown command", "command", cs.Command, "state", cs.State)
+			return
+		}
+		h = b.commandHandler(b.cmd)
+	}
+
+	if b.state = lookupState(h, cs.State); b.state == nil {
+		b.cmd = nil
+		b.Log().Warn("Cannot restore unknown conversation state", "command", cs.Command, "state", cs.State)
+		return
+	}
+	b.named = &ConversationState{Command: cs.Command, State: cs.State}
+	b.stateData = cs.Payload
+	b.Log().Debug(fmt.Sprintf("Restored conversation state %q with ChatID=%d", cs.State, b.chatID), "command", cs.Command)
 }
 
 func (b *Bot) logRecoveredPanic() {
 	if r := recover(); r != nil {
-		b.logger.Error("Recovered panic in update", "panic", r, "stack", string(debug.Stack()))
+		b.tbot.metrics.countPanic()
+		b.traceError(fmt.Errorf("panic: %v", r))
+		b.Log().Error("Recovered panic in update", "panic", r, "stack", string(debug.Stack()))
+		b.tbot.notifyAdminsAsync(fmt.Sprintf("⚠️ Recovered panic in update of chat %d: %v", b.chatID, r))
 	}
 }
 
@@ -201,17 +390,37 @@ func (b *Bot) handleInitialState(u *echotron.Update) StateFn {
 	}
 }
 
+// lookupState returns the StateFn registered under the given name if h is a StateHandler or nil otherwise.
+func lookupState(h any, name string) StateFn {
+	sh, ok := h.(StateHandler)
+	if !ok {
+		return nil
+	}
+	return sh.States()[name]
+}
+
 func (b *Bot) handleUnknown(u *echotron.Update) StateFn {
 	jsonStr, err := json.Marshal(u)
 	if err != nil {
-		b.logger.Error(err.Error())
+		b.Log().Error(err.Error())
 	}
-	b.logger.Error("update has an unknown type", "update", string(jsonStr))
+	b.Log().Error("update has an unknown type", "update", string(jsonStr))
 	return nil
 }
 
-// Returns the command slice if available or nil if no command exists
-func (b *Bot) getCommand(u *echotron.Update) *Command {
+// commandMatch is the result of looking up the command of an update.
+type commandMatch int
+
+const (
+	commandNone         commandMatch = iota // The update contains no registered command
+	commandFound                            // The update contains a registered command the user may use
+	commandForeign                          // The command is addressed to another bot, e.g. /help@other_bot in groups
+	commandNotPermitted                     // The role of the user does not allow the command
+)
+
+// getCommand returns the registered command of the update and whether the command may be used.
+// The command is only returned if it has been found and is permitted.
+func (b *Bot) getCommand(u *echotron.Update) (*Command, commandMatch) {
 	var text string
 	switch {
 	case u.Message != nil:
@@ -219,31 +428,54 @@ func (b *Bot) getCommand(u *echotron.Update) *Command {
 	case u.EditedMessage != nil:
 		text = u.EditedMessage.Text
 	}
-	text = strings.TrimSpace(text)
-	if strings.Index(text, "/") == 0 {
-		re := regexp.MustCompile(`\s{2,}`)
-		cmd := strings.Split(re.ReplaceAllString(text, " "), " ")
 
-		c := b.tbot.getRegistryCommand(cmd[0])
-		if c != nil && len(cmd) > 1 {
-			c.Params = cmd[1:]
-		}
+	ct, ok := parseCommandText(text)
+	if !ok {
+		return nil, commandNone
+	}
+	if ct.Username != "" && !b.tbot.isOwnUsername(ct.Username) {
+		return nil, commandForeign
+	}
 
-		return c
+	c := b.tbot.getRegistryCommand(ct.Name)
+	if c == nil {
+		return nil, commandNone
 	}
-	return nil
+	if role := b.Role(); !c.allows(role) {
+		b.Log().Warn("Command not allowed for role", "command", c.Name, "role", role, "chatID", b.chatID)
+		return nil, commandNotPermitted
+	}
+	if len(ct.Params) > 0 {
+		c.Params = ct.Params
+	}
+	c.Args = ct.Args
+	if ct.Name == "/start" {
+		c.Payload = ct.Args
+	}
+	return c, commandFound
 }
 
-// updateUser updates the user infos with the current user data from Telegram
-func (b *Bot) updateUser(u *echotron.Update) error {
+// refreshUser updates the user infos with the current user data from Telegram within the scope of the update.
+// The user photo is fetched without holding mu, so that the download never blocks the processing of updates.
+func (b *Bot) refreshUser(s *updateScope, u *echotron.Update) error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	current := UserPhoto{}
+	if b.user.UserPhoto != nil {
+		current = *b.user.UserPhoto
+	}
+	chatID, userID := b.user.ChatID, b.user.ID
+	b.mu.Unlock()
 
-	var (
-		user = GetUserFromUpdate(u)
-		err  error
-	)
+	photo, err := b.fetchCurrentUserPhoto(s, chatID, userID, &current)
+	if err != nil {
+		// Warn if a user photo cannot be updated but proceed anyway
+		s.logger.Warn(err.Error())
+	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	user := GetUserFromUpdate(u)
 	b.user.Firstname = user.FirstName
 	b.user.Lastname = user.LastName
 	b.user.Username = user.Username
@@ -256,90 +488,107 @@ func (b *Bot) updateUser(u *echotron.Update) error {
 	b.user.SupportsInlineQueries = user.SupportsInlineQueries
 	b.user.CanConnectToBusiness = user.CanConnectToBusiness
 	b.user.HasMainWebApp = user.HasMainWebApp
+	b.user.UserPhoto = photo
 
-	if b.user.UserPhoto, err = b.fetchCurrentUserPhoto(); err != nil {
-		// Warn if a user photo cannot be updated but proceed anyway
-		b.Log().Warn(err.Error())
+	// Store the time of the refresh, even if nothing has changed
+	b.user.UpdatedAt = time.Now()
+	isNew := b.user.ID == 0
+	if err = b.saveUser(); err != nil {
+		return err
 	}
-
-	return b.tbot.DB().Save(b.user).Error
+	if isNew {
+		b.tbot.notifyAdminsAsync("👋 New user: " + userLabel(user))
+	}
+	return nil
 }
 
 // updateUserData updates the DB user data with data from Telegram update only if the
 // chatType is "private" and more than dur time has passed since the last update.
-func (b *Bot) updateUserData(u *echotron.Update, dur time.Duration) {
-	// Only private user chats will be saved to the database because
-	// we don't want to save channel or group infos as users in the database.
+func (b *Bot) updateUserData(s *updateScope, u *echotron.Update, dur time.Duration) {
+	// Only private user chats will be saved as users to the database.
+	// Groups, supergroups and channels are stored as Chat by the ChatRefreshMiddleware instead.
 	if GetChatTypeFromUpdate(u) != ChatTypePrivate {
 		return
 	}
 
-	// We only update user data in the database if more than dur seconds have elapsed.
-	if time.Since(b.user.UpdatedAt) < dur {
+	// We only update user data in the database if more than dur seconds have elapsed
+	// and no other update is already refreshing it.
+	b.mu.Lock()
+	if b.refreshing || time.Since(b.user.UpdatedAt) < dur {
+		b.mu.Unlock()
 		return
 	}
+	b.refreshing = true
+	b.mu.Unlock()
 
-	if err := b.updateUser(u); err != nil {
-		b.Log().Error(err.Error())
-	}
-}
+	defer func() {
+		b.mu.Lock()
+		b.refreshing = false
+		b.mu.Unlock()
+	}()
 
-func (b *Bot) destruct() {
-	b.tbot.dsp.DelSession(b.chatID)
-	b.logger.Info(fmt.Sprintf("Deleted bot instance with ChatID=%d", b.chatID))
+	if err := b.refreshUser(s, u); err != nil {
+		s.logger.Error(err.Error())
+	}
 }
 
-// fetchCurrentUserPhoto tries to update the current users photo with the data from Telegram
-func (b *Bot) fetchCurrentUserPhoto() (*UserPhoto, error) {
-	userPhoto := &UserPhoto{}
+// fetchCurrentUserPhoto returns the current photo of the user, which is stored in the FileStore if Config.UserPhotos
+// is enabled. The photo is only downloaded if it has changed since the last update.
+func (b *Bot) fetchCurrentUserPhoto(s *updateScope, chatID int64, userID uint64, current *UserPhoto) (*UserPhoto, error) {
+	if !b.tbot.cfg.UserPhotos {
+		return current, nil
+	}
 
-	res, err := b.tbot.api.GetUserProfilePhotos(b.user.ChatID, &echotron.UserProfileOptions{Offset: 0, Limit: 1})
+	res, err := b.tbot.api.GetUserProfilePhotos(chatID, &echotron.UserProfileOptions{Offset: 0, Limit: 1})
 	if err != nil {
-		return userPhoto, err
+		return current, err
 	}
 
 	if !res.Ok {
-		return userPhoto, errors.New("could not get user profile")
+		return current, errors.New("could not get user profile")
 	}
 
-	b.logger.Debug("GetUserProfilePhotos request successful!", "totalPhotos", res.Result.TotalCount)
+	s.logger.Debug("GetUserProfilePhotos request successful!", "totalPhotos", res.Result.TotalCount)
 
 	if len(res.Result.Photos) == 0 {
-		return userPhoto, nil
+		b.deleteUserPhoto(s, userID, current)
+		return &UserPhoto{UserID: userID}, nil
 	}
 
 	newestPhotoSizes := res.Result.Photos[0]
 	biggestPhotoSize := newestPhotoSizes[len(newestPhotoSizes)-1]
-
-	fileID, err := b.tbot.api.GetFile(biggestPhotoSize.FileID)
-	if err != nil {
-		return userPhoto, err
+	if biggestPhotoSize.FileUniqueID == current.FileUniqueID && current.StoredFileID != 0 {
+		return current, nil
 	}
 
-	photoURL := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.tbot.cfg.Telegram.BotToken, fileID.Result.FilePath)
-	b.logger.Debug(fileID.Result.FilePath)
-	fileRes, err := http.Get(photoURL)
+	f, err := b.tbot.StoreFile(s.ctx, biggestPhotoSize.FileID)
 	if err != nil {
-		return userPhoto, err
+		return current, err
 	}
-
-	data, err := io.ReadAll(fileRes.Body)
-	if err != nil {
-		return userPhoto, err
+	if current.StoredFileID != f.ID {
+		b.deleteUserPhoto(s, userID, current)
 	}
 
-	b.logger.Info("Updated user photo", "userID", b.user.ID)
+	s.logger.Info("Updated user photo", "userID", userID)
 
-	userPhoto = &UserPhoto{
-		UserID:       b.user.ID,
+	return &UserPhoto{
+		UserID:       userID,
 		FileID:       biggestPhotoSize.FileID,
 		FileUniqueID: biggestPhotoSize.FileUniqueID,
 		FileSize:     biggestPhotoSize.FileSize,
-		FileHash:     fmt.Sprintf("%x", md5.Sum(data)),
-		FileData:     data,
+		FileHash:     f.Hash,
+		StoredFileID: f.ID,
 		Width:        biggestPhotoSize.Width,
 		Height:       biggestPhotoSize.Height,
-	}
+	}, nil
+}
 
-	return userPhoto, nil
+// deleteUserPhoto deletes the stored file of a replaced user photo.
+func (b *Bot) deleteUserPhoto(s *updateScope, userID uint64, p *UserPhoto) {
+	if p.StoredFileID == 0 {
+		return
+	}
+	if err := b.tbot.DeleteFile(s.ctx, &File{ID: p.StoredFileID, Hash: p.FileHash}); err != nil {
+		s.logger.Warn("Cannot delete user photo", "userID", userID, "error", err)
+	}
 }
@@ -3,6 +3,7 @@ package tbb
 import (
 	"github.com/NicoNex/echotron/v3"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 	"time"
 )
@@ -42,7 +43,7 @@ func TestBot_Update(t *testing.T) {
 			{
 				Name:        "/test_command",
 				Description: "",
-				Handler:     &DefaultCommandHandler{},
+				HandlerFn:   func() CommandHandler { return &DefaultCommandHandler{} },
 			},
 		}
 		tbot := New(WithConfig(cfg), WithCommands(commands))
@@ -77,7 +78,7 @@ func TestBot_Update(t *testing.T) {
 			{
 				Name:        "/test_command",
 				Description: "",
-				Handler:     &DefaultCommandHandler{},
+				HandlerFn:   func() CommandHandler { return &DefaultCommandHandler{} },
 			},
 		}
 		tbot := New(WithConfig(cfg), WithCommands(commands))
@@ -106,3 +107,175 @@ func TestBot_Update(t *testing.T) {
 		assert.True(t, bot.User().UserInfo.IsActive)
 	})
 }
+
+func TestBot_CommandHandlerIsolation(t *testing.T) {
+	cfg := LoadConfig("test/data/test.config.yml")
+	commands := []Command{
+		{
+			Name:      "/test_command",
+			HandlerFn: func() CommandHandler { return &DefaultCommandHandler{} },
+		},
+	}
+	tbot := New(WithConfig(cfg), WithCommands(commands))
+
+	bots := make([]*Bot, 10)
+	for i := range bots {
+		bots[i] = tbot.newBot(int64(10000000+i), tbot.logger.WithGroup("bot"), func() UpdateHandler { return &DefaultUpdateHandler{} })
+		bots[i].user.UpdatedAt = time.Now()
+	}
+
+	// Run the same command in all sessions concurrently. Run with -race to detect shared handler state.
+	var wg sync.WaitGroup
+	for _, bot := range bots {
+		wg.Add(1)
+		go func(bot *Bot) {
+			defer wg.Done()
+			bot.Update(&echotron.Update{
+				Message: &echotron.Message{
+					Chat: echotron.Chat{Type: "private", ID: bot.ChatID()},
+					Text: "/test_command",
+				},
+			})
+		}(bot)
+	}
+	wg.Wait()
+
+	for _, bot := range bots {
+		h, ok := bot.cmdHandlers["/test_command"]
+		assert.True(t, ok)
+		assert.Same(t, bot, h.Bot())
+		assert.Equal(t, "/test_command", bot.Command().Name)
+	}
+	assert.NotSame(t, bots[0].cmdHandlers["/test_command"], bots[1].cmdHandlers["/test_command"])
+}
+
+type conversationTestHandler struct {
+	DefaultCommandHandler
+	answers []string
+}
+
+func (h *conversationTestHandler) States() StateRegistry {
+	return StateRegistry{"awaitAnswer": h.awaitAnswer}
+}
+
+func (h *conversationTestHandler) Handle() StateFn {
+	_ = h.Bot().SetStateData(map[string]int{"step": 1})
+	return h.Bot().NextState("awaitAnswer")
+}
+
+func (h *conversationTestHandler) awaitAnswer(u *echotron.Update) StateFn {
+	h.answers = append(h.answers, u.Message.Text)
+	return nil
+}
+
+func TestBot_ConversationState(t *testing.T) {
+	cfg := LoadConfig("test/data/test.config.yml")
+	commands := []Command{
+		{
+			Name:      "/conversation",
+			HandlerFn: func() CommandHandler { return &conversationTestHandler{} },
+		},
+	}
+	tbot := New(WithConfig(cfg), WithCommands(commands))
+	newMessage := func(text string) *echotron.Update {
+		return &echotron.Update{
+			Message: &echotron.Message{
+				Chat: echotron.Chat{Type: "private", ID: 20000000},
+				Text: text,
+			},
+		}
+	}
+	newTestBot := func() *Bot {
+		bot := tbot.newBot(20000000, tbot.logger.WithGroup("bot"), func() UpdateHandler { return &DefaultUpdateHandler{} })
+		bot.user.UpdatedAt = time.Now()
+		return bot
+	}
+
+	bot := newTestBot()
+	bot.Update(newMessage("/conversation"))
+
+	cs, err := tbot.DB().FindConversationState(20000000)
+	assert.NoError(t, err)
+	assert.Equal(t, "/conversation", cs.Command)
+	assert.Equal(t, "awaitAnswer", cs.State)
+	assert.JSONEq(t, `{"step":1}`, cs.Payload)
+
+	// A new session, e.g. after a timeout or restart, resumes the conversation
+	bot = newTestBot()
+	assert.NotNil(t, bot.state)
+	assert.Equal(t, "/conversation", bot.Command().Name)
+
+	var data map[string]int
+	assert.NoError(t, bot.StateData(&data))
+	assert.Equal(t, 1, data["step"])
+
+	bot.Update(newMessage("answer"))
+	assert.Equal(t, []string{"answer"}, bot.cmdHandlers["/conversation"].(*conversationTestHandler).answers)
+	assert.Nil(t, bot.state)
+
+	_, err = tbot.DB().FindConversationState(20000000)
+	assert.Error(t, err)
+}
+
+func TestTBot_Shutdown(t *testing.T) {
+	cfg := LoadConfig("test/data/test.config.yml")
+	tbot := New(WithConfig(cfg))
+
+	for _, chatID := range []int64{30000000, 30000001} {
+		bot := tbot.session(chatID)
+		bot.user.UpdatedAt = time.Now()
+		tbot.dispatch(&echotron.Update{
+			Message: &echotron.Message{
+				Chat: echotron.Chat{Type: "private", ID: chatID},
+				Text: "hello",
+			},
+		})
+	}
+	assert.Equal(t, 2, tbot.sessions.Len())
+
+	assert.NoError(t, tbot.Shutdown())
+	assert.Zero(t, tbot.sessions.Len())
+
+	sqlDB, err := tbot.DB().DB.DB()
+	assert.NoError(t, err)
+	assert.Error(t, sqlDB.Ping())
+}
+
+func TestBot_getCommand(t *testing.T) {
+	cfg := LoadConfig("test/data/test.config.yml")
+	commands := []Command{
+		{Name: "/start"},
+		{Name: "/help"},
+		{Name: "/stats", Roles: []Role{RoleAdmin}},
+	}
+	tbot := New(WithConfig(cfg), WithCommands(commands))
+	tbot.me = &echotron.User{Username: "my_bot"}
+	bot := tbot.newBot(40000000, tbot.logger, tbot.hFn)
+	newMessage := func(text string) *echotron.Update {
+		return &echotron.Update{Message: &echotron.Message{Chat: echotron.Chat{Type: "group", ID: 40000000}, Text: text}}
+	}
+
+	cmd, match := bot.getCommand(newMessage("/help@My_Bot"))
+	assert.Equal(t, commandFound, match)
+	assert.Equal(t, "/help", cmd.Name)
+
+	cmd, match = bot.getCommand(newMessage("/help@other_bot"))
+	assert.Equal(t, commandForeign, match)
+	assert.Nil(t, cmd)
+
+	cmd, match = bot.getCommand(newMessage("/unknown"))
+	assert.Equal(t, commandNone, match)
+	assert.Nil(t, cmd)
+
+	cmd, match = bot.getCommand(newMessage("/stats"))
+	assert.Equal(t, commandNotPermitted, match)
+	assert.Nil(t, cmd)
+
+	cmd, _ = bot.getCommand(newMessage("/start ref_42"))
+	assert.Equal(t, "ref_42", cmd.Payload)
+	assert.Equal(t, []string{"ref_42"}, cmd.Params)
+
+	cmd, _ = bot.getCommand(newMessage(`/help "two words" three`))
+	assert.Empty(t, cmd.Payload)
+	assert.Equal(t, []string{"two words", "three"}, cmd.Params)
+}
@@ -0,0 +1,250 @@
+package tbb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+const (
+	BroadcastStatusRunning = "running"
+	BroadcastStatusDone    = "done"
+
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusBlocked = "blocked" // The user blocked the bot and has been disabled
+	DeliveryStatusFailed  = "failed"
+
+	broadcastBatchSize   = 500             // Number of users and deliveries loaded from the database at once
+	broadcastRate        = 25              // Default messages per second, which leaves some room for regular replies within the global limit of 30
+	broadcastMaxAttempts = 5               // Maximum number of attempts per recipient
+	broadcastRetryDelay  = time.Second * 3 // Delay before retrying after a network error
+)
+
+// Broadcast is a message sent to all active users. The recipients are determined when the broadcast is created
+// and their delivery status is recorded as BroadcastDelivery, so that an interrupted broadcast can be resumed.
+type Broadcast struct {
+	ID         uint64 `gorm:"primaryKey"`
+	Text       string
+	Options    string `json:"-"`     // JSON encoded echotron.MessageOptions
+	Status     string `gorm:"index"` // Either "running" or "done"
+	Recipients int    `gorm:"-"`     // Number of recipients, only set by Broadcast and ResumeBroadcast
+	Sent       int    `gorm:"-"`     // Number of successful deliveries, only set by Broadcast and ResumeBroadcast
+	Blocked    int    `gorm:"-"`     // Number of users which blocked the bot, only set by Broadcast and ResumeBroadcast
+	Failed     int    `gorm:"-"`     // Number of failed deliveries, only set by Broadcast and ResumeBroadcast
+	FinishedAt *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// BroadcastDelivery is the delivery status of a Broadcast for a single recipient.
+type BroadcastDelivery struct {
+	ID          uint64 `gorm:"primaryKey"`
+	BroadcastID uint64 `gorm:"uniqueIndex:idx_broadcast_chat"`
+	ChatID      int64  `gorm:"uniqueIndex:idx_broadcast_chat"` // Telegram chatID of the recipient
+	Status      string `gorm:"index"`                          // One of "pending", "sent", "blocked" or "failed"
+	MessageID   int    // ID of the sent message
+	Attempts    int
+	Error       string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// WithBroadcastRate option sets the maximum number of broadcast messages per second, which defaults to 25.
+// Telegram allows about 30 messages per second in total, so some capacity should be left for regular replies.
+func WithBroadcastRate(perSecond float64) Option {
+	return func(app *TBot) {
+		app.bcRate = perSecond
+	}
+}
+
+// Broadcast sends the text message with the given options to all active users and blocks until all
+// messages are delivered or the context is cancelled. Users who blocked the bot are disabled.
+// The returned Broadcast can be resumed with ResumeBroadcast, if the context was cancelled or the process crashed.
+func (tb *TBot) Broadcast(ctx context.Context, text string, opts *echotron.MessageOptions) (*Broadcast, error) {
+	o, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := &Broadcast{Text: text, Options: string(o), Status: BroadcastStatusRunning}
+	err = tb.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(bc).Error; err != nil {
+			return err
+		}
+
+		var users []User
+		active := tx.Model(&UserInfo{}).Select("user_id").Where("is_active = ?", true)
+		return tx.Select("id", "chat_id").Where("id IN (?)", active).FindInBatches(&users, broadcastBatchSize, func(tx *gorm.DB, _ int) error {
+			deliveries := make([]BroadcastDelivery, 0, len(users))
+			for _, u := range users {
+				deliveries = append(deliveries, BroadcastDelivery{BroadcastID: bc.ID, ChatID: u.ChatID, Status: DeliveryStatusPending})
+			}
+			return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveries).Error
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tb.logger.Info("Broadcast created", "id", bc.ID)
+	return bc, tb.runBroadcast(ctx, bc)
+}
+
+// BroadcastAsync is like Broadcast but runs in the background until it is finished or the bot shuts down.
+// The optional done func is called with the result afterward.
+func (tb *TBot) BroadcastAsync(text string, opts *echotron.MessageOptions, done func(*Broadcast, error)) {
+	ctx := tb.Context()
+	tb.wg.Add(1)
+	go func() {
+		defer tb.wg.Done()
+		bc, err := tb.Broadcast(ctx, text, opts)
+		if done != nil {
+			done(bc, err)
+		}
+	}()
+}
+
+// ResumeBroadcast continues the delivery of the Broadcast with the given ID to all pending recipients.
+func (tb *TBot) ResumeBroadcast(ctx context.Context, id uint64) (*Broadcast, error) {
+	bc, err := tb.db.FindBroadcast(id)
+	if err != nil {
+		return nil, err
+	}
+	if bc.Status == BroadcastStatusDone {
+		return bc, tb.countDeliveries(bc)
+	}
+	return bc, tb.runBroadcast(ctx, bc)
+}
+
+// runBroadcast delivers the Broadcast to all pending recipients and marks it as done afterward.
+func (tb *TBot) runBroadcast(ctx context.Context, bc *Broadcast) error {
+	var opts *echotron.MessageOptions
+	if err := json.Unmarshal([]byte(bc.Options), &opts); err != nil {
+		return err
+	}
+
+	r := tb.bcRate
+	if r <= 0 {
+		r = broadcastRate
+	}
+	// Each recipient receives one message per broadcast, so the per-chat limit is never exceeded
+	lim := rate.NewLimiter(rate.Limit(r), 1)
+
+	var lastID uint64
+	for {
+		var batch []BroadcastDelivery
+		err := tb.db.Where("broadcast_id = ? AND status = ? AND id > ?", bc.ID, DeliveryStatusPending, lastID).
+			Order("id").Limit(broadcastBatchSize).Find(&batch).Error
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for i := range batch {
+			if err = tb.deliver(ctx, lim, bc, &batch[i], opts); err != nil {
+				return err
+			}
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+
+	now := time.Now()
+	bc.Status, bc.FinishedAt = BroadcastStatusDone, &now
+	if err := tb.db.Model(bc).Select("status", "finished_at").Updates(bc).Error; err != nil {
+		return err
+	}
+	tb.logger.Info("Broadcast finished", "id", bc.ID)
+	return tb.countDeliveries(bc)
+}
+
+// deliver sends the Broadcast to the recipient of the given delivery and records the result.
+// It only returns an error if the context is cancelled or the delivery status cannot be saved.
+func (tb *TBot) deliver(ctx context.Context, lim *rate.Limiter, bc *Broadcast, d *BroadcastDelivery, opts *echotron.MessageOptions) error {
+	for d.Status == DeliveryStatusPending {
+		if err := lim.Wait(ctx); err != nil {
+			return err
+		}
+
+		d.Attempts++
+		res, err := tb.api.WithContext(ctx).SendMessage(bc.Text, d.ChatID, opts)
+		wait := time.Duration(0)
+
+		var apiErr *echotron.APIError
+		switch {
+		case err == nil:
+			d.Status, d.MessageID, d.Error = DeliveryStatusSent, res.Result.ID, ""
+		case errors.As(err, &apiErr) && apiErr.ErrorCode() == http.StatusForbidden:
+			d.Status, d.Error = DeliveryStatusBlocked, err.Error()
+			if err = tb.disableUser(d.ChatID); err != nil {
+				tb.logger.Error("Cannot disable user", "chatID", d.ChatID, "error", err)
+			}
+		case errors.As(err, &apiErr):
+			d.Status, d.Error = DeliveryStatusFailed, err.Error()
+		default:
+			d.Error, wait = err.Error(), broadcastRetryDelay
+		}
+
+		if d.Status == DeliveryStatusPending && d.Attempts >= broadcastMaxAttempts {
+			d.Status = DeliveryStatusFailed
+		}
+		if err = tb.db.Save(d).Error; err != nil {
+			return err
+		}
+
+		if d.Status == DeliveryStatusPending {
+			tb.logger.Warn("Broadcast delivery failed, retrying", "chatID", d.ChatID, "retryIn", wait, "error", d.Error)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+	return nil
+}
+
+// countDeliveries sets the delivery counters of the Broadcast.
+func (tb *TBot) countDeliveries(bc *Broadcast) error {
+	var counts []struct {
+		Status string
+		Count  int
+	}
+	err := tb.db.Model(&BroadcastDelivery{}).Select("status, count(*) AS count").
+		Where("broadcast_id = ?", bc.ID).Group("status").Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+
+	bc.Recipients, bc.Sent, bc.Blocked, bc.Failed = 0, 0, 0, 0
+	for _, c := range counts {
+		bc.Recipients += c.Count
+		switch c.Status {
+		case DeliveryStatusSent:
+			bc.Sent = c.Count
+		case DeliveryStatusBlocked:
+			bc.Blocked = c.Count
+		case DeliveryStatusFailed:
+			bc.Failed = c.Count
+		}
+	}
+	return nil
+}
+
+// disableUser disables the user with the given chatID like Bot.DisableUser does and notifies the admins.
+func (tb *TBot) disableUser(chatID int64) error {
+	tb.notifyAdminsAsync(fmt.Sprintf("🚫 User %d blocked the bot", chatID))
+	return tb.updateUserInfo(chatID, func(u *User) {
+		u.UserInfo.IsActive = false
+		u.UserInfo.Status = memberStatusLeave
+	})
+}
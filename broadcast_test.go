@@ -0,0 +1,87 @@
+package tbb_test
+
+import (
+	"context"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func createUsers(t *testing.T, db *tbb.DB, active map[int64]bool) {
+	for chatID, isActive := range active {
+		u := &tbb.User{ChatID: chatID, UserInfo: &tbb.UserInfo{IsActive: isActive}, UserPhoto: &tbb.UserPhoto{}}
+		require.NoError(t, db.Create(u).Error)
+	}
+}
+
+func TestTBot_Broadcast(t *testing.T) {
+	t.Run("should deliver to active users, disable blocked users and retry rate limited requests", func(t *testing.T) {
+		h := tbbtest.New(t, tbb.WithBroadcastRate(1000))
+		createUsers(t, h.TBot.DB(), map[int64]bool{1: true, 2: true, 3: true, 4: false})
+
+		var (
+			mu      sync.Mutex
+			limited bool
+		)
+		h.Server.Respond("sendMessage", func(r tbbtest.Request) tbbtest.Response {
+			mu.Lock()
+			defer mu.Unlock()
+			switch r.ChatID() {
+			case 2:
+				return tbbtest.Response{ErrorCode: http.StatusForbidden, Description: "Forbidden: bot was blocked by the user"}
+			case 3:
+				if !limited {
+					limited = true
+					return tbbtest.Response{ErrorCode: http.StatusTooManyRequests, Description: "Too Many Requests: retry after 0"}
+				}
+			}
+			return tbbtest.Response{Result: map[string]any{"message_id": 1, "date": 0, "chat": map[string]any{"id": r.ChatID()}}}
+		})
+
+		bc, err := h.TBot.Broadcast(context.Background(), "Hello everyone", nil)
+		require.NoError(t, err)
+		assert.Equal(t, tbb.BroadcastStatusDone, bc.Status)
+		assert.Equal(t, 3, bc.Recipients)
+		assert.Equal(t, 2, bc.Sent)
+		assert.Equal(t, 1, bc.Blocked)
+		assert.Len(t, h.Server.Requests("sendMessage"), 4)
+		h.AssertNoMessage(4, `.*`)
+
+		u, err := h.TBot.DB().FindUserByChatID(2)
+		require.NoError(t, err)
+		assert.False(t, u.UserInfo.IsActive)
+		assert.Equal(t, "kicked", u.UserInfo.Status)
+	})
+
+	t.Run("should resume an interrupted broadcast", func(t *testing.T) {
+		h := tbbtest.New(t, tbb.WithBroadcastRate(1000))
+		createUsers(t, h.TBot.DB(), map[int64]bool{1: true, 2: true, 3: true})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		h.Server.Respond("sendMessage", func(r tbbtest.Request) tbbtest.Response {
+			cancel()
+			return tbbtest.Response{Result: map[string]any{"message_id": 1, "date": 0, "chat": map[string]any{"id": r.ChatID()}}}
+		})
+
+		bc, err := h.TBot.Broadcast(ctx, "Hello everyone", nil)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Len(t, h.Server.Requests("sendMessage"), 1)
+
+		unfinished, err := h.TBot.DB().FindUnfinishedBroadcasts()
+		require.NoError(t, err)
+		require.Len(t, unfinished, 1)
+		assert.Equal(t, bc.ID, unfinished[0].ID)
+
+		bc, err = h.TBot.ResumeBroadcast(context.Background(), bc.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 3, bc.Sent)
+		assert.Len(t, h.Server.Requests("sendMessage"), 3)
+		for _, chatID := range []int64{1, 2, 3} {
+			h.AssertMessage(chatID, `^Hello everyone$`)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package tbb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	callbackDataLimit = 64                  // Maximum length of callback data in bytes as defined by Telegram
+	callbackDataTTL   = time.Hour * 24 * 30 // Lifetime of callback payloads stored in the database
+	callbackSigLen    = 8                   // Length of the truncated HMAC signature in bytes
+	callbackRouteSep  = "|"                 // Separates the route from the payload
+	callbackSigSep    = "#"                 // Separates the signature from the route and payload
+	callbackRefPrefix = "~"                 // Marks a payload as reference to a CallbackPayload in the database
+)
+
+// CallbackHandlerFunc handles callback queries, whose route matches the pattern the handler has been registered for.
+type CallbackHandlerFunc func(b *Bot, q echotron.CallbackQuery, data *CallbackData) StateFn
+
+// CallbackData is the decoded callback data of a routed callback query.
+type CallbackData struct {
+	Route    string                         // Route of the callback data, e.g. settings:tz:Europe/Berlin
+	Wildcard string                         // Part of the route matched by the wildcard of the pattern, e.g. Europe/Berlin for settings:tz:*
+	Answer   *echotron.CallbackQueryOptions // Options of the automatic answer to the callback query, which may be set by the handler
+	payload  []byte
+}
+
+// Decode decodes the structured payload of the callback data into v.
+func (d *CallbackData) Decode(v any) error {
+	if len(d.payload) == 0 {
+		return errors.New("callback data has no payload")
+	}
+	return json.Unmarshal(d.payload, v)
+}
+
+type callbackRoute struct {
+	pattern string
+	prefix  bool // Whether the pattern ends with a wildcard
+	handler CallbackHandlerFunc
+}
+
+// match returns the part of the route matched by the wildcard and whether the route matches at all.
+func (r callbackRoute) match(route string) (string, bool) {
+	if !r.prefix {
+		return "", route == r.pattern
+	}
+	if !strings.HasPrefix(route, r.pattern) {
+		return "", false
+	}
+	return route[len(r.pattern):], true
+}
+
+// WithCallbackHandler registers a handler for callback queries, whose route matches the given pattern.
+// A pattern ending with "*" matches all routes starting with the preceding prefix, e.g. "settings:tz:*".
+// Exact patterns take precedence over wildcard patterns and longer prefixes over shorter ones.
+// Callback queries without a matching route are passed to the current state or the UpdateHandler as usual.
+func WithCallbackHandler(pattern string, h CallbackHandlerFunc) Option {
+	return func(app *TBot) {
+		r := callbackRoute{pattern: pattern, handler: h}
+		if strings.HasSuffix(pattern, "*") {
+			r.pattern, r.prefix = strings.TrimSuffix(pattern, "*"), true
+		}
+		app.cbRoutes = append(app.cbRoutes, r)
+		sort.SliceStable(app.cbRoutes, func(i, j int) bool {
+			ri, rj := app.cbRoutes[i], app.cbRoutes[j]
+			if ri.prefix != rj.prefix {
+				return !ri.prefix
+			}
+			return len(ri.pattern) > len(rj.pattern)
+		})
+	}
+}
+
+// WithCallbackSecret option enables HMAC signing of callback data created by CallbackData,
+// so that routed callback queries with forged callback data are rejected.
+func WithCallbackSecret(secret []byte) Option {
+	return func(app *TBot) {
+		app.cbSecret = secret
+	}
+}
+
+// CallbackData encodes the given route and the JSON representation of the optional payload into callback data
+// for inline keyboard buttons. Payloads which exceed the callback data limit of 64 bytes are stored in the database.
+func (tb *TBot) CallbackData(route string, payload any) (string, error) {
+	var p string
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return "", err
+		}
+		p = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	cbData := tb.signCallbackData(route, p)
+	if len(cbData) <= callbackDataLimit {
+		return cbData, nil
+	}
+	if p == "" {
+		return "", ErrCallbackDataTooLong
+	}
+
+	ref, err := tb.storeCallbackPayload(p)
+	if err != nil {
+		return "", err
+	}
+	if cbData = tb.signCallbackData(route, callbackRefPrefix+ref); len(cbData) > callbackDataLimit {
+		return "", ErrCallbackDataTooLong
+	}
+	return cbData, nil
+}
+
+// decodeCallbackData verifies and decodes callback data created by CallbackData.
+func (tb *TBot) decodeCallbackData(cbData string) (*CallbackData, error) {
+	if len(tb.cbSecret) > 0 {
+		i := strings.LastIndex(cbData, callbackSigSep)
+		if i < 0 || !hmac.Equal([]byte(cbData[i+1:]), []byte(tb.callbackSignature(cbData[:i]))) {
+			return nil, ErrCallbackDataSignature
+		}
+		cbData = cbData[:i]
+	}
+
+	route, p, _ := strings.Cut(cbData, callbackRouteSep)
+	d := &CallbackData{Route: route}
+	if p == "" {
+		return d, nil
+	}
+
+	if ref, ok := strings.CutPrefix(p, callbackRefPrefix); ok {
+		var cp CallbackPayload
+		if err := tb.db.First(&cp, "id = ? AND expires_at > ?", ref, time.Now()).Error; err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCallbackDataExpired, err)
+		}
+		p = cp.Payload
+	}
+
+	var err error
+	if d.payload, err = base64.RawURLEncoding.DecodeString(p); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (tb *TBot) signCallbackData(route, payload string) string {
+	cbData := route
+	if payload != "" {
+		cbData += callbackRouteSep + payload
+	}
+	if len(tb.cbSecret) > 0 {
+		cbData += callbackSigSep + tb.callbackSignature(cbData)
+	}
+	return cbData
+}
+
+func (tb *TBot) callbackSignature(cbData string) string {
+	mac := hmac.New(sha256.New, tb.cbSecret)
+	mac.Write([]byte(cbData))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:callbackSigLen])
+}
+
+// storeCallbackPayload stores the encoded payload in the database and returns its reference.
+// Expired payloads are deleted on the fly.
+func (tb *TBot) storeCallbackPayload(payload string) (string, error) {
+	id := make([]byte, 9)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	cp := CallbackPayload{
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		Payload:   payload,
+		ExpiresAt: time.Now().Add(callbackDataTTL),
+	}
+	if err := tb.db.Delete(&CallbackPayload{}, "expires_at < ?", time.Now()).Error; err != nil {
+		tb.logger.Warn("Cannot delete expired callback payloads", "error", err)
+	}
+	if err := tb.db.Create(&cp).Error; err != nil {
+		return "", err
+	}
+	return cp.ID, nil
+}
+
+// matchCallbackRoute returns the first route matching the callback data and the part matched by its wildcard.
+func (tb *TBot) matchCallbackRoute(cbData string) (*callbackRoute, string) {
+	route, _, _ := strings.Cut(cbData, callbackRouteSep)
+	if len(tb.cbSecret) > 0 {
+		if i := strings.LastIndex(route, callbackSigSep); i >= 0 {
+			route = route[:i]
+		}
+	}
+	for i := range tb.cbRoutes {
+		if wildcard, ok := tb.cbRoutes[i].match(route); ok {
+			return &tb.cbRoutes[i], wildcard
+		}
+	}
+	return nil, ""
+}
+
+// CallbackData encodes the given route and payload into callback data. See TBot.CallbackData for details.
+func (b *Bot) CallbackData(route string, payload any) (string, error) {
+	return b.tbot.CallbackData(route, payload)
+}
+
+// handleCallbackQuery passes the callback query to the matching CallbackHandlerFunc and answers it afterward.
+// It returns false if no route matches the callback data.
+func (b *Bot) handleCallbackQuery(q *echotron.CallbackQuery) (StateFn, bool) {
+	r, wildcard := b.tbot.matchCallbackRoute(q.Data)
+	if r == nil {
+		return nil, false
+	}
+
+	data, err := b.tbot.decodeCallbackData(q.Data)
+	if err != nil {
+		b.Log().Warn("Invalid callback data", "data", q.Data, "error", err)
+		_, _ = b.LimitedAPI().AnswerCallbackQuery(q.ID, &echotron.CallbackQueryOptions{Text: b.T("tbb.callbackInvalid")})
+		return nil, true
+	}
+	data.Wildcard = wildcard
+
+	b.cmd = nil
+	var state StateFn
+	b.traceSpan("tbb.callback", func() { state = r.handler(b, *q, data) }, attrCallbackRoute.String(r.pattern))
+	if _, err = b.LimitedAPI().AnswerCallbackQuery(q.ID, data.Answer); err != nil {
+		b.Log().Warn("Cannot answer callback query", "error", err)
+	}
+	return state, true
+}
@@ -0,0 +1,118 @@
+package tbb_test
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+type tzPayload struct {
+	Offset int    `json:"offset"`
+	Label  string `json:"label"`
+}
+
+func tzCallbackHandler(b *tbb.Bot, q echotron.CallbackQuery, data *tbb.CallbackData) tbb.StateFn {
+	var p tzPayload
+	if err := data.Decode(&p); err != nil {
+		_, _ = b.API().SendMessage("no payload: "+data.Wildcard, b.ChatID(), nil)
+		return nil
+	}
+	_, _ = b.API().SendMessage("tz: "+data.Wildcard+" "+p.Label, b.ChatID(), nil)
+	data.Answer = &echotron.CallbackQueryOptions{Text: "Saved"}
+	return nil
+}
+
+func resetCallbackHandler(b *tbb.Bot, q echotron.CallbackQuery, data *tbb.CallbackData) tbb.StateFn {
+	_, _ = b.API().SendMessage("reset", b.ChatID(), nil)
+	return nil
+}
+
+func TestTBot_CallbackData(t *testing.T) {
+	opts := []tbb.Option{
+		tbb.WithCallbackHandler("settings:*", resetCallbackHandler),
+		tbb.WithCallbackHandler("settings:tz:*", tzCallbackHandler),
+		tbb.WithCallbackSecret([]byte("secret")),
+	}
+
+	t.Run("should route to the longest matching prefix and answer the query", func(t *testing.T) {
+		h := tbbtest.New(t, opts...)
+		data, err := h.TBot.CallbackData("settings:tz:Europe/Berlin", tzPayload{Offset: 1, Label: "CET"})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 64)
+
+		h.SendCallbackQuery(42, data)
+		h.AssertMessage(42, `^tz: Europe/Berlin CET$`)
+		if req := h.AssertRequest("answerCallbackQuery"); len(req) > 0 {
+			assert.Equal(t, "Saved", req[0].Text())
+		}
+	})
+
+	t.Run("should route callback data without payload", func(t *testing.T) {
+		h := tbbtest.New(t, opts...)
+		data, err := h.TBot.CallbackData("settings:reset", nil)
+		assert.NoError(t, err)
+
+		h.SendCallbackQuery(42, data)
+		h.AssertMessage(42, `^reset$`)
+		h.AssertRequest("answerCallbackQuery")
+	})
+
+	t.Run("should store oversized payloads in the database", func(t *testing.T) {
+		h := tbbtest.New(t, opts...)
+		label := strings.Repeat("x", 200)
+		data, err := h.TBot.CallbackData("settings:tz:UTC", tzPayload{Label: label})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 64)
+
+		h.SendCallbackQuery(42, data)
+		h.AssertMessage(42, `^tz: UTC x{200}$`)
+	})
+
+	t.Run("should reject forged callback data", func(t *testing.T) {
+		h := tbbtest.New(t, opts...)
+		data, err := h.TBot.CallbackData("settings:tz:UTC", tzPayload{Label: "UTC"})
+		assert.NoError(t, err)
+
+		h.SendCallbackQuery(42, strings.Replace(data, "UTC", "CET", 1))
+		h.AssertNoMessage(42, `.*`)
+		h.AssertRequest("answerCallbackQuery")
+	})
+
+	t.Run("should fail for too long routes", func(t *testing.T) {
+		h := tbbtest.New(t, opts...)
+		_, err := h.TBot.CallbackData("settings:tz:"+strings.Repeat("x", 64), nil)
+		assert.ErrorIs(t, err, tbb.ErrCallbackDataTooLong)
+	})
+}
+
+func TestEnable_Callbacks(t *testing.T) {
+	commands := tbb.WithCommands([]tbb.Command{{Name: "/enable", HandlerFn: command.NewEnable}})
+
+	t.Run("should answer the callback query and fall back to UTC", func(t *testing.T) {
+		h := tbbtest.New(t, commands, tbb.WithCallbackSecret([]byte("secret")))
+		h.SendMessage(42, "/enable")
+		h.AssertMessage(42, `current time zone`)
+
+		h.SendCallbackQuery(42, "utc")
+		h.AssertMessage(42, `UTC timezone`)
+		h.AssertRequest("answerCallbackQuery")
+	})
+
+	t.Run("should ask again for a location instead of a callback query", func(t *testing.T) {
+		h := tbbtest.New(t, commands)
+		h.SendMessage(42, "/enable")
+		h.SendCallbackQuery(42, "update")
+		h.AssertMessage(42, `send me a valid location`)
+
+		h.SendCallbackQuery(42, "update")
+		h.AssertMessage(42, `^Please send a valid location point\.$`)
+		assert.Len(t, h.Server.Requests("answerCallbackQuery"), 2)
+
+		h.SendLocation(42, 52.52, 13.405)
+		h.AssertMessage(42, `notifications are now enabled`)
+	})
+}
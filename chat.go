@@ -0,0 +1,204 @@
+package tbb
+
+import (
+	"errors"
+	"github.com/NicoNex/echotron/v3"
+	"gorm.io/gorm"
+	"time"
+)
+
+// memberCountRetryDelay is the minimum delay between two attempts to refresh the member count of a Chat.
+const memberCountRetryDelay = time.Minute * 10
+
+// Statuses of the bot within a Chat as sent by Telegram.
+const (
+	ChatStatusCreator       = "creator"
+	ChatStatusAdministrator = "administrator"
+	ChatStatusMember        = "member"
+	ChatStatusRestricted    = "restricted"
+	ChatStatusLeft          = "left"
+	ChatStatusKicked        = "kicked"
+)
+
+// Chat is a group, supergroup or channel the bot is or has been a member of.
+// Chats are stored when the bot is added to them or receives updates from them and are deactivated
+// as soon as the bot is removed or the group is migrated to a supergroup.
+type Chat struct {
+	ID            int64      `gorm:"primaryKey;autoIncrement:false" json:"id"` // Telegram chatID
+	Type          ChatType   `gorm:"index" json:"type"`                        // One of "group", "supergroup" or "channel"
+	Title         string     `json:"title"`
+	Username      string     `json:"username,omitempty"`
+	IsForum       bool       `json:"isForum,omitempty"`
+	Status        string     `json:"status,omitempty"`             // Status of the bot in the chat, e.g. "member" or "administrator"
+	IsActive      bool       `gorm:"index" json:"isActive"`        // True, if the bot is a member of the chat
+	MemberCount   int        `json:"memberCount"`                  // Number of members of the chat
+	MemberCountAt *time.Time `json:"-"`                            // Time of the last update of MemberCount
+	MigratedTo    int64      `json:"migratedTo,omitempty"`         // ChatID of the supergroup the group has been migrated to
+	BotRights     BotRights  `gorm:"embedded;embeddedPrefix:bot_"` // Permissions of the bot in the chat
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// BotRights are the permissions of the bot within a Chat. The administrator rights are only set if the bot is an administrator.
+type BotRights struct {
+	CanSendMessages    bool `json:"canSendMessages"` // True, if the bot can send messages to the chat or post messages in the channel
+	CanManageChat      bool `json:"canManageChat,omitempty"`
+	CanPostMessages    bool `json:"canPostMessages,omitempty"` // Channels only
+	CanEditMessages    bool `json:"canEditMessages,omitempty"` // Channels only
+	CanDeleteMessages  bool `json:"canDeleteMessages,omitempty"`
+	CanRestrictMembers bool `json:"canRestrictMembers,omitempty"`
+	CanPromoteMembers  bool `json:"canPromoteMembers,omitempty"`
+	CanChangeInfo      bool `json:"canChangeInfo,omitempty"`
+	CanInviteUsers     bool `json:"canInviteUsers,omitempty"`
+	CanPinMessages     bool `json:"canPinMessages,omitempty"`
+	CanManageTopics    bool `json:"canManageTopics,omitempty"`
+}
+
+// ChatRefreshMiddleware stores the group, supergroup or channel of the update as Chat and keeps the status
+// and permissions of the bot up to date. The member count is refreshed asynchronously once per day.
+func ChatRefreshMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		if refresh := b.updateChat(u); refresh {
+			s := b.currentScope()
+			b.tbot.wg.Add(1)
+			go func() {
+				defer b.tbot.wg.Done()
+				b.updateMemberCount(s)
+			}()
+		}
+		next(b, u)
+	}
+}
+
+// Chat returns a copy of the group, supergroup or channel of the session or nil for private chats.
+func (b *Bot) Chat() *Chat {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.chat == nil {
+		return nil
+	}
+	c := *b.chat
+	return &c
+}
+
+// updateChat applies the changes of the update to the Chat of the session and saves it if necessary.
+// It returns true if the member count should be refreshed.
+func (b *Bot) updateChat(u *echotron.Update) bool {
+	ec, ok := chatFromUpdate(u)
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.chat == nil {
+		c, err := b.DB().FindChat(ec.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c = &Chat{ID: ec.ID, IsActive: true, Status: ChatStatusMember, BotRights: BotRights{CanSendMessages: true}}
+		} else if err != nil {
+			b.Log().Error("Cannot load chat", "chatID", ec.ID, "error", err)
+			return false
+		}
+		b.chat = c
+	}
+
+	c := *b.chat
+	c.Type, c.Title, c.Username, c.IsForum = ChatType(ec.Type), ec.Title, ec.Username, ec.IsForum
+
+	switch {
+	case u.MyChatMember != nil:
+		m := u.MyChatMember.NewChatMember
+		c.Status = m.Status
+		c.IsActive = m.Status != ChatStatusLeft && m.Status != ChatStatusKicked
+		c.BotRights = botRights(c.Type, m)
+		if c.IsActive {
+			c.MigratedTo = 0
+		}
+	case u.Message != nil && u.Message.MigrateToChatID != 0:
+		c.IsActive, c.MigratedTo = false, int64(u.Message.MigrateToChatID)
+	}
+
+	if c.CreatedAt.IsZero() || c != *b.chat {
+		if err := b.DB().Save(&c).Error; err != nil {
+			b.Log().Error("Cannot save chat", "chatID", c.ID, "error", err)
+			return false
+		}
+		b.chat = &c
+	}
+	if !c.IsActive || time.Since(b.countedAt) < memberCountRetryDelay {
+		return false
+	}
+	if c.MemberCountAt != nil && time.Since(*c.MemberCountAt) <= updateDuration && u.MyChatMember == nil {
+		return false
+	}
+	// The attempt is recorded before the refresh, so that updates never start another refresh while one is pending
+	b.countedAt = time.Now()
+	return true
+}
+
+// updateMemberCount fetches the member count of the Chat of the session from Telegram within the scope of the update.
+func (b *Bot) updateMemberCount(s *updateScope) {
+	res, err := b.tbot.api.GetChatMemberCount(b.chatID)
+	if err != nil {
+		s.logger.Warn("Cannot get chat member count", "chatID", b.chatID, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	err = s.db(b.tbot).Model(&Chat{}).Where("id = ?", b.chatID).
+		Updates(map[string]any{"member_count": res.Result, "member_count_at": now}).Error
+	if err != nil {
+		s.logger.Error("Cannot save chat member count", "chatID", b.chatID, "error", err)
+		return
+	}
+	if b.chat != nil {
+		b.chat.MemberCount, b.chat.MemberCountAt = res.Result, &now
+	}
+}
+
+// chatFromUpdate returns the group, supergroup or channel of the update.
+func chatFromUpdate(u *echotron.Update) (echotron.Chat, bool) {
+	c := parseUpdate(u).Chat
+	if c == nil {
+		return echotron.Chat{}, false
+	}
+
+	switch ChatType(c.Type) {
+	case ChatTypeGroup, ChatTypeSuperGroup, ChatTypeChannel:
+		return *c, true
+	default:
+		return *c, false
+	}
+}
+
+// botRights returns the BotRights of the given chat member, which is the bot itself.
+func botRights(ct ChatType, m echotron.ChatMember) BotRights {
+	switch m.Status {
+	case ChatStatusCreator:
+		return BotRights{CanSendMessages: true}
+	case ChatStatusAdministrator:
+		return BotRights{
+			CanSendMessages:    ct != ChatTypeChannel || m.CanPostMessages,
+			CanManageChat:      m.CanManageChat,
+			CanPostMessages:    m.CanPostMessages,
+			CanEditMessages:    m.CanEditMessages,
+			CanDeleteMessages:  m.CanDeleteMessages,
+			CanRestrictMembers: m.CanRestrictMembers,
+			CanPromoteMembers:  m.CanPromoteMembers,
+			CanChangeInfo:      m.CanChangeInfo,
+			CanInviteUsers:     m.CanInviteUsers,
+			CanPinMessages:     m.CanPinMessages,
+			CanManageTopics:    m.CanManageTopics,
+		}
+	case ChatStatusMember:
+		return BotRights{CanSendMessages: ct != ChatTypeChannel}
+	case ChatStatusRestricted:
+		return BotRights{CanSendMessages: m.IsMember && m.CanSendMessages}
+	default:
+		return BotRights{}
+	}
+}
@@ -0,0 +1,144 @@
+package tbb_test
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const groupChatID = -100123
+
+func myChatMember(chat echotron.Chat, member echotron.ChatMember) *echotron.Update {
+	member.User = &echotron.User{ID: tbbtest.BotID, IsBot: true}
+	return &echotron.Update{MyChatMember: &echotron.ChatMemberUpdated{
+		Chat:          chat,
+		From:          echotron.User{ID: 42, FirstName: "Test"},
+		NewChatMember: member,
+		Date:          int(time.Now().Unix()),
+	}}
+}
+
+func groupMessage(chat echotron.Chat, text string) *echotron.Update {
+	return &echotron.Update{Message: &echotron.Message{
+		ID:   1,
+		Date: int(time.Now().Unix()),
+		From: &echotron.User{ID: 42, FirstName: "Test"},
+		Chat: chat,
+		Text: text,
+	}}
+}
+
+func TestChats(t *testing.T) {
+	group := echotron.Chat{ID: groupChatID, Type: "supergroup", Title: "Test group"}
+
+	t.Run("should store the chat when the bot is added", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.Respond("getChatMemberCount", func(tbbtest.Request) tbbtest.Response {
+			return tbbtest.Response{Result: 42}
+		})
+
+		h.SendUpdate(myChatMember(group, echotron.ChatMember{Status: "administrator", CanDeleteMessages: true, CanPinMessages: true}))
+		c, err := h.TBot.DB().FindChat(groupChatID)
+		require.NoError(t, err)
+		assert.Equal(t, tbb.ChatTypeSuperGroup, c.Type)
+		assert.Equal(t, "Test group", c.Title)
+		assert.Equal(t, tbb.ChatStatusAdministrator, c.Status)
+		assert.True(t, c.IsActive)
+		assert.Equal(t, tbb.BotRights{CanSendMessages: true, CanDeleteMessages: true, CanPinMessages: true}, c.BotRights)
+
+		assert.Eventually(t, func() bool {
+			c, err := h.TBot.DB().FindChat(groupChatID)
+			return err == nil && c.MemberCount == 42
+		}, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("should update the chat from messages", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.SendUpdate(groupMessage(group, "Hello"))
+
+		renamed := group
+		renamed.Title = "Renamed group"
+		h.SendUpdate(groupMessage(renamed, "Hello"))
+
+		c, err := h.TBot.DB().FindChat(groupChatID)
+		require.NoError(t, err)
+		assert.Equal(t, "Renamed group", c.Title)
+		assert.True(t, c.BotRights.CanSendMessages)
+
+		_, err = h.TBot.DB().FindUserByChatID(groupChatID)
+		assert.Error(t, err)
+	})
+
+	t.Run("should deactivate the chat when the bot is removed", func(t *testing.T) {
+		h := tbbtest.New(t)
+		channel := echotron.Chat{ID: -100456, Type: "channel", Title: "Test channel"}
+		h.SendUpdate(myChatMember(group, echotron.ChatMember{Status: "member"}))
+		h.SendUpdate(myChatMember(channel, echotron.ChatMember{Status: "administrator", CanPostMessages: true}))
+
+		chats, err := h.TBot.DB().FindActiveChats(tbb.ChatTypeChannel)
+		require.NoError(t, err)
+		require.Len(t, chats, 1)
+		assert.True(t, chats[0].BotRights.CanSendMessages)
+
+		h.SendUpdate(myChatMember(group, echotron.ChatMember{Status: "kicked"}))
+		chats, err = h.TBot.DB().FindActiveChats()
+		require.NoError(t, err)
+		require.Len(t, chats, 1)
+		assert.Equal(t, int64(-100456), chats[0].ID)
+
+		c, err := h.TBot.DB().FindChat(groupChatID)
+		require.NoError(t, err)
+		assert.False(t, c.IsActive)
+		assert.Equal(t, tbb.BotRights{}, c.BotRights)
+	})
+
+	t.Run("should deactivate groups migrated to supergroups", func(t *testing.T) {
+		h := tbbtest.New(t)
+		old := echotron.Chat{ID: -123, Type: "group", Title: "Test group"}
+		h.SendUpdate(myChatMember(old, echotron.ChatMember{Status: "member"}))
+
+		u := groupMessage(old, "")
+		u.Message.MigrateToChatID = groupChatID
+		h.SendUpdate(u)
+
+		c, err := h.TBot.DB().FindChat(-123)
+		require.NoError(t, err)
+		assert.False(t, c.IsActive)
+		assert.Equal(t, int64(groupChatID), c.MigratedTo)
+	})
+
+	t.Run("should not refresh the member count on every update if it fails", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.Respond("getChatMemberCount", func(tbbtest.Request) tbbtest.Response {
+			return tbbtest.Response{ErrorCode: http.StatusBadRequest, Description: "Bad Request: chat not found"}
+		})
+
+		for range 3 {
+			h.SendUpdate(groupMessage(group, "Hello"))
+		}
+		require.NoError(t, h.TBot.Shutdown())
+		assert.Len(t, h.Server.Requests("getChatMemberCount"), 1)
+	})
+
+	t.Run("should deactivate the chat when the bot is removed during a flood", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.RateLimit.Updates = 0.001
+		cfg.RateLimit.UpdatesBurst = 1
+		h := tbbtest.NewWithConfig(t, cfg)
+
+		h.SendUpdate(myChatMember(group, echotron.ChatMember{Status: "member"}))
+		h.SendUpdate(groupMessage(group, "Hello"))
+		h.SendUpdate(groupMessage(group, "Hello"))
+		h.SendUpdate(myChatMember(group, echotron.ChatMember{Status: "kicked"}))
+
+		c, err := h.TBot.DB().FindChat(groupChatID)
+		require.NoError(t, err)
+		assert.False(t, c.IsActive)
+		assert.Len(t, h.Messages(groupChatID), 1)
+	})
+}
@@ -22,10 +22,10 @@ func (h *myBotHandler) HandleMessage(m echotron.Message) tbb.StateFn {
 			h.Bot().Log().Error(err.Error())
 			return nil
 		}
-		_, _ = h.Bot().API().SendMessage("Got a location: ```json\n"+tbb.PrintAsJson(tzi, true)+"\n```", m.From.ID, &echotron.MessageOptions{ParseMode: echotron.MarkdownV2})
+		_, _ = h.Bot().LimitedAPI().SendMessage("Got a location: ```json\n"+tbb.PrintAsJson(tzi, true)+"\n```", m.From.ID, &echotron.MessageOptions{ParseMode: echotron.MarkdownV2})
 		return nil
 	}
-	_, _ = h.Bot().API().SendMessage("Echo: "+m.Text, m.From.ID, nil)
+	_, _ = h.Bot().LimitedAPI().SendMessage("Echo: "+m.Text, m.From.ID, nil)
 	return nil
 }
 
@@ -39,26 +39,56 @@ func main() {
 			{
 				Name:        "/start",
 				Description: "",
-				Handler:     &command.Enable{},
+				HandlerFn:   command.NewEnable,
 			}, {
 				Name:        "/enable",
 				Description: "Enable bot notifications",
-				Handler:     &command.Enable{},
+				HandlerFn:   command.NewEnable,
 			},
 			{
 				Name:        "/disable",
 				Description: "Disable bot notifications",
-				Handler:     &command.Disable{},
+				HandlerFn:   command.NewDisable,
 			},
 			{
 				Name:        "/timezone",
 				Description: "Set your current timezone",
-				Handler:     &command.Timezone{},
+				HandlerFn:   command.NewTimezone,
+			},
+			{
+				Name:        "/language",
+				Description: "Change the language",
+				HandlerFn:   command.NewLanguage,
+			},
+			{
+				Name:      "/stats",
+				HandlerFn: command.NewStats,
+				Roles:     []tbb.Role{tbb.RoleAdmin},
+			},
+			{
+				Name:      "/ban",
+				HandlerFn: command.NewBan,
+				Roles:     []tbb.Role{tbb.RoleAdmin},
+			},
+			{
+				Name:      "/unban",
+				HandlerFn: command.NewUnban,
+				Roles:     []tbb.Role{tbb.RoleAdmin},
+			},
+			{
+				Name:      "/role",
+				HandlerFn: command.NewSetRole,
+				Roles:     []tbb.Role{tbb.RoleAdmin},
+			},
+			{
+				Name:      "/broadcast",
+				HandlerFn: command.NewBroadcast,
+				Roles:     []tbb.Role{tbb.RoleAdmin},
 			},
 			{
 				Name:        "/help",
 				Description: "Show the help message",
-				Handler:     &command.Help{},
+				HandlerFn:   command.NewHelp,
 			},
 		}),
 		tbb.WithHandlerFunc(func() tbb.UpdateHandler {
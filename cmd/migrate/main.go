@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"github.com/apperia-de/tbb/pkg/migrate"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Shows the status of the database migrations of tbb and applies or rolls them back, e.g.
+//
+//	go run ./cmd/migrate -config config.yml status
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := migrate.Run(ctx, os.Args[1:], os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -1,74 +1,360 @@
 package tbb
 
 import (
+	"errors"
+	"fmt"
 	"gopkg.in/yaml.v3"
+	"io/fs"
 	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 const (
-	defaultSessionTimout = 15 // Default bot session timeout of 15 minutes of inactivity
+	defaultSessionTimout   = 15                         // Default bot session timeout of 15 minutes of inactivity
+	defaultAPIURL          = "https://api.telegram.org" // Default Telegram Bot API server
+	defaultDownloadTimeout = 60                         // Default timeout of file downloads of 60 seconds
+	envPrefix              = "TBB"                      // Prefix of environment variables overriding the config
 )
 
+// envVarRegexp matches ${VAR} and ${VAR:-default} in yaml values.
+var envVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?}`)
+
 type Config struct {
 	Admin struct {
 		BotToken string  `yaml:"botToken"` // Telegram bot token for an admin bot to use when sending messages
 		ChatIDs  []int64 `yaml:"chatIDs"`  // Telegram chat IDs of admins
 	} `yaml:"admin"`
-	AllowedChatIDs []int64 `yaml:"allowedChatIDs"` // If set, only the specified chatIDs are allowed to use the bot. If not set or empty, all chat ids are allowed to use the bot.
+	AllowedChatIDs []int64 `yaml:"allowedChatIDs"` // If set, only the specified chatIDs are allowed to use the bot. If not set or empty, all chat ids are allowed to use the bot. Consider using roles instead.
 	Database       struct {
 		Type     string `yaml:"type"`     // one of sqlite, mysql, postgres
 		DSN      string `yaml:"dsn"`      // in the case of mysql or postgres
 		Filename string `yaml:"filename"` // in the case of sqlite
+		// If set, migrations are not applied on start but with cmd/migrate instead. The bot fails to start with pending migrations.
+		SkipMigrations bool `yaml:"skipMigrations"`
 	} `yaml:"database"`
-	Debug             bool   `yaml:"debug"`
-	BotSessionTimeout int    `yaml:"botSessionTimeout"` // Timeout in minutes, after which the bot instance will be deleted to save memory. Defaults to 15 minutes.
-	LogLevel          string `yaml:"logLevel"`
-	Telegram          struct {
-		BotToken string `yaml:"botToken"`
+	Debug             bool `yaml:"debug"`
+	BotSessionTimeout int  `yaml:"botSessionTimeout"` // Timeout in minutes, after which the bot instance will be deleted to save memory. Defaults to 15 minutes.
+	MaxSessions       int  `yaml:"maxSessions"`       // Maximum number of bot sessions, after which the least recently used ones are deleted. Unlimited if not set.
+	Files             struct {
+		Store   string `yaml:"store"`   // One of db or local. Defaults to db.
+		Dir     string `yaml:"dir"`     // Directory of the local file store
+		MaxSize int64  `yaml:"maxSize"` // Maximum size of downloaded files in bytes. Defaults to 20 MB, the download limit of Telegram.
+	} `yaml:"files"`
+	LogLevel     string `yaml:"logLevel"`
+	MessageStore struct {
+		Enabled       bool `yaml:"enabled"`       // Whether incoming updates and sent messages are stored in the database
+		RetentionDays int  `yaml:"retentionDays"` // Number of days after which stored messages are deleted. Messages are kept forever, if not set.
+		Payload       bool `yaml:"payload"`       // Whether the JSON encoded incoming updates are stored as well
+	} `yaml:"messageStore"`
+	Metrics struct {
+		Enabled     bool   `yaml:"enabled"`     // Whether Prometheus metrics are collected and served
+		Path        string `yaml:"path"`        // Path of the metrics handler. Defaults to /metrics.
+		Listen      string `yaml:"listen"`      // Listen address of the server for metrics and health checks in polling mode, if WithServer is not set
+		HealthzPath string `yaml:"healthzPath"` // Path of the liveness check. Defaults to /healthz. Use "-" to disable it.
+		ReadyzPath  string `yaml:"readyzPath"`  // Path of the readiness check. Defaults to /readyz. Use "-" to disable it.
+	} `yaml:"metrics"`
+	RateLimit struct {
+		Updates      float64 `yaml:"updates"`      // Maximum incoming updates per second and chat. Incoming updates are not limited, if not set.
+		UpdatesBurst int     `yaml:"updatesBurst"` // Number of updates a chat may send at once. Defaults to 5.
+		Message      string  `yaml:"message"`      // Reply to chats exceeding the limit. Defaults to the translated message tbb.slowDown. Use "-" for no reply.
+		Global       float64 `yaml:"global"`       // Maximum outgoing messages per second in total. Defaults to 30.
+		Chat         float64 `yaml:"chat"`         // Maximum outgoing messages per second and private chat. Defaults to 1.
+		Group        float64 `yaml:"group"`        // Maximum outgoing messages per second and group or channel. Defaults to 20 per minute.
+	} `yaml:"rateLimit"` // Outgoing messages are not limited, if the respective limit is negative.
+	Telegram struct {
+		BotToken        string `yaml:"botToken"`
+		APIURL          string `yaml:"apiURL"`          // Url of the Bot API server, e.g. a local Bot API server. Defaults to https://api.telegram.org
+		DownloadTimeout int    `yaml:"downloadTimeout"` // Timeout in seconds for downloading files. Defaults to 60 seconds.
 	} `yaml:"telegram"`
+	UserPhotos     bool `yaml:"userPhotos"`     // Whether the profile photos of users are downloaded into the FileStore. Photos were always downloaded before this option existed.
+	UserWriteDelay int  `yaml:"userWriteDelay"` // Seconds, for which changes of users are collected and then written in one transaction. Users are written immediately, if not set.
+	Webhook        struct {
+		URL                string   `yaml:"url"`                // Public url of the webhook. Updates are received by polling if not set.
+		Listen             string   `yaml:"listen"`             // Listen address of the server. Defaults to the port of the url.
+		Path               string   `yaml:"path"`               // Path of the webhook handler, e.g. behind a reverse proxy. Defaults to the path of the url.
+		SecretToken        string   `yaml:"secretToken"`        // Secret token sent by Telegram with each update. Generated on start if not set.
+		AllowedUpdates     []string `yaml:"allowedUpdates"`     // Update types to receive like "message". Telegram keeps the previous setting if not set.
+		MaxConnections     int      `yaml:"maxConnections"`     // Maximum number of simultaneous connections from Telegram. Defaults to 40.
+		DropPendingUpdates bool     `yaml:"dropPendingUpdates"` // Whether pending updates are dropped when the webhook is set
+		CertFile           string   `yaml:"certFile"`           // Certificate of the server, which serves TLS if set together with the KeyFile
+		KeyFile            string   `yaml:"keyFile"`            // Private key of the certificate
+		SelfSigned         bool     `yaml:"selfSigned"`         // Whether the certificate is self-signed and must be uploaded to Telegram
+		KeepOnShutdown     bool     `yaml:"keepOnShutdown"`     // Whether the webhook is kept on shutdown instead of being deleted
+	} `yaml:"webhook"`
 	CustomData any `yaml:"customData"`
 }
 
-// LoadConfig returns the yaml config with the given name
-func LoadConfig(filename string) *Config {
-	return loadConfig(filename)
+// ConfigOverride changes the config after it has been loaded from the yaml file and the environment.
+type ConfigOverride func(cfg *Config) error
+
+// ConfigValue returns a ConfigOverride, which sets the config value with the given path of yaml keys like
+// "telegram.botToken" or "customData.username". Lists are given as comma separated values.
+func ConfigValue(path, value string) ConfigOverride {
+	return func(cfg *Config) error {
+		if err := setConfigPath(reflect.ValueOf(cfg).Elem(), strings.Split(path, "."), value); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidConfigValue, path, err)
+		}
+		return nil
+	}
 }
 
-// LoadCustomConfig returns the config but also takes your custom struct for the "customData" into account.
-func LoadCustomConfig[T any](filename string) *Config {
-	cfg := loadConfig(filename)
-	out, err := yaml.Marshal(&cfg.CustomData)
+// LoadConfig returns the config loaded by LoadConfigE and panics on error.
+func LoadConfig(filename string, overrides ...ConfigOverride) *Config {
+	cfg, err := LoadConfigE(filename, overrides...)
 	if err != nil {
 		panic(err)
 	}
-	var custom T
-	err = yaml.Unmarshal(out, &custom)
+	return cfg
+}
+
+// LoadConfigE returns the yaml config with the given name or an error,
+// which is ErrMissingBotToken or ErrMissingDatabase if the config is incomplete.
+//
+// The config is loaded in layers, where each layer overrides the previous ones:
+//   - The yaml file, in which ${VAR} and ${VAR:-default} are replaced with the values of environment variables.
+//     A missing file is skipped.
+//   - Environment variables named TBB_ followed by the uppercase yaml keys joined by underscores,
+//     e.g. TBB_TELEGRAM_BOTTOKEN or TBB_DATABASE_DSN. Lists are given as comma separated values.
+//     If a variable is suffixed with _FILE, like TBB_TELEGRAM_BOTTOKEN_FILE, the value is read from the given file.
+//   - The given overrides.
+func LoadConfigE(filename string, overrides ...ConfigOverride) (*Config, error) {
+	return loadConfig(filename, nil, overrides)
+}
+
+// LoadCustomConfig returns the config but also takes your custom struct for the "customData" into account.
+// It panics on error.
+func LoadCustomConfig[T any](filename string, overrides ...ConfigOverride) *Config {
+	cfg, err := LoadCustomConfigE[T](filename, overrides...)
 	if err != nil {
 		panic(err)
 	}
-	cfg.CustomData = custom
 	return cfg
 }
 
-func loadConfig(filename string) *Config {
-	var cfg Config
+// LoadCustomConfigE is like LoadCustomConfig but returns an error instead of panicking.
+// The custom data is loaded in the same layers as the config by LoadConfigE. Its environment variables are prefixed
+// with TBB_CUSTOMDATA_.
+func LoadCustomConfigE[T any](filename string, overrides ...ConfigOverride) (*Config, error) {
+	return loadConfig(filename, func(cfg *Config) error {
+		out, err := yaml.Marshal(&cfg.CustomData)
+		if err != nil {
+			return err
+		}
+		var custom T
+		if err = yaml.Unmarshal(out, &custom); err != nil {
+			return err
+		}
+		if err = applyEnv(reflect.ValueOf(&custom).Elem(), envPrefix+"_CUSTOMDATA"); err != nil {
+			return err
+		}
+		cfg.CustomData = custom
+		return nil
+	}, overrides)
+}
+
+func loadConfig(filename string, custom func(cfg *Config) error, overrides []ConfigOverride) (*Config, error) {
+	var (
+		cfg  Config
+		node yaml.Node
+	)
+	// A missing yaml file is an empty layer, so that the config can be given by environment variables only
 	data, err := os.ReadFile(filename)
-	if err != nil {
-		panic(err)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
 	}
-	err = yaml.Unmarshal(data, &cfg)
-	if err != nil {
-		panic(err)
+	if err = yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if node.Kind != 0 {
+		expandEnv(&node)
+		if err = node.Decode(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if custom != nil {
+		if err = custom(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err = applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix); err != nil {
+		return nil, err
 	}
+	for _, o := range overrides {
+		if err = o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.Telegram.BotToken == "" {
-		panic("missing telegram bot token")
+		return nil, ErrMissingBotToken
 	}
-	if cfg.Database.Filename == "" {
-		panic("missing database")
+	if cfg.Database.Filename == "" && cfg.Database.DSN == "" {
+		return nil, ErrMissingDatabase
 	}
 	if cfg.BotSessionTimeout == 0 {
 		cfg.BotSessionTimeout = defaultSessionTimout
 	}
 
-	return &cfg
+	return &cfg, nil
+}
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in all scalar values of the yaml node with environment variables.
+func expandEnv(n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode && strings.Contains(n.Value, "${") {
+		n.Value = envVarRegexp.ReplaceAllStringFunc(n.Value, func(m string) string {
+			sm := envVarRegexp.FindStringSubmatch(m)
+			if v, ok := os.LookupEnv(sm[1]); ok && v != "" {
+				return v
+			}
+			return sm[3]
+		})
+		// Let the decoder resolve the type of unquoted values again, e.g. for numbers, unless the tag is explicit
+		if n.Style&(yaml.TaggedStyle|yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			n.Tag = ""
+		}
+	}
+	for _, c := range n.Content {
+		expandEnv(c)
+	}
+}
+
+// applyEnv sets the fields of the struct v from the environment variables named after the prefix and the yaml keys.
+func applyEnv(v reflect.Value, prefix string) error {
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < v.NumField(); i++ {
+		key := yamlKey(v.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		if f := v.Field(i); f.Kind() == reflect.Struct {
+			if err := applyEnv(f, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = setConfigValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidConfigValue, name, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the value of the environment variable or the content of the file given by the variable with the
+// suffix _FILE.
+func lookupEnv(name string) (string, bool, error) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true, nil
+	}
+	filename, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot read %s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// setConfigPath sets the value of the field with the given path of yaml keys in the struct v.
+func setConfigPath(v reflect.Value, path []string, value string) error {
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		// Values stored in interfaces like the custom data are not addressable and must be copied
+		c := reflect.New(v.Elem().Type()).Elem()
+		c.Set(v.Elem())
+		if err := setConfigPath(c, path, value); err != nil {
+			return err
+		}
+		v.Set(c)
+		return nil
+	}
+	if len(path) == 0 {
+		return setConfigValue(v, value)
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("unknown key %s", path[0])
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if strings.EqualFold(yamlKey(v.Type().Field(i)), path[0]) {
+			return setConfigPath(v.Field(i), path[1:], value)
+		}
+	}
+	return fmt.Errorf("unknown key %s", path[0])
+}
+
+// setConfigValue parses the string value according to the type of v and sets it.
+func setConfigValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var parts []string
+		if value != "" {
+			parts = strings.Split(value, ",")
+		}
+		s := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setConfigValue(s.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// yamlKey returns the yaml key of the struct field or an empty string if the field is not part of the yaml config.
+func yamlKey(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	switch key {
+	case "-":
+		return ""
+	case "":
+		return strings.ToLower(f.Name)
+	}
+	return key
 }
@@ -3,6 +3,9 @@ package tbb_test
 import (
 	"github.com/apperia-de/tbb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -11,12 +14,16 @@ func TestLoadConfig(t *testing.T) {
 		assert.Panics(t, func() { tbb.LoadConfig("") })
 	})
 
+	t.Run("LoadConfig should panic because the config file is a directory", func(t *testing.T) {
+		assert.Panics(t, func() { tbb.LoadConfig(t.TempDir()) })
+	})
+
 	t.Run("LoadConfig should panic because Telegram.BotToken is missing", func(t *testing.T) {
-		assert.PanicsWithValue(t, "missing telegram bot token", func() { tbb.LoadConfig("test/data/test-missing-bot-token.config.yml") })
+		assert.PanicsWithError(t, tbb.ErrMissingBotToken.Error(), func() { tbb.LoadConfig("test/data/test-missing-bot-token.config.yml") })
 	})
 
 	t.Run("LoadConfig should panic because DB is missing", func(t *testing.T) {
-		assert.PanicsWithValue(t, "missing database", func() { tbb.LoadConfig("test/data/test-missing-database.config.yml") })
+		assert.PanicsWithError(t, tbb.ErrMissingDatabase.Error(), func() { tbb.LoadConfig("test/data/test-missing-database.config.yml") })
 	})
 
 	t.Run("LoadConfig load as expected", func(t *testing.T) {
@@ -26,6 +33,36 @@ func TestLoadConfig(t *testing.T) {
 	})
 }
 
+func TestLoadConfigE(t *testing.T) {
+	t.Run("LoadConfigE returns an error because config file does not exists", func(t *testing.T) {
+		cfg, err := tbb.LoadConfigE("")
+		assert.Nil(t, cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("LoadConfigE returns an error because the config file is a directory", func(t *testing.T) {
+		cfg, err := tbb.LoadConfigE(t.TempDir())
+		assert.Nil(t, cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("LoadConfigE returns ErrMissingBotToken", func(t *testing.T) {
+		_, err := tbb.LoadConfigE("test/data/test-missing-bot-token.config.yml")
+		assert.ErrorIs(t, err, tbb.ErrMissingBotToken)
+	})
+
+	t.Run("LoadCustomConfigE returns ErrMissingDatabase", func(t *testing.T) {
+		_, err := tbb.LoadCustomConfigE[struct{}]("test/data/test-missing-database.config.yml")
+		assert.ErrorIs(t, err, tbb.ErrMissingDatabase)
+	})
+
+	t.Run("LoadConfigE load as expected", func(t *testing.T) {
+		cfg, err := tbb.LoadConfigE("test/data/test.config.yml")
+		assert.NoError(t, err)
+		assert.NotNil(t, cfg)
+	})
+}
+
 func TestLoadCustomConfig(t *testing.T) {
 	type CustomConfig struct {
 		Version   string `yaml:"version"`
@@ -58,3 +95,130 @@ func TestLoadCustomConfig(t *testing.T) {
 	})
 
 }
+
+func TestLoadConfigLayers(t *testing.T) {
+	writeConfig := func(t *testing.T, content string) string {
+		filename := filepath.Join(t.TempDir(), "config.yml")
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+		return filename
+	}
+
+	t.Run("should replace environment variables in the yaml file", func(t *testing.T) {
+		t.Setenv("TEST_BOT_TOKEN", "token-from-env")
+		t.Setenv("TEST_TIMEOUT", "42")
+		filename := writeConfig(t, `
+telegram:
+  botToken: ${TEST_BOT_TOKEN}
+database:
+  type: ${TEST_DB_TYPE:-sqlite}
+  filename: "${TEST_DB_DIR:-data}/app.db"
+botSessionTimeout: ${TEST_TIMEOUT}
+`)
+		cfg, err := tbb.LoadConfigE(filename)
+		require.NoError(t, err)
+		assert.Equal(t, "token-from-env", cfg.Telegram.BotToken)
+		assert.Equal(t, "sqlite", cfg.Database.Type)
+		assert.Equal(t, "data/app.db", cfg.Database.Filename)
+		assert.Equal(t, 42, cfg.BotSessionTimeout)
+	})
+
+	t.Run("should keep explicit tags of environment variables", func(t *testing.T) {
+		t.Setenv("TEST_PIN", "12345")
+		filename := writeConfig(t, `
+telegram:
+  botToken: token
+database:
+  filename: app.db
+customData:
+  pin: !!str ${TEST_PIN}
+  number: ${TEST_PIN}
+`)
+		cfg, err := tbb.LoadConfigE(filename)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{"pin": "12345", "number": 12345}, cfg.CustomData)
+	})
+
+	t.Run("should load the config from environment variables without a yaml file", func(t *testing.T) {
+		t.Setenv("TBB_TELEGRAM_BOTTOKEN", "token-from-env")
+		t.Setenv("TBB_DATABASE_FILENAME", "app.db")
+		cfg, err := tbb.LoadConfigE(filepath.Join(t.TempDir(), "missing.yml"))
+		require.NoError(t, err)
+		assert.Equal(t, "token-from-env", cfg.Telegram.BotToken)
+		assert.Equal(t, "app.db", cfg.Database.Filename)
+
+		t.Setenv("TBB_TELEGRAM_BOTTOKEN", "")
+		_, err = tbb.LoadConfigE(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.ErrorIs(t, err, tbb.ErrMissingBotToken)
+	})
+
+	t.Run("should override the yaml file with environment variables and secret files", func(t *testing.T) {
+		secret := filepath.Join(t.TempDir(), "dsn")
+		require.NoError(t, os.WriteFile(secret, []byte("postgres://secret\n"), 0o600))
+		t.Setenv("TBB_TELEGRAM_BOTTOKEN", "token-from-env")
+		t.Setenv("TBB_DATABASE_TYPE", "postgres")
+		t.Setenv("TBB_DATABASE_DSN_FILE", secret)
+		t.Setenv("TBB_ADMIN_CHATIDS", "1, 2")
+		t.Setenv("TBB_RATELIMIT_GLOBAL", "10.5")
+		t.Setenv("TBB_DEBUG", "false")
+
+		cfg, err := tbb.LoadConfigE("test/data/test.config.yml")
+		require.NoError(t, err)
+		assert.Equal(t, "token-from-env", cfg.Telegram.BotToken)
+		assert.Equal(t, "postgres", cfg.Database.Type)
+		assert.Equal(t, "postgres://secret", cfg.Database.DSN)
+		assert.Equal(t, []int64{1, 2}, cfg.Admin.ChatIDs)
+		assert.Equal(t, 10.5, cfg.RateLimit.Global)
+		assert.False(t, cfg.Debug)
+	})
+
+	t.Run("should reject invalid environment variables", func(t *testing.T) {
+		t.Setenv("TBB_BOTSESSIONTIMEOUT", "soon")
+		_, err := tbb.LoadConfigE("test/data/test.config.yml")
+		assert.ErrorIs(t, err, tbb.ErrInvalidConfigValue)
+	})
+
+	t.Run("should apply overrides last", func(t *testing.T) {
+		t.Setenv("TBB_TELEGRAM_BOTTOKEN", "token-from-env")
+		cfg, err := tbb.LoadConfigE("test/data/test.config.yml",
+			tbb.ConfigValue("telegram.botToken", "token-from-flag"),
+			func(cfg *tbb.Config) error {
+				cfg.LogLevel = "error"
+				return nil
+			},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, "token-from-flag", cfg.Telegram.BotToken)
+		assert.Equal(t, "error", cfg.LogLevel)
+
+		_, err = tbb.LoadConfigE("test/data/test.config.yml", tbb.ConfigValue("telegram.unknown", "x"))
+		assert.ErrorIs(t, err, tbb.ErrInvalidConfigValue)
+	})
+
+	t.Run("should validate the config after all layers", func(t *testing.T) {
+		t.Setenv("TBB_TELEGRAM_BOTTOKEN", "token-from-env")
+		_, err := tbb.LoadConfigE("test/data/test-missing-bot-token.config.yml")
+		assert.NoError(t, err)
+	})
+
+	t.Run("should apply the layers to the custom data", func(t *testing.T) {
+		type CustomConfig struct {
+			Username  string `yaml:"username"`
+			Password  string `yaml:"password"`
+			Blacklist []int  `yaml:"blacklist"`
+		}
+		t.Setenv("TEST_USERNAME", "you")
+		t.Setenv("TBB_CUSTOMDATA_BLACKLIST", "4,5")
+		filename := writeConfig(t, `
+telegram:
+  botToken: token
+database:
+  filename: app.db
+customData:
+  username: ${TEST_USERNAME}
+  password: keins
+`)
+		cfg, err := tbb.LoadCustomConfigE[CustomConfig](filename, tbb.ConfigValue("customData.password", "geheim"))
+		require.NoError(t, err)
+		assert.Equal(t, CustomConfig{Username: "you", Password: "geheim", Blacklist: []int{4, 5}}, cfg.CustomData)
+	})
+}
@@ -1,11 +1,13 @@
 package tbb
 
 import (
+	"errors"
 	"fmt"
 	"github.com/glebarez/sqlite"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"time"
 )
 
 type DB struct {
@@ -18,8 +20,38 @@ const (
 	DB_TYPE_POSTGRES = "postgres"
 )
 
-// NewDB returns a new Database connection based on the given config files
+// registerDBCallbacks registers the callbacks returned by before and after for the given operation,
+// which are called before and after every database operation.
+func registerDBCallbacks(db *gorm.DB, name string, before, after func(op string) func(*gorm.DB)) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register(name+"_before_create", before("create")),
+		cb.Create().After("gorm:create").Register(name+"_after_create", after("create")),
+		cb.Query().Before("gorm:query").Register(name+"_before_query", before("query")),
+		cb.Query().After("gorm:query").Register(name+"_after_query", after("query")),
+		cb.Update().Before("gorm:update").Register(name+"_before_update", before("update")),
+		cb.Update().After("gorm:update").Register(name+"_after_update", after("update")),
+		cb.Delete().Before("gorm:delete").Register(name+"_before_delete", before("delete")),
+		cb.Delete().After("gorm:delete").Register(name+"_after_delete", after("delete")),
+		cb.Row().Before("gorm:row").Register(name+"_before_row", before("row")),
+		cb.Row().After("gorm:row").Register(name+"_after_row", after("row")),
+		cb.Raw().Before("gorm:raw").Register(name+"_before_raw", before("raw")),
+		cb.Raw().After("gorm:raw").Register(name+"_after_raw", after("raw")),
+	)
+}
+
+// NewDB returns a new Database connection based on the given config files and panics on error.
 func NewDB(cfg *Config, gormCfg *gorm.Config) *DB {
+	db, err := NewDBE(cfg, gormCfg)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// NewDBE returns a new Database connection based on the given config files or an error,
+// which is ErrUnsupportedDatabase if the database type is unknown.
+func NewDBE(cfg *Config, gormCfg *gorm.Config) (*DB, error) {
 	var (
 		gormDB *gorm.DB
 		err    error
@@ -32,30 +64,30 @@ func NewDB(cfg *Config, gormCfg *gorm.Config) *DB {
 	switch cfg.Database.Type {
 	case DB_TYPE_SQLITE:
 		if cfg.Database.Filename == "" {
-			panic("database filename is required")
+			return nil, ErrMissingDatabaseFile
 		}
 		gormDB, err = gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?cache=shared", cfg.Database.Filename)), gormCfg)
 	case DB_TYPE_MYSQL:
 		if cfg.Database.DSN == "" {
-			panic("database DSN is required")
+			return nil, ErrMissingDatabaseDSN
 		}
 		gormDB, err = gorm.Open(mysql.Open(cfg.Database.DSN), gormCfg)
 	case DB_TYPE_POSTGRES:
 		if cfg.Database.DSN == "" {
-			panic("database DSN is required")
+			return nil, ErrMissingDatabaseDSN
 		}
 		gormDB, err = gorm.Open(postgres.Open(cfg.Database.DSN), gormCfg)
 	default:
-		panic(fmt.Sprintf("unsupported database type: %s", cfg.Database.Type))
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedDatabase, cfg.Database.Type)
 	}
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return &DB{
 		DB: gormDB,
-	}
+	}, nil
 }
 
 // FindUserByChatID return a user by Telegram chat id if exists or error otherwise.
@@ -71,3 +103,108 @@ func (db *DB) FindUserByChatID(chatID int64) (*User, error) {
 
 	return &user, nil
 }
+
+// FindConversationState returns the persisted ConversationState of the given chat if exists or error otherwise.
+func (db *DB) FindConversationState(chatID int64) (*ConversationState, error) {
+	var cs ConversationState
+	if err := db.First(&cs, "chat_id = ?", chatID).Error; err != nil {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+// SaveConversationState creates or updates the given ConversationState.
+func (db *DB) SaveConversationState(cs *ConversationState) error {
+	return db.Save(cs).Error
+}
+
+// DeleteConversationState deletes the persisted ConversationState of the given chat.
+func (db *DB) DeleteConversationState(chatID int64) error {
+	return db.Delete(&ConversationState{}, "chat_id = ?", chatID).Error
+}
+
+// FindBroadcast returns the Broadcast with the given ID if exists or error otherwise.
+func (db *DB) FindBroadcast(id uint64) (*Broadcast, error) {
+	var bc Broadcast
+	if err := db.First(&bc, id).Error; err != nil {
+		return nil, err
+	}
+	return &bc, nil
+}
+
+// FindUnfinishedBroadcasts returns all broadcasts, which have not been delivered to all recipients yet.
+// They can be continued with TBot.ResumeBroadcast.
+func (db *DB) FindUnfinishedBroadcasts() ([]Broadcast, error) {
+	var bcs []Broadcast
+	err := db.Where("status = ?", BroadcastStatusRunning).Order("id").Find(&bcs).Error
+	return bcs, err
+}
+
+// FindChat returns the group, supergroup or channel with the given Telegram chat id if exists or error otherwise.
+func (db *DB) FindChat(chatID int64) (*Chat, error) {
+	var c Chat
+	if err := db.First(&c, "id = ?", chatID).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// FindActiveChats returns all chats the bot is a member of. If types are given, only chats of these types are returned.
+func (db *DB) FindActiveChats(types ...ChatType) ([]Chat, error) {
+	var chats []Chat
+	q := db.Where("is_active = ?", true)
+	if len(types) > 0 {
+		q = q.Where("type IN ?", types)
+	}
+	err := q.Order("id").Find(&chats).Error
+	return chats, err
+}
+
+// FindMessages returns the stored messages matching the query ordered by the time they were sent.
+func (db *DB) FindMessages(q MessageQuery) ([]MessageRecord, error) {
+	var records []MessageRecord
+	order := "sent_at, id"
+	if q.Desc {
+		order = "sent_at DESC, id DESC"
+	}
+	tx := q.apply(db.Model(&MessageRecord{})).Order(order)
+	if q.Limit > 0 {
+		tx = tx.Limit(q.Limit)
+	}
+	if q.Offset > 0 {
+		tx = tx.Offset(q.Offset)
+	}
+	err := tx.Find(&records).Error
+	return records, err
+}
+
+// CountMessages returns the number of stored messages matching the query. Limit and Offset are ignored.
+func (db *DB) CountMessages(q MessageQuery) (int64, error) {
+	var n int64
+	err := q.apply(db.Model(&MessageRecord{})).Count(&n).Error
+	return n, err
+}
+
+// DeleteMessagesBefore deletes all stored messages sent before the given time and returns their number.
+func (db *DB) DeleteMessagesBefore(t time.Time) (int64, error) {
+	res := db.Where("sent_at < ?", t).Delete(&MessageRecord{})
+	return res.RowsAffected, res.Error
+}
+
+// FindFileByUniqueID returns the stored File with the given Telegram unique file ID if exists or error otherwise.
+func (db *DB) FindFileByUniqueID(uniqueID string) (*File, error) {
+	var f File
+	if err := db.First(&f, "unique_id = ?", uniqueID).Error; err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// FindFileByHash returns the first stored File with the given hash if exists or error otherwise.
+func (db *DB) FindFileByHash(hash string) (*File, error) {
+	var f File
+	if err := db.First(&f, "hash = ?", hash).Error; err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
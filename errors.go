@@ -0,0 +1,39 @@
+package tbb
+
+import "errors"
+
+// Sentinel errors returned by NewE, LoadConfigE, NewDBE, Run, StartE, StartWithWebhookE, the Migrator, the callback data and
+// the file helpers, the SessionManager and SetUserRole.
+var (
+	ErrMissingConfig        = errors.New("tbot config is missing")
+	ErrMissingBotToken      = errors.New("missing telegram bot token")
+	ErrMissingDatabase      = errors.New("missing database")
+	ErrInvalidConfigValue   = errors.New("invalid config value")
+	ErrMissingDatabaseFile  = errors.New("database filename is required")
+	ErrMissingDatabaseDSN   = errors.New("database DSN is required")
+	ErrUnsupportedDatabase  = errors.New("unsupported database type")
+	ErrMissingWebhookURL    = errors.New("webhook url is empty")
+	ErrMissingWebhookCert   = errors.New("webhook certificate is required for self-signed certificates")
+	ErrInvalidWebhookSecret = errors.New("webhook secret token must consist of 1-256 characters A-Z, a-z, 0-9, _ and -")
+	ErrInvalidWebhookPath   = errors.New("webhook path must not contain braces or whitespace")
+	ErrTimezoneData         = errors.New("cannot load time zone data")
+	ErrSetBotCommands       = errors.New("cannot set bot commands")
+	ErrGetUpdates           = errors.New("cannot get updates")
+
+	ErrInvalidMigration      = errors.New("invalid migration")
+	ErrDuplicateMigration    = errors.New("duplicate migration version")
+	ErrIrreversibleMigration = errors.New("migration cannot be rolled back")
+	ErrPendingMigrations     = errors.New("database has pending migrations")
+
+	ErrCallbackDataTooLong   = errors.New("callback data route is too long")
+	ErrCallbackDataSignature = errors.New("invalid callback data signature")
+	ErrCallbackDataExpired   = errors.New("callback data expired")
+
+	ErrFileNotFound         = errors.New("file not found")
+	ErrFileTooLarge         = errors.New("file is too large")
+	ErrMissingFileDir       = errors.New("file store directory is required")
+	ErrUnsupportedFileStore = errors.New("unsupported file store")
+
+	ErrSessionNotFound = errors.New("bot session not found")
+	ErrUnknownRole     = errors.New("unknown role")
+)
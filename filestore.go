@@ -0,0 +1,331 @@
+package tbb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/gabriel-vasile/mimetype"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	FileStoreDB    = "db"    // Stores the file data in the database
+	FileStoreLocal = "local" // Stores the file data in a local directory
+
+	defaultMaxFileSize = 20 << 20 // Telegram bots can download files of up to 20 MB
+)
+
+// FileStore stores the binary data of files by key. The key of a stored File is its hash.
+// Implementations must be safe for concurrent use.
+type FileStore interface {
+	// Put stores the data read from r under the given key and overwrites existing data.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the data stored under the given key or ErrFileNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete deletes the data stored under the given key. Deleting missing data is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// FileBlob is the data of a file stored by the DBFileStore.
+// The key column is always quoted by gorm, since key is a reserved word in MySQL.
+type FileBlob struct {
+	Key       string `gorm:"primaryKey"`
+	Data      []byte
+	CreatedAt time.Time
+}
+
+// DBFileStore is a FileStore, which stores the file data in the database.
+// It keeps whole files in memory while storing or reading them, so it is only suitable for small files.
+type DBFileStore struct {
+	db *DB
+}
+
+// NewDBFileStore returns a FileStore, which stores the file data as FileBlob in the given database.
+func NewDBFileStore(db *DB) *DBFileStore {
+	return &DBFileStore{db: db}
+}
+
+func (s *DBFileStore) Put(ctx context.Context, key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Save(&FileBlob{Key: key, Data: data}).Error
+}
+
+func (s *DBFileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var blob FileBlob
+	err := s.db.WithContext(ctx).Where(&FileBlob{Key: key}).First(&blob).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(blob.Data)), nil
+}
+
+func (s *DBFileStore) Delete(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Delete(&FileBlob{Key: key}).Error
+}
+
+// LocalFileStore is a FileStore, which stores the file data in a local directory.
+type LocalFileStore struct {
+	dir string
+}
+
+// NewLocalFileStore returns a FileStore, which stores the file data in the given directory and creates it if necessary.
+func NewLocalFileStore(dir string) (*LocalFileStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalFileStore{dir: dir}, nil
+}
+
+func (s *LocalFileStore) Put(_ context.Context, key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that readers never see partial data
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalFileStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, key)
+	}
+	return f, err
+}
+
+func (s *LocalFileStore) Delete(_ context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the given key, which is stored in a subdirectory named after the first two characters.
+func (s *LocalFileStore) path(key string) (string, error) {
+	if len(key) < 3 || filepath.Base(key) != key || key[0] == '.' {
+		return "", fmt.Errorf("invalid file key %q", key)
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+// WithFileStore option sets the FileStore used by StoreFile. By default, the FileStore is chosen by Config.Files.
+func WithFileStore(fs FileStore) Option {
+	return func(app *TBot) {
+		app.files = fs
+	}
+}
+
+// FileStore returns the FileStore used by StoreFile.
+func (tb *TBot) FileStore() FileStore {
+	return tb.files
+}
+
+// newFileStore returns the FileStore configured by Config.Files.
+func (tb *TBot) newFileStore() (FileStore, error) {
+	switch tb.cfg.Files.Store {
+	case "", FileStoreDB:
+		return NewDBFileStore(tb.db), nil
+	case FileStoreLocal:
+		if tb.cfg.Files.Dir == "" {
+			return nil, ErrMissingFileDir
+		}
+		return NewLocalFileStore(tb.cfg.Files.Dir)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFileStore, tb.cfg.Files.Store)
+	}
+}
+
+// newHTTPClient returns the HTTP client for downloading files with the configured timeouts.
+func newHTTPClient(cfg *Config) *http.Client {
+	timeout := time.Duration(cfg.Telegram.DownloadTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout * time.Second
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = timeout
+	return &http.Client{Timeout: timeout, Transport: t}
+}
+
+// maxFileSize returns the maximum size of downloaded files in bytes.
+func (tb *TBot) maxFileSize() int64 {
+	if tb.cfg.Files.MaxSize > 0 {
+		return tb.cfg.Files.MaxSize
+	}
+	return defaultMaxFileSize
+}
+
+// StoreFile downloads the file with the given fileID from Telegram into the FileStore and returns the stored File.
+// Every call creates a new File, so that every owner can delete its File with DeleteFile independently.
+// The data is deduplicated though: a file with a known UniqueID is not downloaded again and files with the same content
+// share their data in the FileStore. The file is streamed to a temporary file, so it is never kept in memory.
+// Files larger than Config.Files.MaxSize are rejected with ErrFileTooLarge.
+func (tb *TBot) StoreFile(ctx context.Context, fileID string) (*File, error) {
+	res, err := tb.api.GetFile(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if res.Result.FileSize > tb.maxFileSize() {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFileTooLarge, res.Result.FileSize)
+	}
+	if f, err := tb.storeKnownFile(ctx, res.Result.FileUniqueID); err == nil {
+		return f, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "tbb-file-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if err = tb.download(ctx, res.Result.FilePath, io.MultiWriter(tmp, h)); err != nil {
+		return nil, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	mime, err := mimetype.DetectReader(tmp)
+	if err != nil {
+		return nil, err
+	}
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		Name:      path.Base(res.Result.FilePath),
+		UniqueID:  res.Result.FileUniqueID,
+		Extension: mime.Extension(),
+		MimeType:  mime.String(),
+		Hash:      fmt.Sprintf("%x", h.Sum(nil)),
+		Size:      size,
+	}
+
+	// The data must not be deleted by DeleteFile between the check for shared data and the creation of the File
+	tb.filesMu.Lock()
+	defer tb.filesMu.Unlock()
+
+	if _, err = tb.db.FindFileByHash(f.Hash); errors.Is(err, gorm.ErrRecordNotFound) {
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err = tb.files.Put(ctx, f.Hash, tmp); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = tb.db.WithContext(ctx).Create(f).Error; err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// storeKnownFile creates a new File, which shares the data of the stored File with the given UniqueID.
+// It returns gorm.ErrRecordNotFound if no such File exists.
+func (tb *TBot) storeKnownFile(ctx context.Context, uniqueID string) (*File, error) {
+	tb.filesMu.Lock()
+	defer tb.filesMu.Unlock()
+
+	known, err := tb.db.FindFileByUniqueID(uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Name: known.Name, UniqueID: known.UniqueID, Extension: known.Extension, MimeType: known.MimeType, Hash: known.Hash, Size: known.Size}
+	if err = tb.db.WithContext(ctx).Create(f).Error; err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile returns the data of the stored File from the FileStore. The caller must close the returned reader.
+func (tb *TBot) OpenFile(ctx context.Context, f *File) (io.ReadCloser, error) {
+	return tb.files.Get(ctx, f.Hash)
+}
+
+// DeleteFile deletes the stored File and its data, unless the data is shared with another File.
+func (tb *TBot) DeleteFile(ctx context.Context, f *File) error {
+	tb.filesMu.Lock()
+	defer tb.filesMu.Unlock()
+
+	if err := tb.db.WithContext(ctx).Delete(&File{}, f.ID).Error; err != nil {
+		return err
+	}
+	if _, err := tb.db.FindFileByHash(f.Hash); !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return tb.files.Delete(ctx, f.Hash)
+}
+
+// download writes the file with the given path as returned by GetFile to w.
+// It fails with ErrFileTooLarge, if the file is larger than Config.Files.MaxSize.
+func (tb *TBot) download(ctx context.Context, filePath string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tb.fileURL(filePath), nil)
+	if err != nil {
+		return err
+	}
+	res, err := tb.httpc.Do(req)
+	if err != nil {
+		// Do not leak the bot token, which is part of the url
+		return fmt.Errorf("cannot download file %s: %w", filePath, errors.Unwrap(err))
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot download file %s: %s", filePath, res.Status)
+	}
+
+	limit := tb.maxFileSize()
+	n, err := io.Copy(w, io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, limit)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package tbb_test
+
+import (
+	"context"
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("%PDF-1.4 test document")
+
+	readFile := func(t *testing.T, h *tbbtest.Harness, f *tbb.File) []byte {
+		r, err := h.TBot.OpenFile(ctx, f)
+		require.NoError(t, err)
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return b
+	}
+
+	t.Run("should store and deduplicate files", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.AddFile("f1", data)
+		h.Server.AddFile("f2", data)
+
+		f1, err := h.TBot.StoreFile(ctx, "f1")
+		require.NoError(t, err)
+		assert.Equal(t, "unique-f1", f1.UniqueID)
+		assert.Equal(t, "application/pdf", f1.MimeType)
+		assert.Equal(t, ".pdf", f1.Extension)
+		assert.EqualValues(t, len(data), f1.Size)
+		assert.Equal(t, data, readFile(t, h, f1))
+
+		assert.Len(t, f1.Hash, 64)
+
+		// Every owner gets its own File, which shares the data
+		again, err := h.TBot.StoreFile(ctx, "f1")
+		require.NoError(t, err)
+		assert.NotEqual(t, f1.ID, again.ID)
+		assert.Equal(t, f1.Hash, again.Hash)
+		assert.Len(t, h.Server.Requests("getFile"), 2)
+		require.NoError(t, h.TBot.DeleteFile(ctx, again))
+		assert.Equal(t, data, readFile(t, h, f1))
+
+		f2, err := h.TBot.StoreFile(ctx, "f2")
+		require.NoError(t, err)
+		assert.NotEqual(t, f1.ID, f2.ID)
+		assert.Equal(t, f1.Hash, f2.Hash)
+
+		var blobs int64
+		require.NoError(t, h.TBot.DB().Model(&tbb.FileBlob{}).Count(&blobs).Error)
+		assert.EqualValues(t, 1, blobs)
+
+		// The data is shared, so it is kept until the last file is deleted
+		require.NoError(t, h.TBot.DeleteFile(ctx, f1))
+		assert.Equal(t, data, readFile(t, h, f2))
+		require.NoError(t, h.TBot.DeleteFile(ctx, f2))
+		_, err = h.TBot.OpenFile(ctx, f2)
+		assert.ErrorIs(t, err, tbb.ErrFileNotFound)
+	})
+
+	t.Run("should store files in a local directory", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Files.Store = tbb.FileStoreLocal
+		cfg.Files.Dir = t.TempDir()
+		h := tbbtest.NewWithConfig(t, cfg)
+		h.Server.AddFile("f1", data)
+
+		f, err := h.TBot.StoreFile(ctx, "f1")
+		require.NoError(t, err)
+		assert.IsType(t, &tbb.LocalFileStore{}, h.TBot.FileStore())
+		assert.Equal(t, data, readFile(t, h, f))
+
+		require.NoError(t, h.TBot.DeleteFile(ctx, f))
+		_, err = h.TBot.OpenFile(ctx, f)
+		assert.ErrorIs(t, err, tbb.ErrFileNotFound)
+	})
+
+	t.Run("should reject files exceeding the maximum size", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Files.MaxSize = 10
+		h := tbbtest.NewWithConfig(t, cfg)
+		h.Server.AddFile("f1", data)
+
+		_, err := h.TBot.StoreFile(ctx, "f1")
+		assert.ErrorIs(t, err, tbb.ErrFileTooLarge)
+		_, err = h.TBot.DownloadFile("f1")
+		assert.ErrorIs(t, err, tbb.ErrFileTooLarge)
+	})
+
+	t.Run("should download files into memory", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.AddFile("f1", data)
+
+		f, err := h.TBot.DownloadFile("f1")
+		require.NoError(t, err)
+		assert.Equal(t, data, f.Data)
+		assert.Equal(t, "application/pdf", f.MimeType)
+		assert.Len(t, f.Hash, 64)
+	})
+
+	t.Run("should keep shared data while deleting files concurrently", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.AddFile("f1", data)
+		h.Server.AddFile("f2", data)
+
+		for range 20 {
+			f1, err := h.TBot.StoreFile(ctx, "f1")
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, h.TBot.DeleteFile(ctx, f1))
+			}()
+			f2, err := h.TBot.StoreFile(ctx, "f2")
+			wg.Wait()
+			require.NoError(t, err)
+
+			assert.Equal(t, data, readFile(t, h, f2))
+			require.NoError(t, h.TBot.DeleteFile(ctx, f2))
+		}
+	})
+}
+
+func TestUserPhotos(t *testing.T) {
+	photo := []byte("\x89PNG\r\n\x1a\n test photo")
+	profilePhotos := func(tbbtest.Request) tbbtest.Response {
+		return tbbtest.Response{Result: echotron.UserProfilePhotos{TotalCount: 1, Photos: [][]echotron.PhotoSize{{
+			{FileID: "small", FileUniqueID: "unique-small", Width: 160, Height: 160},
+			{FileID: "p1", FileUniqueID: "unique-p1", Width: 640, Height: 640, FileSize: len(photo)},
+		}}}}
+	}
+	findPhoto := func(t *testing.T, h *tbbtest.Harness) *tbb.UserPhoto {
+		var p *tbb.UserPhoto
+		require.Eventually(t, func() bool {
+			u, err := h.TBot.DB().FindUserByChatID(42)
+			if err != nil || u.UserPhoto == nil || u.UserPhoto.StoredFileID == 0 {
+				return false
+			}
+			p = u.UserPhoto
+			return true
+		}, time.Second*5, time.Millisecond*10)
+		return p
+	}
+
+	t.Run("should store the photo in the file store and skip unchanged photos", func(t *testing.T) {
+		cfg := &tbb.Config{UserPhotos: true}
+		cfg.Database.Type = tbb.DB_TYPE_SQLITE
+		cfg.Database.Filename = filepath.Join(t.TempDir(), "photos.db")
+		h := tbbtest.NewWithConfig(t, cfg)
+		h.Server.Respond("getUserProfilePhotos", profilePhotos)
+		h.Server.AddFile("p1", photo)
+
+		h.SendMessage(42, "Hello")
+		p := findPhoto(t, h)
+		assert.Equal(t, "unique-p1", p.FileUniqueID)
+		assert.Equal(t, 640, p.Width)
+
+		r, err := h.TBot.OpenFile(context.Background(), &tbb.File{Hash: p.FileHash})
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, photo, data)
+		require.NoError(t, h.TBot.Shutdown())
+
+		// Force a refresh of the user data by another bot instance
+		h = tbbtest.NewWithConfig(t, cfg)
+		h.Server.Respond("getUserProfilePhotos", profilePhotos)
+		require.NoError(t, h.TBot.DB().Model(&tbb.User{}).Where("chat_id = ?", 42).UpdateColumn("updated_at", time.Now().AddDate(0, 0, -2)).Error)
+
+		h.SendMessage(42, "Hello")
+		require.NoError(t, h.TBot.Shutdown())
+		h.AssertRequest("getUserProfilePhotos")
+		assert.Empty(t, h.Server.Requests("getFile"))
+	})
+
+	t.Run("should process updates while the photo is downloaded", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		h := tbbtest.NewWithConfig(t, &tbb.Config{UserPhotos: true})
+		h.Server.Respond("getUserProfilePhotos", func(req tbbtest.Request) tbbtest.Response {
+			<-release
+			return profilePhotos(req)
+		})
+
+		h.SendMessage(42, "Hello")
+		require.Eventually(t, func() bool {
+			return len(h.Server.Requests("getUserProfilePhotos")) > 0
+		}, time.Second*5, time.Millisecond*10)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.SendMessage(42, "Hello again")
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("update blocked by the refresh of the user photo")
+		}
+	})
+
+	t.Run("should not fetch photos if disabled", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.Respond("getUserProfilePhotos", profilePhotos)
+		h.SendMessage(42, "Hello")
+		require.NoError(t, h.TBot.Shutdown())
+		assert.Empty(t, h.Server.Requests("getUserProfilePhotos"))
+	})
+
+	t.Run("should move photos stored in the database into the file store", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Database.Type = tbb.DB_TYPE_SQLITE
+		cfg.Database.Filename = filepath.Join(t.TempDir(), "legacy.db")
+		db, err := tbb.NewDBE(cfg, nil)
+		require.NoError(t, err)
+		require.NoError(t, db.AutoMigrate(&tbb.User{}, &tbb.UserInfo{}, &tbb.UserPhoto{}))
+		require.NoError(t, db.Exec("ALTER TABLE user_photos ADD COLUMN file_data blob").Error)
+		require.NoError(t, db.Create(&tbb.User{ChatID: 42, UserInfo: &tbb.UserInfo{}, UserPhoto: &tbb.UserPhoto{FileUniqueID: "unique-p1"}}).Error)
+		require.NoError(t, db.Exec("UPDATE user_photos SET file_data = ?", photo).Error)
+		sqlDB, err := db.DB.DB()
+		require.NoError(t, err)
+		require.NoError(t, sqlDB.Close())
+
+		h := tbbtest.NewWithConfig(t, cfg)
+		assert.False(t, h.TBot.DB().Migrator().HasColumn(&tbb.UserPhoto{}, "file_data"))
+		u, err := h.TBot.DB().FindUserByChatID(42)
+		require.NoError(t, err)
+		require.NotZero(t, u.UserPhoto.StoredFileID)
+
+		f, err := h.TBot.DB().FindFileByUniqueID("unique-p1")
+		require.NoError(t, err)
+		assert.Equal(t, u.UserPhoto.StoredFileID, f.ID)
+		assert.Equal(t, "image/png", f.MimeType)
+		r, err := h.TBot.OpenFile(context.Background(), f)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, photo, data)
+	})
+}
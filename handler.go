@@ -12,9 +12,26 @@ type CommandRegistry map[string]Command
 type Command struct {
 	Name        string
 	Description string
-	Params      []string
+	Params      []string // Arguments of the command, where quoted arguments like "two words" count as one
+	Args        string   // Raw argument text following the command
+	Payload     string   // Deep-link payload of the /start command, e.g. "abc" for https://t.me/<bot_username>?start=abc
 	Data        any
-	Handler     CommandHandler
+	Roles       []Role           // Roles which may use the command, or all roles except RoleBanned if empty
+	HandlerFn   CommandHandlerFn // Creates the CommandHandler, which is called once for each Bot session.
+}
+
+// CommandHandlerFn returns a new CommandHandler instance.
+// Every Bot session gets its own instance, so that state kept inside a handler is never shared between users.
+type CommandHandlerFn func() CommandHandler
+
+// StateRegistry maps state names to their StateFn.
+type StateRegistry map[string]StateFn
+
+// StateHandler can be implemented by a CommandHandler or an UpdateHandler to register named states.
+// Named states, which are entered via Bot.NextState, are persisted in the database and restored
+// when a new Bot session is created, so that multistep conversations resume where they left off.
+type StateHandler interface {
+	States() StateRegistry
 }
 
 type CommandHandler interface {
@@ -140,7 +157,9 @@ func (h *DefaultUpdateHandler) HandleMyChatMember(c echotron.ChatMemberUpdated)
 		// User blocked the Bot
 		h.bot.Log().Info("Bot blocked by user", "status", status, "user", h.bot.user.Firstname)
 		h.bot.DisableUser()
-		h.bot.DB().Save(h.bot.user)
+		if err := h.bot.SaveUser(); err != nil {
+			h.bot.Log().Error("Cannot save user", "error", err)
+		}
 	default:
 		// Unknown
 		h.bot.Log().Info("MyChatMember.Status", "status", status, "user", c.From)
@@ -0,0 +1,427 @@
+package tbb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// PluralForm is the plural category of a number as defined by the Unicode CLDR.
+type PluralForm string
+
+const (
+	PluralZero  PluralForm = "zero"
+	PluralOne   PluralForm = "one"
+	PluralTwo   PluralForm = "two"
+	PluralFew   PluralForm = "few"
+	PluralMany  PluralForm = "many"
+	PluralOther PluralForm = "other"
+)
+
+// PluralRule returns the PluralForm for the given number.
+type PluralRule func(n int) PluralForm
+
+// DefaultCatalog is the Catalog used by all bots, which have not been configured with WithCatalog.
+// Packages providing commands, like pkg/command, register their translations here.
+var DefaultCatalog = NewCatalog("en")
+
+// Message is a translated message, which is either a single text or a text per PluralForm.
+// In catalog files, a message is either a string or a map of plural forms to strings, e.g. {one: ..., other: ...}.
+type Message struct {
+	Text   string
+	Plural map[PluralForm]string
+}
+
+// Catalog holds translated messages by language code and message key.
+// Message keys may be nested in catalog files and are flattened with dots, e.g. help.message.
+type Catalog struct {
+	mu       sync.RWMutex
+	fallback string
+	messages map[string]map[string]Message
+	rules    map[string]PluralRule
+}
+
+// NewCatalog returns an empty Catalog, which falls back to the given language code for missing translations.
+func NewCatalog(fallback string) *Catalog {
+	return &Catalog{
+		fallback: normalizeLanguage(fallback),
+		messages: map[string]map[string]Message{},
+		rules:    map[string]PluralRule{},
+	}
+}
+
+// WithCatalog option replaces the DefaultCatalog used for translating messages.
+func WithCatalog(c *Catalog) Option {
+	return func(app *TBot) {
+		app.catalog = c
+	}
+}
+
+// Fallback returns the language code used for missing translations.
+func (c *Catalog) Fallback() string {
+	return c.fallback
+}
+
+// Add adds the given messages for the language code and overrides existing messages with the same key.
+func (c *Catalog) Add(lang string, messages map[string]Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lang = normalizeLanguage(lang)
+	if c.messages[lang] == nil {
+		c.messages[lang] = map[string]Message{}
+	}
+	for k, m := range messages {
+		c.messages[lang][k] = m
+	}
+}
+
+// SetPluralRule sets the PluralRule for the given language code and overrides the built-in rule.
+func (c *Catalog) SetPluralRule(lang string, rule PluralRule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules[normalizeLanguage(lang)] = rule
+}
+
+// LoadDir loads all catalog files from the given directory. See LoadFS for details.
+func (c *Catalog) LoadDir(dir string) error {
+	return c.LoadFS(os.DirFS(dir), ".")
+}
+
+// LoadFS loads all catalog files with the extensions .yml, .yaml or .json from the given directory of fsys,
+// which can be an embed.FS. The language code is taken from the filename, e.g. de.yml or pt-BR.json.
+func (c *Catalog) LoadFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		ext := path.Ext(e.Name())
+		if e.IsDir() || (ext != ".yml" && ext != ".yaml" && ext != ".json") {
+			continue
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+
+		var raw map[string]any
+		if ext == ".json" {
+			err = json.Unmarshal(data, &raw)
+		} else {
+			err = yaml.Unmarshal(data, &raw)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot load catalog file %s: %w", e.Name(), err)
+		}
+
+		messages := map[string]Message{}
+		if err = flattenMessages("", raw, messages); err != nil {
+			return fmt.Errorf("cannot load catalog file %s: %w", e.Name(), err)
+		}
+		c.Add(strings.TrimSuffix(e.Name(), ext), messages)
+	}
+	return nil
+}
+
+// Languages returns the sorted language codes of all loaded translations.
+func (c *Catalog) Languages() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	langs := make([]string, 0, len(c.messages))
+	for l := range c.messages {
+		langs = append(langs, l)
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+// Lookup returns the message with the given key in the exact language without any fallback.
+func (c *Catalog) Lookup(lang, key string) (Message, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.messages[normalizeLanguage(lang)][key]
+	return m, ok
+}
+
+// Translate returns the message with the given key in the given language, formatted with the given args
+// like fmt.Sprintf. If the language is not available, the base language (e.g. pt for pt-br) and finally the fallback
+// language is used. If the key does not exist at all, the key itself is returned.
+// For plural messages, the first argument must be an integer, which selects the plural form.
+func (c *Catalog) Translate(lang, key string, args ...any) string {
+	if text, ok := c.translate(lang, key, args); ok {
+		return text
+	}
+	return key
+}
+
+func (c *Catalog) translate(lang, key string, args []any) (string, bool) {
+	lang = normalizeLanguage(lang)
+	base, _, _ := strings.Cut(lang, "-")
+
+	for _, l := range []string{lang, base, c.fallback} {
+		if m, ok := c.Lookup(l, key); ok {
+			return c.format(l, m, args), true
+		}
+	}
+	return "", false
+}
+
+func (c *Catalog) format(lang string, m Message, args []any) string {
+	text := m.Text
+	if len(m.Plural) > 0 {
+		n := 0
+		if len(args) > 0 {
+			n, _ = toInt(args[0])
+		}
+		var ok bool
+		if text, ok = m.Plural[c.pluralForm(lang, n)]; !ok {
+			text = m.Plural[PluralOther]
+		}
+	}
+
+	// Texts without verbs, like the plural form "One user", ignore their arguments
+	if len(args) == 0 || !strings.Contains(text, "%") {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+func (c *Catalog) pluralForm(lang string, n int) PluralForm {
+	base, _, _ := strings.Cut(lang, "-")
+
+	c.mu.RLock()
+	rule, ok := c.rules[lang]
+	if !ok {
+		rule, ok = c.rules[base]
+	}
+	c.mu.RUnlock()
+
+	if !ok {
+		if rule, ok = pluralRules[base]; !ok {
+			rule = pluralOneOther
+		}
+	}
+	return rule(n)
+}
+
+// pluralRules are the built-in plural rules. Languages without a rule use pluralOneOther.
+var pluralRules = map[string]PluralRule{
+	"fr": func(n int) PluralForm {
+		if n == 0 || n == 1 {
+			return PluralOne
+		}
+		return PluralOther
+	},
+	"ru": pluralSlavic,
+	"uk": pluralSlavic,
+	"pl": func(n int) PluralForm {
+		switch {
+		case n == 1:
+			return PluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return PluralFew
+		default:
+			return PluralMany
+		}
+	},
+	"ja": pluralOther,
+	"ko": pluralOther,
+	"zh": pluralOther,
+	"tr": pluralOther,
+}
+
+func pluralOneOther(n int) PluralForm {
+	if n == 1 {
+		return PluralOne
+	}
+	return PluralOther
+}
+
+func pluralOther(int) PluralForm {
+	return PluralOther
+}
+
+func pluralSlavic(n int) PluralForm {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return PluralOne
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return PluralFew
+	default:
+		return PluralMany
+	}
+}
+
+// flattenMessages flattens nested catalog maps into messages with dotted keys.
+// Maps which only contain plural forms are treated as plural messages.
+func flattenMessages(prefix string, raw map[string]any, messages map[string]Message) error {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		switch v := v.(type) {
+		case string:
+			messages[key] = Message{Text: v}
+		case map[string]any:
+			if plural, ok := pluralForms(v); ok {
+				messages[key] = Message{Plural: plural}
+				continue
+			}
+			if err := flattenMessages(key, v, messages); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid message %q of type %T", key, v)
+		}
+	}
+	return nil
+}
+
+// pluralForms returns the given map as plural forms if it only contains plural form keys with string values.
+func pluralForms(raw map[string]any) (map[PluralForm]string, bool) {
+	res := map[PluralForm]string{}
+	for k, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		switch f := PluralForm(k); f {
+		case PluralZero, PluralOne, PluralTwo, PluralFew, PluralMany, PluralOther:
+			res[f] = s
+		default:
+			return nil, false
+		}
+	}
+	return res, len(res) > 0
+}
+
+func normalizeLanguage(lang string) string {
+	return strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+}
+
+func toInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int8:
+		return int(n), true
+	case int16:
+		return int(n), true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case uint:
+		return int(n), true
+	case uint8:
+		return int(n), true
+	case uint16:
+		return int(n), true
+	case uint32:
+		return int(n), true
+	case uint64:
+		return int(n), true
+	default:
+		return 0, false
+	}
+}
+
+// Catalog returns the Catalog used for translating messages.
+func (tb *TBot) Catalog() *Catalog {
+	return tb.catalog
+}
+
+// T translates the message with the given key into the given language. See Catalog.Translate for details.
+// Messages missing in a custom Catalog are looked up in the DefaultCatalog.
+func (tb *TBot) T(lang, key string, args ...any) string {
+	if text, ok := tb.catalog.translate(lang, key, args); ok {
+		return text
+	}
+	if tb.catalog != DefaultCatalog {
+		if text, ok := DefaultCatalog.translate(lang, key, args); ok {
+			return text
+		}
+	}
+	return key
+}
+
+// T translates the message with the given key into the language of the current user. See Catalog.Translate for details.
+func (b *Bot) T(key string, args ...any) string {
+	return b.tbot.T(b.Language(), key, args...)
+}
+
+// Language returns the language code of the current user, which is either the language chosen via
+// UserInfo.Language or the language of the user's Telegram client.
+func (b *Bot) Language() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.user.language()
+}
+
+// SetLanguage sets the language code of the current user, which overrides the language of the user's Telegram client,
+// and saves the user. An empty language code resets the language to the one of the Telegram client.
+func (b *Bot) SetLanguage(lang string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.user.UserInfo.Language = normalizeLanguage(lang)
+	return b.saveUser()
+}
+
+// setLocalizedBotCommands registers the default command menu for all languages of the Catalog.
+// Languages without any translated command description are skipped.
+func (tb *TBot) setLocalizedBotCommands() error {
+	for _, lang := range tb.catalog.Languages() {
+		bc, translated := tb.commandsForRole(RoleMember, lang)
+		if !translated {
+			continue
+		}
+		if _, err := tb.api.SetMyCommands(&echotron.CommandOptions{LanguageCode: lang}, bc...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupMessage returns the message with the given key in the exact language from the Catalog or the DefaultCatalog.
+func (tb *TBot) lookupMessage(lang, key string) (Message, bool) {
+	if lang == "" {
+		return Message{}, false
+	}
+	if m, ok := tb.catalog.Lookup(lang, key); ok {
+		return m, true
+	}
+	return DefaultCatalog.Lookup(lang, key)
+}
+
+// language returns the language code chosen by the user or the language of the user's Telegram client.
+func (u *User) language() string {
+	if u.UserInfo != nil && u.UserInfo.Language != "" {
+		return u.UserInfo.Language
+	}
+	return u.LanguageCode
+}
+
+func init() {
+	DefaultCatalog.Add("en", map[string]Message{
+		"tbb.callbackInvalid": {Text: "This button is no longer valid."},
+		"tbb.slowDown":        {Text: "You are sending too many messages. Please slow down."},
+	})
+	DefaultCatalog.Add("de", map[string]Message{
+		"tbb.callbackInvalid": {Text: "Diese Schaltfläche ist nicht mehr gültig."},
+		"tbb.slowDown":        {Text: "Du sendest zu viele Nachrichten. Bitte etwas langsamer."},
+	})
+}
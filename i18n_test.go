@@ -0,0 +1,98 @@
+package tbb_test
+
+import (
+	"context"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCatalog(t *testing.T) {
+	fsys := fstest.MapFS{
+		"locales/en.yml":    {Data: []byte("greeting: Hello %s\nusers:\n  one: '%d user'\n  other: '%d users'\nitems:\n  one: One item\n  other: '%d items'\nnested:\n  key: Nested\n")},
+		"locales/de.json":   {Data: []byte(`{"greeting": "Hallo %s", "users": {"one": "%d Nutzer", "other": "%d Nutzer"}}`)},
+		"locales/ru.yml":    {Data: []byte("users:\n  one: '%d пользователь'\n  few: '%d пользователя'\n  many: '%d пользователей'\n")},
+		"locales/README.md": {Data: []byte("ignored")},
+	}
+	c := tbb.NewCatalog("en")
+	require.NoError(t, c.LoadFS(fsys, "locales"))
+
+	t.Run("should list all loaded languages", func(t *testing.T) {
+		assert.Equal(t, []string{"de", "en", "ru"}, c.Languages())
+	})
+
+	t.Run("should format messages and flatten nested keys", func(t *testing.T) {
+		assert.Equal(t, "Hallo Bob", c.Translate("de", "greeting", "Bob"))
+		assert.Equal(t, "Nested", c.Translate("de", "nested.key"))
+	})
+
+	t.Run("should fall back to the base and fallback language", func(t *testing.T) {
+		assert.Equal(t, "Hallo Bob", c.Translate("de-AT", "greeting", "Bob"))
+		assert.Equal(t, "Hello Bob", c.Translate("fr", "greeting", "Bob"))
+		assert.Equal(t, "missing.key", c.Translate("de", "missing.key"))
+	})
+
+	t.Run("should select plural forms", func(t *testing.T) {
+		assert.Equal(t, "1 user", c.Translate("en", "users", 1))
+		assert.Equal(t, "5 users", c.Translate("en", "users", 5))
+		assert.Equal(t, "1 пользователь", c.Translate("ru", "users", 1))
+		assert.Equal(t, "3 пользователя", c.Translate("ru", "users", 3))
+		assert.Equal(t, "11 пользователей", c.Translate("ru", "users", 11))
+		assert.Equal(t, "One item", c.Translate("en", "items", 1))
+		assert.Equal(t, "2 items", c.Translate("en", "items", 2))
+		assert.Equal(t, "Nested", c.Translate("en", "nested.key", 1))
+
+		c.SetPluralRule("en", func(n int) tbb.PluralForm { return tbb.PluralOther })
+		assert.Equal(t, "1 users", c.Translate("en", "users", 1))
+	})
+}
+
+func TestLanguageCommand(t *testing.T) {
+	commands := []tbb.Command{
+		{Name: "/language", Description: "Change the language", HandlerFn: command.NewLanguage},
+	}
+	h := tbbtest.New(t, tbb.WithCommands(commands))
+
+	h.SendMessage(42, "/language")
+	h.AssertMessage(42, `^Please choose your language\.$`)
+	h.SendCallbackQuery(42, "de")
+	h.AssertMessage(42, `^Ok, ich spreche ab jetzt Deutsch mit dir\.$`)
+	h.AssertRequest("answerCallbackQuery")
+
+	h.SendMessage(42, "/language xx")
+	h.AssertMessage(42, `"xx" ist leider nicht verfügbar`)
+
+	h.SendMessage(42, "/language auto")
+	h.Server.Reset()
+	h.SendMessage(42, "/language xx")
+	h.AssertMessage(42, `^Sorry, the language "xx" is not available\.$`)
+}
+
+func TestLocalizedBotCommands(t *testing.T) {
+	commands := []tbb.Command{
+		{Name: "help", Description: "Show the help message", HandlerFn: command.NewHelp},
+		{Name: "custom", Description: "Not translated", HandlerFn: command.NewHelp},
+	}
+	h := tbbtest.New(t, tbb.WithCommands(commands))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, h.TBot.Run(ctx))
+
+	var languages []string
+	for _, r := range h.AssertRequest("setMyCommands") {
+		if lang := r.Params.Get("language_code"); lang != "" {
+			languages = append(languages, lang)
+			if lang == "de" {
+				assert.Contains(t, r.Params.Get("commands"), "Hilfe anzeigen")
+				assert.Contains(t, r.Params.Get("commands"), "Not translated")
+			}
+		}
+	}
+	assert.Contains(t, languages, "de")
+	assert.Contains(t, languages, "en")
+}
@@ -0,0 +1,195 @@
+package tbb
+
+import (
+	"context"
+	"github.com/NicoNex/echotron/v3"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	MessageDirectionIn  = "in"  // Update received from Telegram
+	MessageDirectionOut = "out" // Message sent by the bot
+
+	messageStorePruneInterval = time.Hour // Interval for deleting messages exceeding the retention period
+)
+
+// likeEscaper escapes the wildcards of LIKE patterns with "!", which, unlike a backslash, needs no quoting in any database.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// MessageRecord is an incoming update or a message sent by the bot, which is stored if Config.MessageStore is enabled.
+type MessageRecord struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	Direction string    `gorm:"index" json:"direction"`                    // Either "in" or "out"
+	ChatID    int64     `gorm:"index:idx_message_chat_sent" json:"chatID"` // Telegram chatID of the conversation
+	UserID    int64     `json:"userID,omitempty"`                          // Telegram user ID of the sender of incoming updates
+	MessageID int       `json:"messageID,omitempty"`                       // Telegram message ID, if the record refers to a message
+	UpdateID  int       `json:"updateID,omitempty"`                        // Telegram update ID of incoming updates
+	Type      string    `gorm:"index" json:"type"`                         // Update type like "message" or "callback_query" or Bot API method like "sendMessage"
+	Text      string    `json:"text,omitempty"`                            // Text, caption, callback data or query
+	Payload   string    `json:"payload,omitempty"`                         // JSON encoded update, if Config.MessageStore.Payload is enabled
+	SentAt    time.Time `gorm:"index:idx_message_chat_sent" json:"sentAt"` // Time the update or message was sent
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MessageQuery filters the stored messages returned by DB.FindMessages. Zero values are ignored.
+type MessageQuery struct {
+	ChatID    int64
+	Direction string
+	Types     []string
+	Since     time.Time // Only messages sent at or after Since
+	Until     time.Time // Only messages sent before Until
+	Text      string    // Only messages containing the text
+	Limit     int
+	Offset    int
+	Desc      bool // Whether the newest messages are returned first
+}
+
+// MessageStoreMiddleware stores all incoming updates as MessageRecord if Config.MessageStore is enabled.
+// It should be applied after the RateLimitMiddleware, so that floods are dropped before they are written to the database.
+func MessageStoreMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		if b.tbot.cfg.MessageStore.Enabled {
+			if err := b.DB().Create(b.tbot.updateRecord(u)).Error; err != nil {
+				b.Log().Error("Cannot store update", "updateID", u.ID, "error", err)
+			}
+		}
+		next(b, u)
+	}
+}
+
+// updateRecord returns the MessageRecord of an incoming update.
+func (tb *TBot) updateRecord(u *echotron.Update) *MessageRecord {
+	info := parseUpdate(u)
+	r := &MessageRecord{Direction: MessageDirectionIn, ChatID: u.ChatID(), UpdateID: u.ID, Type: info.Type, SentAt: time.Now()}
+	if info.From != nil {
+		r.UserID = info.From.ID
+	}
+
+	switch {
+	case info.Message != nil:
+		r.MessageID, r.Text = info.Message.ID, messageText(info.Message)
+		if info.Message.Date != 0 {
+			r.SentAt = time.Unix(int64(info.Message.Date), 0)
+		}
+	case u.CallbackQuery != nil:
+		r.Text = u.CallbackQuery.Data
+		if u.CallbackQuery.Message != nil {
+			r.MessageID = u.CallbackQuery.Message.ID
+		}
+	case u.InlineQuery != nil:
+		r.Text = u.InlineQuery.Query
+	case u.ChosenInlineResult != nil:
+		r.Text = u.ChosenInlineResult.Query
+	case u.MyChatMember != nil:
+		r.Text = u.MyChatMember.NewChatMember.Status
+	case u.ChatMember != nil:
+		r.Text = u.ChatMember.NewChatMember.Status
+	case u.ChatJoinRequest != nil:
+		r.Text = u.ChatJoinRequest.Bio
+	}
+
+	if tb.cfg.MessageStore.Payload {
+		r.Payload = PrintAsJson(u, false)
+	}
+	return r
+}
+
+// recordSent stores the messages of a successful Bot API response as MessageRecord.
+func (tb *TBot) recordSent(method string, chatID int64, res any) {
+	var records []MessageRecord
+	add := func(msg *echotron.Message) {
+		if msg == nil {
+			return
+		}
+		r := MessageRecord{Direction: MessageDirectionOut, ChatID: msg.Chat.ID, MessageID: msg.ID, Type: method, Text: messageText(msg), SentAt: time.Now()}
+		if r.ChatID == 0 {
+			r.ChatID = chatID
+		}
+		if msg.EditDate != 0 {
+			r.SentAt = time.Unix(int64(msg.EditDate), 0)
+		} else if msg.Date != 0 {
+			r.SentAt = time.Unix(int64(msg.Date), 0)
+		}
+		records = append(records, r)
+	}
+	addID := func(id *echotron.MessageID) {
+		if id != nil {
+			records = append(records, MessageRecord{Direction: MessageDirectionOut, ChatID: chatID, MessageID: id.MessageID, Type: method, SentAt: time.Now()})
+		}
+	}
+
+	switch res := res.(type) {
+	case echotron.APIResponseMessage:
+		add(res.Result)
+	case echotron.APIResponseMessageArray:
+		for _, msg := range res.Result {
+			add(msg)
+		}
+	case echotron.APIResponseMessageID:
+		addID(res.Result)
+	case echotron.APIResponseMessageIDs:
+		for _, id := range res.Result {
+			addID(id)
+		}
+	}
+
+	if len(records) == 0 {
+		return
+	}
+	if err := tb.db.Create(&records).Error; err != nil {
+		tb.logger.Error("Cannot store sent messages", "method", method, "chatID", chatID, "error", err)
+	}
+}
+
+// pruneMessages deletes all stored messages exceeding Config.MessageStore.RetentionDays periodically until the
+// context is cancelled.
+func (tb *TBot) pruneMessages(ctx context.Context) error {
+	ticker := time.NewTicker(messageStorePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		before := time.Now().AddDate(0, 0, -tb.cfg.MessageStore.RetentionDays)
+		if n, err := tb.db.DeleteMessagesBefore(before); err != nil {
+			tb.logger.Error("Cannot delete stored messages", "error", err)
+		} else if n > 0 {
+			tb.logger.Info("Deleted stored messages", "count", n, "before", before)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// messageText returns the text or caption of the message.
+func messageText(msg *echotron.Message) string {
+	if msg.Text != "" {
+		return msg.Text
+	}
+	return msg.Caption
+}
+
+func (q MessageQuery) apply(tx *gorm.DB) *gorm.DB {
+	if q.ChatID != 0 {
+		tx = tx.Where("chat_id = ?", q.ChatID)
+	}
+	if q.Direction != "" {
+		tx = tx.Where("direction = ?", q.Direction)
+	}
+	if len(q.Types) > 0 {
+		tx = tx.Where("type IN ?", q.Types)
+	}
+	if !q.Since.IsZero() {
+		tx = tx.Where("sent_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		tx = tx.Where("sent_at < ?", q.Until)
+	}
+	if q.Text != "" {
+		tx = tx.Where("text LIKE ? ESCAPE '!'", "%"+likeEscaper.Replace(q.Text)+"%")
+	}
+	return tx
+}
@@ -0,0 +1,113 @@
+package tbb_test
+
+import (
+	"context"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMessageStore(t *testing.T) {
+	commands := tbb.WithCommands([]tbb.Command{{Name: "/help", HandlerFn: command.NewHelp}})
+
+	t.Run("should store incoming updates and sent messages", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.MessageStore.Enabled = true
+		cfg.MessageStore.Payload = true
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+
+		u := h.SendMessage(42, "/help")
+		h.SendCallbackQuery(42, "button")
+		h.SendMessage(43, "/help")
+
+		records, err := h.TBot.DB().FindMessages(tbb.MessageQuery{ChatID: 42})
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+
+		assert.Equal(t, tbb.MessageDirectionIn, records[0].Direction)
+		assert.Equal(t, "message", records[0].Type)
+		assert.Equal(t, "/help", records[0].Text)
+		assert.Equal(t, u.ID, records[0].UpdateID)
+		assert.Equal(t, u.Message.ID, records[0].MessageID)
+		assert.Equal(t, int64(42), records[0].UserID)
+		assert.Contains(t, records[0].Payload, `"text":"/help"`)
+
+		assert.Equal(t, tbb.MessageDirectionOut, records[1].Direction)
+		assert.Equal(t, "sendMessage", records[1].Type)
+		assert.Contains(t, records[1].Text, "list of available commands")
+		assert.NotZero(t, records[1].MessageID)
+
+		assert.Equal(t, "callback_query", records[2].Type)
+		assert.Equal(t, "button", records[2].Text)
+
+		n, err := h.TBot.DB().CountMessages(tbb.MessageQuery{Direction: tbb.MessageDirectionOut})
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, n)
+
+		records, err = h.TBot.DB().FindMessages(tbb.MessageQuery{Text: "available", Desc: true, Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, int64(43), records[0].ChatID)
+
+		h.SendMessage(44, "100% sure")
+		h.SendMessage(44, "1000 sure")
+		records, err = h.TBot.DB().FindMessages(tbb.MessageQuery{Text: "0% s"})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "100% sure", records[0].Text)
+	})
+
+	t.Run("should not store updates dropped by the rate limit", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.MessageStore.Enabled = true
+		cfg.RateLimit.Updates = 0.001
+		cfg.RateLimit.UpdatesBurst = 1
+		cfg.RateLimit.Message = "-"
+		h := tbbtest.NewWithConfig(t, cfg)
+
+		for range 3 {
+			h.SendMessage(42, "spam")
+		}
+		n, err := h.TBot.DB().CountMessages(tbb.MessageQuery{ChatID: 42})
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, n)
+	})
+
+	t.Run("should not store messages if disabled", func(t *testing.T) {
+		h := tbbtest.New(t, commands)
+		h.SendMessage(42, "/help")
+
+		n, err := h.TBot.DB().CountMessages(tbb.MessageQuery{})
+		require.NoError(t, err)
+		assert.Zero(t, n)
+	})
+
+	t.Run("should delete messages exceeding the retention period", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.MessageStore.Enabled = true
+		cfg.MessageStore.RetentionDays = 30
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+
+		old := tbb.MessageRecord{Direction: tbb.MessageDirectionIn, ChatID: 42, Type: "message", SentAt: time.Now().AddDate(0, 0, -31)}
+		require.NoError(t, h.TBot.DB().Create(&old).Error)
+		h.SendMessage(42, "/help")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.NoError(t, h.TBot.Run(ctx))
+
+		// Run closes the database on shutdown
+		db, err := tbb.NewDBE(h.TBot.Config(), nil)
+		require.NoError(t, err)
+		sqlDB, err := db.DB.DB()
+		require.NoError(t, err)
+		defer sqlDB.Close()
+		n, err := db.CountMessages(tbb.MessageQuery{})
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, n)
+	})
+}
@@ -0,0 +1,253 @@
+package tbb
+
+import (
+	"context"
+	"errors"
+	"github.com/NicoNex/echotron/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	metricsNamespace   = "tbb"
+	defaultMetricsPath = "/metrics"
+	defaultHealthzPath = "/healthz"
+	defaultReadyzPath  = "/readyz"
+
+	healthCheckTimeout = time.Second * 5 // Timeout of the database ping of the readiness check
+
+	dbStartKey = "tbb:metrics_start" // Statement instance key of the start time of a database operation
+)
+
+// metrics collects the Prometheus metrics of a TBot. All methods may be called on a nil *metrics,
+// in which case nothing is collected.
+type metrics struct {
+	reg             *prometheus.Registry
+	updates         *prometheus.CounterVec
+	commands        *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+	panics          prometheus.Counter
+	apiErrors       *prometheus.CounterVec
+	dbDuration      *prometheus.HistogramVec
+}
+
+// WithMetricsRegistry enables metrics regardless of Config.Metrics.Enabled and registers them on the given registry,
+// e.g. to serve them together with the metrics of the application. By default, metrics are registered on a new
+// registry together with the Go and process collectors.
+func WithMetricsRegistry(reg *prometheus.Registry) Option {
+	return func(tb *TBot) {
+		tb.metricsReg = reg
+	}
+}
+
+// MetricsRegistry returns the Prometheus registry of the bot or nil if metrics are disabled.
+// Additional collectors of the application can be registered on it.
+func (tb *TBot) MetricsRegistry() *prometheus.Registry {
+	if tb.metrics == nil {
+		return nil
+	}
+	return tb.metrics.reg
+}
+
+// MetricsHandler returns the http.Handler serving the metrics in the Prometheus format.
+// It responds with 404 Not Found if metrics are disabled.
+func (tb *TBot) MetricsHandler() http.Handler {
+	if tb.metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(tb.metrics.reg, promhttp.HandlerOpts{Registry: tb.metrics.reg})
+}
+
+// HealthzHandler returns the http.Handler of the liveness check, which always responds with 200 OK
+// as long as the process is able to serve requests.
+func (tb *TBot) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// ReadyzHandler returns the http.Handler of the readiness check, which responds with 200 OK while the bot is running
+// and the database is reachable and with 503 Service Unavailable otherwise.
+func (tb *TBot) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := tb.checkReady(r.Context()); err != nil {
+			tb.logger.Debug("Readiness check failed", "error", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// checkReady returns an error if the bot is not running or the database is not reachable.
+func (tb *TBot) checkReady(ctx context.Context) error {
+	if !tb.ready.Load() {
+		return errors.New("bot is not running")
+	}
+	sqlDB, err := tb.db.DB.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err = sqlDB.PingContext(ctx); err != nil {
+		return errors.New("database is not reachable")
+	}
+	return nil
+}
+
+// initMetrics creates the metrics if enabled, instruments the database and mounts the metrics and health handlers
+// on the ServeMux.
+func (tb *TBot) initMetrics() error {
+	tb.handleHealthCheck(tb.cfg.Metrics.HealthzPath, defaultHealthzPath, tb.HealthzHandler())
+	tb.handleHealthCheck(tb.cfg.Metrics.ReadyzPath, defaultReadyzPath, tb.ReadyzHandler())
+
+	if tb.metricsReg == nil {
+		if !tb.cfg.Metrics.Enabled {
+			return nil
+		}
+		tb.metricsReg = prometheus.NewRegistry()
+		tb.metricsReg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	if tb.cfg.Metrics.Path == "" {
+		tb.cfg.Metrics.Path = defaultMetricsPath
+	}
+
+	m, err := newMetrics(tb.metricsReg, tb.sessionCount)
+	if err != nil {
+		return err
+	}
+	if err = m.instrumentDB(tb.db.DB); err != nil {
+		return err
+	}
+	tb.metrics = m
+	tb.mux.Handle("GET "+tb.cfg.Metrics.Path, tb.MetricsHandler())
+	return nil
+}
+
+// handleHealthCheck mounts the handler of a health check at the configured path or the default path on the ServeMux.
+// Health checks with the path "-" are not mounted, e.g. if the application serves its own.
+func (tb *TBot) handleHealthCheck(path, defaultPath string, h http.Handler) {
+	switch path {
+	case "-":
+		return
+	case "":
+		path = defaultPath
+	}
+	tb.mux.Handle("GET "+path, h)
+}
+
+// sessionCount returns the number of active Bot sessions.
+func (tb *TBot) sessionCount() float64 {
+	return float64(tb.sessions.Len())
+}
+
+func newMetrics(reg *prometheus.Registry, sessions func() float64) (*metrics, error) {
+	m := &metrics{
+		reg: reg,
+		updates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "updates_total",
+			Help:      "Number of received updates by type.",
+		}, []string{"type"}),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_total",
+			Help:      "Number of command invocations by command name.",
+		}, []string{"command"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "update_duration_seconds",
+			Help:      "Duration of processing an update by type, including all middlewares.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"type"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "panics_recovered_total",
+			Help:      "Number of panics recovered while processing updates.",
+		}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_errors_total",
+			Help:      "Number of failed Telegram API requests by method and error code, which is 0 for network errors.",
+		}, []string{"method", "code"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_query_duration_seconds",
+			Help:      "Duration of database operations by operation and table.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"operation", "table"}),
+	}
+
+	err := errors.Join(
+		reg.Register(m.updates),
+		reg.Register(m.commands),
+		reg.Register(m.handlerDuration),
+		reg.Register(m.panics),
+		reg.Register(m.apiErrors),
+		reg.Register(m.dbDuration),
+		reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_active",
+			Help:      "Number of active Bot sessions.",
+		}, sessions)),
+	)
+	return m, err
+}
+
+// observeUpdate counts the update and records the duration of its processing since start.
+func (m *metrics) observeUpdate(u *echotron.Update, start time.Time) {
+	if m == nil {
+		return
+	}
+	t := parseUpdate(u).Type
+	m.updates.WithLabelValues(t).Inc()
+	m.handlerDuration.WithLabelValues(t).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) countCommand(name string) {
+	if m == nil {
+		return
+	}
+	m.commands.WithLabelValues(name).Inc()
+}
+
+func (m *metrics) countPanic() {
+	if m == nil {
+		return
+	}
+	m.panics.Inc()
+}
+
+func (m *metrics) countAPIError(method string, err error) {
+	if m == nil {
+		return
+	}
+	code := 0
+	var apiErr *echotron.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+	m.apiErrors.WithLabelValues(method, strconv.Itoa(code)).Inc()
+}
+
+// instrumentDB registers gorm callbacks, which record the duration of all database operations.
+func (m *metrics) instrumentDB(db *gorm.DB) error {
+	start := func(tx *gorm.DB) {
+		tx.InstanceSet(dbStartKey, time.Now())
+	}
+	observe := func(op string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if v, ok := tx.InstanceGet(dbStartKey); ok {
+				m.dbDuration.WithLabelValues(op, tx.Statement.Table).Observe(time.Since(v.(time.Time)).Seconds())
+			}
+		}
+	}
+
+	return registerDBCallbacks(db, "tbb:metrics", func(string) func(*gorm.DB) { return start }, observe)
+}
@@ -0,0 +1,157 @@
+package tbb_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type panicHandler struct {
+	tbb.DefaultCommandHandler
+}
+
+func (h *panicHandler) Handle() tbb.StateFn {
+	panic("test panic")
+}
+
+// get performs a GET request with the given path on the ServeMux of the bot.
+func get(t *testing.T, tbot *tbb.TBot, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	tbot.ServeMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := io.ReadAll(rec.Result().Body)
+	require.NoError(t, err)
+	return rec.Code, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	commands := tbb.WithCommands([]tbb.Command{
+		{Name: "/help", HandlerFn: command.NewHelp},
+		{Name: "/panic", HandlerFn: func() tbb.CommandHandler { return &panicHandler{} }},
+	})
+
+	t.Run("should collect metrics of updates, commands, panics, sessions, api errors and queries", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Metrics.Enabled = true
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+		h.SendMessage(42, "/help")
+		h.SendMessage(42, "/help")
+		h.SendMessage(43, "/panic")
+		h.SendCallbackQuery(42, "unknown")
+		h.Server.Respond("sendMessage", func(tbbtest.Request) tbbtest.Response {
+			return tbbtest.Response{ErrorCode: http.StatusForbidden, Description: "Forbidden: bot was blocked by the user"}
+		})
+		h.SendMessage(44, "/help")
+
+		code, body := get(t, h.TBot, "/metrics")
+		require.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `tbb_updates_total{type="message"} 4`)
+		assert.Contains(t, body, `tbb_updates_total{type="callback_query"} 1`)
+		assert.Contains(t, body, `tbb_update_duration_seconds_count{type="message"} 4`)
+		assert.Contains(t, body, `tbb_commands_total{command="/help"} 3`)
+		assert.Contains(t, body, `tbb_commands_total{command="/panic"} 1`)
+		assert.Contains(t, body, `tbb_panics_recovered_total 1`)
+		assert.Contains(t, body, `tbb_sessions_active 3`)
+		assert.Contains(t, body, `tbb_api_errors_total{code="403",method="sendMessage"} 1`)
+		assert.Contains(t, body, `tbb_db_query_duration_seconds_count{operation="query",table="users"}`)
+		assert.Contains(t, body, `go_goroutines`)
+	})
+
+	t.Run("should register the metrics on the given registry", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := tbbtest.New(t, commands, tbb.WithMetricsRegistry(reg))
+		assert.Same(t, reg, h.TBot.MetricsRegistry())
+		h.SendMessage(42, "/help")
+
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		names := map[string]bool{}
+		for _, f := range families {
+			names[f.GetName()] = true
+		}
+		assert.True(t, names["tbb_updates_total"])
+		assert.False(t, names["go_goroutines"])
+	})
+
+	t.Run("should not serve metrics if disabled", func(t *testing.T) {
+		h := tbbtest.New(t)
+		assert.Nil(t, h.TBot.MetricsRegistry())
+		code, _ := get(t, h.TBot, "/metrics")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
+
+func TestHealthChecks(t *testing.T) {
+	t.Run("should report liveness and readiness", func(t *testing.T) {
+		h := tbbtest.New(t)
+
+		code, _ := get(t, h.TBot, "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = get(t, h.TBot, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code, "not ready before Run")
+
+		stop := runBot(t, h)
+		require.Eventually(t, func() bool {
+			code, _ := get(t, h.TBot, "/readyz")
+			return code == http.StatusOK
+		}, time.Second*5, time.Millisecond*10)
+
+		require.NoError(t, stop())
+		code, _ = get(t, h.TBot, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code, "not ready after shutdown")
+		code, _ = get(t, h.TBot, "/healthz")
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("should serve health checks at the configured paths", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Metrics.HealthzPath = "/live"
+		cfg.Metrics.ReadyzPath = "-"
+		h := tbbtest.NewWithConfig(t, cfg)
+
+		code, _ := get(t, h.TBot, "/live")
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = get(t, h.TBot, "/healthz")
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = get(t, h.TBot, "/readyz")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("should serve health checks and metrics on the listen address in polling mode", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Metrics.Enabled = true
+		cfg.Metrics.Path = "/internal/metrics"
+		cfg.Metrics.Listen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		h := tbbtest.NewWithConfig(t, cfg)
+		stop := runBot(t, h)
+		defer func() { require.NoError(t, stop()) }()
+
+		url := "http://" + cfg.Metrics.Listen
+		require.Eventually(t, func() bool {
+			res, err := http.Get(url + "/readyz")
+			if err != nil {
+				return false
+			}
+			_ = res.Body.Close()
+			return res.StatusCode == http.StatusOK
+		}, time.Second*5, time.Millisecond*10)
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url+"/internal/metrics", nil)
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "tbb_sessions_active")
+	})
+}
@@ -0,0 +1,78 @@
+package tbb
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"slices"
+)
+
+// UpdateFunc processes a single echotron.Update within the given Bot session.
+type UpdateFunc func(*Bot, *echotron.Update)
+
+// Middleware wraps an UpdateFunc with additional behavior like logging, authorization, rate limiting or metrics.
+// A Middleware stops the processing of an update by not calling next.
+type Middleware func(next UpdateFunc) UpdateFunc
+
+// DefaultMiddlewares returns the built-in middlewares in the order they are applied by default.
+// The ChatRefreshMiddleware runs before the middlewares, which drop updates, so that the bot never misses being
+// removed from a chat.
+// Use WithoutDefaultMiddlewares together with WithMiddleware in order to reorder or remove them. Without the
+// RoleMiddleware and the RateLimitMiddleware, banned users are no longer ignored and incoming updates are not limited.
+func DefaultMiddlewares() []Middleware {
+	return []Middleware{
+		RecoverMiddleware,
+		ChatRefreshMiddleware,
+		RoleMiddleware,
+		RateLimitMiddleware,
+		MessageStoreMiddleware,
+		AllowedChatIDsMiddleware,
+		UserRefreshMiddleware,
+	}
+}
+
+// RecoverMiddleware recovers from panics in all subsequent middlewares and handlers and logs them.
+func RecoverMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		defer b.logRecoveredPanic()
+		next(b, u)
+	}
+}
+
+// AllowedChatIDsMiddleware only allows users from Config.AllowedChatIDs to use the bot.
+// If AllowedChatIDs is nil or empty, all users are allowed.
+// Roles are more flexible, because they can be changed at runtime. See RoleMiddleware and TBot.SetUserRole.
+func AllowedChatIDsMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		if len(b.tbot.cfg.AllowedChatIDs) > 0 && !slices.Contains(b.tbot.cfg.AllowedChatIDs, u.ChatID()) {
+			if b.IsUserActive() {
+				b.DisableUser()
+				if err := b.SaveUser(); err != nil {
+					b.Log().Error("Cannot save user", "error", err)
+				}
+			}
+			b.Log().Info("Access denied for user", "user", PrintAsJson(b.User(), false), "update", PrintAsJson(u, false))
+			return
+		}
+		next(b, u)
+	}
+}
+
+// UserRefreshMiddleware checks asynchronously if the user information needs to be updated from Telegram.
+func UserRefreshMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		s := b.currentScope()
+		b.tbot.wg.Add(1)
+		go func() {
+			defer b.tbot.wg.Done()
+			b.updateUserData(s, u, updateDuration)
+		}()
+		next(b, u)
+	}
+}
+
+// chainMiddlewares wraps h with the given middlewares, so that the first middleware is the outermost one.
+func chainMiddlewares(mws []Middleware, h UpdateFunc) UpdateFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -0,0 +1,80 @@
+package tbb
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	newUpdate := func(chatID int64) *echotron.Update {
+		return &echotron.Update{
+			Message: &echotron.Message{
+				Chat: echotron.Chat{Type: "private", ID: chatID},
+				Text: "/test_command",
+			},
+		}
+	}
+	recorder := func(calls *[]string, name string) Middleware {
+		return func(next UpdateFunc) UpdateFunc {
+			return func(b *Bot, u *echotron.Update) {
+				*calls = append(*calls, name)
+				next(b, u)
+			}
+		}
+	}
+	commands := []Command{
+		{
+			Name:      "/test_command",
+			HandlerFn: func() CommandHandler { return &DefaultCommandHandler{} },
+		},
+	}
+
+	t.Run("Middlewares are applied in the given order after the default middlewares", func(t *testing.T) {
+		var calls []string
+		cfg := LoadConfig("test/data/test.config.yml")
+		cfg.AllowedChatIDs = []int64{12345678}
+		tbot := New(WithConfig(cfg), WithCommands(commands), WithMiddleware(recorder(&calls, "first"), recorder(&calls, "second")))
+		bot := tbot.newBot(12345678, tbot.logger, tbot.hFn)
+		bot.user.UpdatedAt = time.Now()
+		bot.Update(newUpdate(12345678))
+
+		assert.Equal(t, []string{"first", "second"}, calls)
+		assert.NotNil(t, bot.Command())
+
+		// Denied by the AllowedChatIDsMiddleware before reaching custom middlewares
+		calls = nil
+		bot = tbot.newBot(87654321, tbot.logger, tbot.hFn)
+		bot.user.UpdatedAt = time.Now()
+		bot.Update(newUpdate(87654321))
+
+		assert.Empty(t, calls)
+		assert.Nil(t, bot.Command())
+	})
+
+	t.Run("Default middlewares can be removed and reordered", func(t *testing.T) {
+		var calls []string
+		cfg := LoadConfig("test/data/test.config.yml")
+		cfg.AllowedChatIDs = []int64{12345678}
+		tbot := New(WithConfig(cfg), WithCommands(commands), WithoutDefaultMiddlewares(), WithMiddleware(recorder(&calls, "custom"), RecoverMiddleware))
+		bot := tbot.newBot(87654321, tbot.logger, tbot.hFn)
+		bot.user.UpdatedAt = time.Now()
+		bot.Update(newUpdate(87654321))
+
+		assert.Equal(t, []string{"custom"}, calls)
+		assert.NotNil(t, bot.Command())
+	})
+
+	t.Run("RecoverMiddleware recovers from panics", func(t *testing.T) {
+		cfg := LoadConfig("test/data/test.config.yml")
+		panicking := func(next UpdateFunc) UpdateFunc {
+			return func(b *Bot, u *echotron.Update) { panic("test panic") }
+		}
+		tbot := New(WithConfig(cfg), WithMiddleware(panicking))
+		bot := tbot.newBot(12345678, tbot.logger, tbot.hFn)
+		bot.user.UpdatedAt = time.Now()
+
+		assert.NotPanics(t, func() { bot.Update(newUpdate(12345678)) })
+	})
+}
@@ -0,0 +1,418 @@
+package tbb
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/gabriel-vasile/mimetype"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"slices"
+	"time"
+)
+
+// Migration is a versioned change of the database schema or data.
+// Migrations are applied in ascending order of their version and each migration runs in a transaction.
+// Note that MySQL commits schema changes implicitly, so migrations should be idempotent where possible.
+type Migration struct {
+	Version int64  // Unique version, e.g. the creation time like 20241017120000
+	Name    string // Short description like "create_orders"
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error // Reverts Up. Migrations without Down cannot be rolled back.
+}
+
+// SchemaMigration is an applied Migration, which is stored in the schema_migrations table.
+type SchemaMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationStatus is a known Migration and the time it has been applied at.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time // Time the migration has been applied at or nil if the migration is pending
+}
+
+// Applied returns whether the migration has been applied.
+func (s MigrationStatus) Applied() bool {
+	return s.AppliedAt != nil
+}
+
+// Migrator applies and rolls back the migrations of tbb and of the application.
+type Migrator struct {
+	db         *DB
+	migrations []Migration
+}
+
+// WithMigrations option registers migrations of the application, which are applied by NewE together with the
+// migrations of tbb. Use timestamps as versions to avoid conflicts.
+func WithMigrations(ms ...Migration) Option {
+	return func(app *TBot) {
+		app.migrations = append(app.migrations, ms...)
+	}
+}
+
+// NewMigrator returns a Migrator for the migrations of tbb and the given migrations of the application.
+// It creates the schema_migrations table if necessary and returns ErrInvalidMigration or ErrDuplicateMigration
+// if a migration has no Up function or its version is not unique.
+func NewMigrator(db *DB, ms ...Migration) (*Migrator, error) {
+	all := append(slices.Clone(coreMigrations), ms...)
+	slices.SortStableFunc(all, func(a, b Migration) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	for i, m := range all {
+		if m.Version <= 0 || m.Up == nil {
+			return nil, fmt.Errorf("%w: %d %s", ErrInvalidMigration, m.Version, m.Name)
+		}
+		if i > 0 && all[i-1].Version == m.Version {
+			return nil, fmt.Errorf("%w: %d", ErrDuplicateMigration, m.Version)
+		}
+	}
+
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: all}, nil
+}
+
+// Status returns all known migrations in the order they are applied in.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	return m.status(m.db.DB)
+}
+
+// Pending returns the migrations, which have not been applied yet.
+func (m *Migrator) Pending() ([]Migration, error) {
+	return m.pending(m.db.DB)
+}
+
+// Up applies all pending migrations and returns the applied ones.
+// It stops at the first failing migration, whose changes are rolled back.
+// Concurrent migrators, e.g. of several instances starting at once, wait for each other, see lock.
+func (m *Migrator) Up(ctx context.Context) (res []Migration, err error) {
+	err = m.lock(ctx, func(conn *gorm.DB) error {
+		pending, err := m.pending(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range pending {
+			var applied bool
+			err = conn.Transaction(func(tx *gorm.DB) error {
+				// Sqlite has no lock, so the migration may have been applied by a concurrent migrator meanwhile
+				var n int64
+				if err := tx.Model(&SchemaMigration{}).Where("version = ?", mig.Version).Count(&n).Error; err != nil || n > 0 {
+					return err
+				}
+				if err := mig.Up(tx); err != nil {
+					return err
+				}
+				applied = true
+				return tx.Create(&SchemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s failed: %w", mig.Version, mig.Name, err)
+			}
+			if applied {
+				res = append(res, mig)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Down rolls back the given number of most recently applied migrations and returns the rolled back ones.
+// It fails with ErrIrreversibleMigration if a migration has no Down function.
+func (m *Migrator) Down(ctx context.Context, steps int) (res []Migration, err error) {
+	err = m.lock(ctx, func(conn *gorm.DB) error {
+		status, err := m.status(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(status) - 1; i >= 0 && len(res) < steps; i-- {
+			mig := status[i].Migration
+			if !status[i].Applied() {
+				continue
+			}
+			if mig.Down == nil {
+				return fmt.Errorf("%w: %d %s", ErrIrreversibleMigration, mig.Version, mig.Name)
+			}
+			err = conn.Transaction(func(tx *gorm.DB) error {
+				if err := mig.Down(tx); err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{Version: mig.Version}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("rollback of migration %d %s failed: %w", mig.Version, mig.Name, err)
+			}
+			res = append(res, mig)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Identifiers of the lock held by migrators, which is a named lock for MySQL and an advisory lock for Postgres.
+const (
+	migrationLockName = "tbb_schema_migrations"
+	migrationLockKey  = 7_381_650_712 // Arbitrary key of the advisory lock
+)
+
+// lock calls fn with a single connection of the database, which holds a lock of the migrations meanwhile.
+// Postgres and MySQL use named locks, which do not block other queries. Sqlite does not have named locks,
+// but only allows a single writer, so the transactions of the migrations are serialized anyway.
+func (m *Migrator) lock(ctx context.Context, fn func(conn *gorm.DB) error) error {
+	return m.db.WithContext(ctx).Connection(func(conn *gorm.DB) (err error) {
+		conn = conn.Session(&gorm.Session{NewDB: true})
+		switch conn.Dialector.Name() {
+		case DB_TYPE_POSTGRES:
+			if err = conn.Exec("SELECT pg_advisory_lock(?)", migrationLockKey).Error; err != nil {
+				return err
+			}
+			defer func() {
+				err = errors.Join(err, conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockKey).Error)
+			}()
+		case DB_TYPE_MYSQL:
+			var ok int
+			if err = conn.Raw("SELECT GET_LOCK(?, -1)", migrationLockName).Scan(&ok).Error; err != nil {
+				return err
+			}
+			if ok != 1 {
+				return fmt.Errorf("cannot acquire lock %s", migrationLockName)
+			}
+			defer func() {
+				err = errors.Join(err, conn.Exec("SELECT RELEASE_LOCK(?)", migrationLockName).Error)
+			}()
+		}
+		return fn(conn)
+	})
+}
+
+// status returns all known migrations in the order they are applied in using the given connection.
+func (m *Migrator) status(conn *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := m.applied(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]MigrationStatus, len(m.migrations))
+	for i, mig := range m.migrations {
+		res[i].Migration = mig
+		if sm, ok := applied[mig.Version]; ok {
+			res[i].AppliedAt = &sm.AppliedAt
+		}
+	}
+	return res, nil
+}
+
+// pending returns the migrations, which have not been applied yet, using the given connection.
+func (m *Migrator) pending(conn *gorm.DB) ([]Migration, error) {
+	status, err := m.status(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Migration
+	for _, s := range status {
+		if !s.Applied() {
+			res = append(res, s.Migration)
+		}
+	}
+	return res, nil
+}
+
+// applied returns the applied migrations by version.
+func (m *Migrator) applied(conn *gorm.DB) (map[int64]SchemaMigration, error) {
+	var sms []SchemaMigration
+	if err := conn.Find(&sms).Error; err != nil {
+		return nil, err
+	}
+
+	res := make(map[int64]SchemaMigration, len(sms))
+	for _, sm := range sms {
+		res[sm.Version] = sm
+	}
+	return res, nil
+}
+
+// migrate applies all pending migrations or fails with ErrPendingMigrations if Config.Database.SkipMigrations is set.
+func (tb *TBot) migrate() error {
+	m, err := NewMigrator(tb.db, tb.migrations...)
+	if err != nil {
+		return err
+	}
+
+	if tb.cfg.Database.SkipMigrations {
+		pending, err := m.Pending()
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%w: %d migrations starting with %d %s", ErrPendingMigrations, len(pending), pending[0].Version, pending[0].Name)
+		}
+		return nil
+	}
+
+	applied, err := m.Up(tb.ctx)
+	for _, mig := range applied {
+		tb.logger.Info("Applied migration", "version", mig.Version, "name", mig.Name)
+	}
+	return err
+}
+
+// coreMigrations are the migrations of the tables of tbb.
+// The initial migration creates all tables, so that databases created by AutoMigrate before migrations existed
+// are migrated seamlessly. It uses snapshots of the models, see initialModels.
+var coreMigrations = []Migration{
+	{
+		Version: 20261017000000,
+		Name:    "create_tables",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(initialModels()...)
+		},
+		Down: func(tx *gorm.DB) error {
+			models := initialModels()
+			slices.Reverse(models)
+			return tx.Migrator().DropTable(models...)
+		},
+	},
+	{
+		// User photos were stored in the database until the FileStore existed. Photos, which are still stored in the
+		// database, are moved into the FileStore by NewE, which drops the column afterward. See moveLegacyUserPhotos.
+		Version: 20261017000100,
+		Name:    "drop_user_photo_data",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&legacyUserPhoto{}, "file_data") {
+				return nil
+			}
+			var n int64
+			if err := tx.Model(&legacyUserPhoto{}).Where("file_data IS NOT NULL").Count(&n).Error; err != nil {
+				return err
+			}
+			if n > 0 {
+				return nil
+			}
+			return dropUserPhotoData(tx)
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&legacyUserPhoto{}, "file_data") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&legacyUserPhoto{}, "FileData")
+		},
+	},
+	{
+		// Banned users were flagged with UserInfo.IsBanned before roles existed
+		Version: 20261017000200,
+		Name:    "migrate_banned_users",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&legacyUserInfo{}, "is_banned") {
+				return nil
+			}
+			err := tx.Table("user_infos").Where("is_banned = ?", true).Update("role", RoleBanned).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "user_infos"}, clause.Column{Name: "is_banned"}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&legacyUserInfo{}, "is_banned") {
+				return nil
+			}
+			if err := tx.Migrator().AddColumn(&legacyUserInfo{}, "IsBanned"); err != nil {
+				return err
+			}
+			return tx.Table("user_infos").Where("role = ?", RoleBanned).Update("is_banned", true).Error
+		},
+	},
+}
+
+// legacyPhotoBatchSize is the number of legacy user photos, which are loaded from the database at once.
+const legacyPhotoBatchSize = 100
+
+// legacyUserPhoto is the former UserPhoto, which contained the binary data of the photo.
+type legacyUserPhoto struct {
+	UserID       uint64 `gorm:"primaryKey"`
+	FileUniqueID string
+	FileData     []byte
+}
+
+func (legacyUserPhoto) TableName() string {
+	return "user_photos"
+}
+
+// dropUserPhotoData drops the column of the binary data of the legacyUserPhoto.
+func dropUserPhotoData(tx *gorm.DB) error {
+	// The sqlite migrator of gorm cannot drop columns, which are not part of the model
+	return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "user_photos"}, clause.Column{Name: "file_data"}).Error
+}
+
+// moveLegacyUserPhotos moves the user photos, which are still stored in the database, into the FileStore and drops
+// their column afterward.
+func (tb *TBot) moveLegacyUserPhotos(ctx context.Context) error {
+	if !tb.db.Migrator().HasColumn(&legacyUserPhoto{}, "file_data") {
+		return nil
+	}
+
+	var moved int
+	for {
+		var photos []legacyUserPhoto
+		err := tb.db.WithContext(ctx).Where("file_data IS NOT NULL").Limit(legacyPhotoBatchSize).Find(&photos).Error
+		if err != nil {
+			return err
+		}
+		if len(photos) == 0 {
+			break
+		}
+		for _, p := range photos {
+			if err = tb.moveLegacyUserPhoto(ctx, &p); err != nil {
+				return fmt.Errorf("cannot move photo of user %d into the file store: %w", p.UserID, err)
+			}
+		}
+		moved += len(photos)
+	}
+
+	tb.logger.Info("Moved user photos into the file store", "count", moved)
+	return dropUserPhotoData(tb.db.WithContext(ctx))
+}
+
+// moveLegacyUserPhoto stores the data of the photo as File and references it by the UserPhoto.
+func (tb *TBot) moveLegacyUserPhoto(ctx context.Context, p *legacyUserPhoto) error {
+	if len(p.FileData) == 0 {
+		return tb.db.WithContext(ctx).Model(p).Update("file_data", nil).Error
+	}
+
+	mime := mimetype.Detect(p.FileData)
+	f := &File{
+		Name:      p.FileUniqueID + mime.Extension(),
+		UniqueID:  p.FileUniqueID,
+		Extension: mime.Extension(),
+		MimeType:  mime.String(),
+		Hash:      fmt.Sprintf("%x", sha256.Sum256(p.FileData)),
+		Size:      int64(len(p.FileData)),
+	}
+	if err := tb.files.Put(ctx, f.Hash, bytes.NewReader(p.FileData)); err != nil {
+		return err
+	}
+	return tb.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(f).Error; err != nil {
+			return err
+		}
+		return tx.Model(p).Updates(map[string]any{"file_hash": f.Hash, "stored_file_id": f.ID, "file_data": nil}).Error
+	})
+}
+
+// legacyUserInfo is the former UserInfo, which flagged banned users instead of assigning the RoleBanned.
+type legacyUserInfo struct {
+	IsBanned bool
+}
+
+func (legacyUserInfo) TableName() string {
+	return "user_infos"
+}
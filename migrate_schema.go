@@ -0,0 +1,222 @@
+package tbb
+
+import (
+	"time"
+)
+
+// The initial* types are snapshots of the models as created by the create_tables migration. They must never change,
+// since the migration has to create the same schema, whenever it is applied. Changes of the models require a new
+// migration instead.
+
+// initialModels returns the snapshots of the models of all tables created by the create_tables migration.
+func initialModels() []any {
+	return []any{&initialUser{}, &initialUserInfo{}, &initialUserPhoto{}, &initialConversationState{}, &initialCallbackPayload{}, &initialBroadcast{}, &initialBroadcastDelivery{}, &initialScheduledRun{}, &initialChat{}, &initialMessageRecord{}, &initialFile{}, &initialFileBlob{}}
+}
+
+type initialUser struct {
+	ID                      uint64 `gorm:"primaryKey"`
+	Username                string
+	Firstname               string
+	Lastname                string
+	ChatID                  int64 `gorm:"uniqueIndex"`
+	LanguageCode            string
+	IsBot                   bool
+	IsPremium               bool
+	AddedToAttachmentMenu   bool
+	CanJoinGroups           bool
+	CanReadAllGroupMessages bool
+	SupportsInlineQueries   bool
+	CanConnectToBusiness    bool
+	HasMainWebApp           bool
+	UserInfo                *initialUserInfo  `gorm:"foreignKey:UserID"`
+	UserPhoto               *initialUserPhoto `gorm:"foreignKey:UserID"`
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+}
+
+func (initialUser) TableName() string {
+	return "users"
+}
+
+type initialUserInfo struct {
+	UserID    uint64 `gorm:"primaryKey"`
+	IsActive  bool
+	Status    string
+	Language  string
+	Role      string
+	Latitude  float64
+	Longitude float64
+	Location  string
+	ZoneName  string
+	Offset    int
+	IsDST     bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (initialUserInfo) TableName() string {
+	return "user_infos"
+}
+
+type initialUserPhoto struct {
+	UserID       uint64 `gorm:"primaryKey"`
+	FileID       string
+	FileUniqueID string
+	FileSize     int
+	FileHash     string
+	StoredFileID int64
+	Width        int
+	Height       int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (initialUserPhoto) TableName() string {
+	return "user_photos"
+}
+
+type initialConversationState struct {
+	ChatID    int64 `gorm:"primaryKey;autoIncrement:false"`
+	Command   string
+	State     string
+	Payload   string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (initialConversationState) TableName() string {
+	return "conversation_states"
+}
+
+type initialCallbackPayload struct {
+	ID        string `gorm:"primaryKey"`
+	Payload   string
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+func (initialCallbackPayload) TableName() string {
+	return "callback_payloads"
+}
+
+type initialBroadcast struct {
+	ID         uint64 `gorm:"primaryKey"`
+	Text       string
+	Options    string
+	Status     string `gorm:"index"`
+	FinishedAt *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (initialBroadcast) TableName() string {
+	return "broadcasts"
+}
+
+type initialBroadcastDelivery struct {
+	ID          uint64 `gorm:"primaryKey"`
+	BroadcastID uint64 `gorm:"uniqueIndex:idx_broadcast_chat"`
+	ChatID      int64  `gorm:"uniqueIndex:idx_broadcast_chat"`
+	Status      string `gorm:"index"`
+	MessageID   int
+	Attempts    int
+	Error       string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (initialBroadcastDelivery) TableName() string {
+	return "broadcast_deliveries"
+}
+
+type initialScheduledRun struct {
+	Job       string `gorm:"primaryKey"`
+	ChatID    int64  `gorm:"primaryKey;autoIncrement:false"`
+	Location  string
+	NextRunAt time.Time `gorm:"index"`
+	LastRunAt *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (initialScheduledRun) TableName() string {
+	return "scheduled_runs"
+}
+
+type initialChat struct {
+	ID            int64  `gorm:"primaryKey;autoIncrement:false"`
+	Type          string `gorm:"index"`
+	Title         string
+	Username      string
+	IsForum       bool
+	Status        string
+	IsActive      bool `gorm:"index"`
+	MemberCount   int
+	MemberCountAt *time.Time
+	MigratedTo    int64
+	BotRights     initialBotRights `gorm:"embedded;embeddedPrefix:bot_"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (initialChat) TableName() string {
+	return "chats"
+}
+
+type initialBotRights struct {
+	CanSendMessages    bool
+	CanManageChat      bool
+	CanPostMessages    bool
+	CanEditMessages    bool
+	CanDeleteMessages  bool
+	CanRestrictMembers bool
+	CanPromoteMembers  bool
+	CanChangeInfo      bool
+	CanInviteUsers     bool
+	CanPinMessages     bool
+	CanManageTopics    bool
+}
+
+type initialMessageRecord struct {
+	ID        uint64 `gorm:"primaryKey"`
+	Direction string `gorm:"index"`
+	ChatID    int64  `gorm:"index:idx_message_chat_sent"`
+	UserID    int64
+	MessageID int
+	UpdateID  int
+	Type      string `gorm:"index"`
+	Text      string
+	Payload   string
+	SentAt    time.Time `gorm:"index:idx_message_chat_sent"`
+	CreatedAt time.Time
+}
+
+func (initialMessageRecord) TableName() string {
+	return "message_records"
+}
+
+type initialFile struct {
+	ID        int64 `gorm:"primaryKey"`
+	Name      string
+	UniqueID  string `gorm:"index"`
+	Extension string
+	MimeType  string
+	Hash      string `gorm:"index"`
+	Size      int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (initialFile) TableName() string {
+	return "files"
+}
+
+type initialFileBlob struct {
+	Key       string `gorm:"primaryKey"`
+	Data      []byte
+	CreatedAt time.Time
+}
+
+func (initialFileBlob) TableName() string {
+	return "file_blobs"
+}
@@ -0,0 +1,177 @@
+package tbb_test
+
+import (
+	"context"
+	"github.com/apperia-de/tbb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"path/filepath"
+	"testing"
+)
+
+type order struct {
+	ID     uint64
+	Amount int
+}
+
+var createOrders = tbb.Migration{
+	Version: 30000101000000,
+	Name:    "create_orders",
+	Up:      func(tx *gorm.DB) error { return tx.AutoMigrate(&order{}) },
+	Down:    func(tx *gorm.DB) error { return tx.Migrator().DropTable(&order{}) },
+}
+
+func newMigrationDB(t *testing.T) (*tbb.Config, *tbb.DB) {
+	cfg := &tbb.Config{}
+	cfg.Database.Type = tbb.DB_TYPE_SQLITE
+	cfg.Database.Filename = filepath.Join(t.TempDir(), "migrate.db")
+	db, err := tbb.NewDBE(cfg, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	return cfg, db
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should apply and roll back migrations in order", func(t *testing.T) {
+		_, db := newMigrationDB(t)
+		m, err := tbb.NewMigrator(db, createOrders)
+		require.NoError(t, err)
+
+		pending, err := m.Pending()
+		require.NoError(t, err)
+		require.NotEmpty(t, pending)
+		assert.Equal(t, createOrders.Version, pending[len(pending)-1].Version)
+
+		applied, err := m.Up(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, stripFuncs(pending), stripFuncs(applied))
+		assert.True(t, db.Migrator().HasTable(&order{}))
+		assert.True(t, db.Migrator().HasTable(&tbb.User{}))
+
+		applied, err = m.Up(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, applied)
+
+		rolledBack, err := m.Down(ctx, 1)
+		require.NoError(t, err)
+		require.Len(t, rolledBack, 1)
+		assert.Equal(t, "create_orders", rolledBack[0].Name)
+		assert.False(t, db.Migrator().HasTable(&order{}))
+
+		status, err := m.Status()
+		require.NoError(t, err)
+		assert.True(t, status[0].Applied())
+		assert.False(t, status[len(status)-1].Applied())
+	})
+
+	t.Run("should create the schema of the models", func(t *testing.T) {
+		_, db := newMigrationDB(t)
+		m, err := tbb.NewMigrator(db)
+		require.NoError(t, err)
+		_, err = m.Up(ctx)
+		require.NoError(t, err)
+
+		// Changes of the models require a migration
+		models := []any{&tbb.User{}, &tbb.UserInfo{}, &tbb.UserPhoto{}, &tbb.ConversationState{}, &tbb.CallbackPayload{}, &tbb.Broadcast{}, &tbb.BroadcastDelivery{}, &tbb.ScheduledRun{}, &tbb.Chat{}, &tbb.MessageRecord{}, &tbb.File{}, &tbb.FileBlob{}}
+		for _, model := range models {
+			stmt := &gorm.Statement{DB: db.DB}
+			require.NoError(t, stmt.Parse(model))
+			for _, f := range stmt.Schema.Fields {
+				if f.DBName != "" {
+					assert.True(t, db.Migrator().HasColumn(model, f.DBName), "missing column %s.%s", stmt.Schema.Table, f.DBName)
+				}
+			}
+			for _, idx := range stmt.Schema.ParseIndexes() {
+				assert.True(t, db.Migrator().HasIndex(model, idx.Name), "missing index %s.%s", stmt.Schema.Table, idx.Name)
+			}
+		}
+	})
+
+	t.Run("should reject invalid migrations", func(t *testing.T) {
+		_, db := newMigrationDB(t)
+		_, err := tbb.NewMigrator(db, createOrders, createOrders)
+		assert.ErrorIs(t, err, tbb.ErrDuplicateMigration)
+
+		_, err = tbb.NewMigrator(db, tbb.Migration{Version: 1, Name: "empty"})
+		assert.ErrorIs(t, err, tbb.ErrInvalidMigration)
+	})
+
+	t.Run("should not roll back irreversible migrations", func(t *testing.T) {
+		_, db := newMigrationDB(t)
+		irreversible := createOrders
+		irreversible.Down = nil
+		m, err := tbb.NewMigrator(db, irreversible)
+		require.NoError(t, err)
+		_, err = m.Up(ctx)
+		require.NoError(t, err)
+
+		_, err = m.Down(ctx, 1)
+		assert.ErrorIs(t, err, tbb.ErrIrreversibleMigration)
+	})
+
+	t.Run("should apply migrations of the application on start", func(t *testing.T) {
+		cfg, db := newMigrationDB(t)
+		cfg.Telegram.BotToken = "token"
+		cfg.LogLevel = "error"
+		_, err := tbb.NewE(tbb.WithConfig(cfg), tbb.WithMigrations(createOrders))
+		require.NoError(t, err)
+		assert.True(t, db.Migrator().HasTable(&order{}))
+	})
+
+	t.Run("should fail on start with pending migrations if skipped", func(t *testing.T) {
+		cfg, _ := newMigrationDB(t)
+		cfg.Telegram.BotToken = "token"
+		cfg.LogLevel = "error"
+		cfg.Database.SkipMigrations = true
+		_, err := tbb.NewE(tbb.WithConfig(cfg))
+		assert.ErrorIs(t, err, tbb.ErrPendingMigrations)
+	})
+
+	t.Run("should migrate databases created by AutoMigrate", func(t *testing.T) {
+		_, db := newMigrationDB(t)
+		require.NoError(t, db.AutoMigrate(&tbb.User{}, &tbb.UserInfo{}, &tbb.UserPhoto{}))
+		require.NoError(t, db.Exec("ALTER TABLE user_photos ADD COLUMN file_data blob").Error)
+		require.NoError(t, db.Exec("ALTER TABLE user_infos ADD COLUMN is_banned numeric").Error)
+		require.NoError(t, db.Create(&tbb.User{ChatID: 1, UserInfo: &tbb.UserInfo{}}).Error)
+		require.NoError(t, db.Create(&tbb.User{ChatID: 2, UserInfo: &tbb.UserInfo{}}).Error)
+		require.NoError(t, db.Exec("UPDATE user_infos SET is_banned = true WHERE user_id = 1").Error)
+
+		m, err := tbb.NewMigrator(db)
+		require.NoError(t, err)
+		_, err = m.Up(ctx)
+		require.NoError(t, err)
+		assert.False(t, db.Migrator().HasColumn(&tbb.UserPhoto{}, "file_data"))
+		assert.False(t, db.Migrator().HasColumn(&tbb.UserInfo{}, "is_banned"))
+		for chatID, role := range map[int64]tbb.Role{1: tbb.RoleBanned, 2: ""} {
+			u, err := db.FindUserByChatID(chatID)
+			require.NoError(t, err)
+			assert.Equal(t, role, u.UserInfo.Role)
+		}
+
+		_, err = m.Down(ctx, 1)
+		require.NoError(t, err)
+		assert.True(t, db.Migrator().HasColumn(&tbb.UserInfo{}, "is_banned"))
+		_, err = m.Down(ctx, 1)
+		require.NoError(t, err)
+		assert.True(t, db.Migrator().HasColumn(&tbb.UserPhoto{}, "file_data"))
+		_, err = m.Down(ctx, 1)
+		require.NoError(t, err)
+		assert.False(t, db.Migrator().HasTable(&tbb.User{}))
+	})
+}
+
+// stripFuncs removes the functions of the migrations, which cannot be compared.
+func stripFuncs(ms []tbb.Migration) []tbb.Migration {
+	res := make([]tbb.Migration, len(ms))
+	for i, m := range ms {
+		res[i] = tbb.Migration{Version: m.Version, Name: m.Name}
+	}
+	return res
+}
@@ -28,34 +28,57 @@ type User struct {
 type UserInfo struct {
 	UserID   uint64 `gorm:"primaryKey"`
 	IsActive bool   `json:"isActive"`
-	Status   string `json:"status,omitempty"` // Either "member" or "kicked"
+	Status   string `json:"status,omitempty"`   // Either "member" or "kicked"
+	Language string `json:"language,omitempty"` // Language code chosen by the user, which overrides User.LanguageCode
+	Role     Role   `json:"role,omitempty"`     // Role of the user, which is RoleMember if empty
 	TimeZoneInfo
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// UserPhoto is the current profile photo of a user. It is only downloaded if Config.UserPhotos is enabled.
 type UserPhoto struct {
 	UserID       uint64 `gorm:"primaryKey"` // ID from User table to whom the photo belongs to.
 	FileID       string // Identifier for this file, which can be used to download or reuse the file
 	FileUniqueID string // Unique identifier for this file, which is supposed to be the same over time and for different bots. Can't be used to download or reuse the file.
 	FileSize     int    // Size in bytes of the user photo
-	FileHash     string // The md5 file hash of the user photo
-	FileData     []byte // The binary Data of the user photo
+	FileHash     string // The file hash of the user photo, which is the key of the data in the FileStore
+	StoredFileID int64  // ID of the stored File of the user photo or 0 if the photo has not been downloaded
 	Width        int    // Photo width
 	Height       int    // Photo height
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
 
+// ConversationState stores the current named state of a chat, so that multistep conversations
+// survive session timeouts and restarts.
+type ConversationState struct {
+	ChatID    int64  `gorm:"primaryKey;autoIncrement:false"` // Telegram chatID of the conversation
+	Command   string // Name of the command owning the state or empty if the state belongs to the UpdateHandler
+	State     string // Name of the state as registered by a StateHandler
+	Payload   string // JSON encoded state data
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// CallbackPayload stores the payload of callback data, which exceeds the callback data limit of Telegram.
+type CallbackPayload struct {
+	ID        string    `gorm:"primaryKey"` // Reference used within the callback data
+	Payload   string    // Base64 encoded JSON payload
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// File is a file downloaded from Telegram. The data of files stored by TBot.StoreFile is kept in the FileStore.
 type File struct {
 	ID        int64  `gorm:"primaryKey" json:"id"`
 	Name      string // Filename
-	UniqueID  string // Unique file ID from Telegram
+	UniqueID  string `gorm:"index"` // Unique file ID from Telegram
 	Extension string // File extension with the preceding "." if exists or empty otherwise
 	MimeType  string // Mime type of the stored file
-	Hash      string // MD5 hash of the file binary data
+	Hash      string `gorm:"index"` // SHA-256 hash of the file binary data (MD5 for files stored before), which is the key of the data in the FileStore
 	Size      int64  // File size of the binary data
-	Data      []byte // Binary file data
+	Data      []byte `gorm:"-" json:"-"` // Binary file data, which is only set by TBot.DownloadFile
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
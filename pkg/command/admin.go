@@ -0,0 +1,144 @@
+package command
+
+import (
+	"github.com/apperia-de/tbb"
+	"strconv"
+	"strings"
+)
+
+// Stats, Ban, Unban, SetRole and Broadcast are admin commands, which should be registered with tbb.Command Roles
+// set to tbb.RoleAdmin.
+
+type Stats struct {
+	tbb.DefaultCommandHandler
+}
+
+// NewStats returns a new Stats command handler and can be used as tbb.Command HandlerFn.
+func NewStats() tbb.CommandHandler {
+	return &Stats{}
+}
+
+func (c *Stats) Handle() tbb.StateFn {
+	s, err := c.Bot().TBot().Stats()
+	if err != nil {
+		c.Bot().Log().Error("Cannot get stats", "error", err)
+		return nil
+	}
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.stats", s.Users, s.ActiveUsers, s.BannedUsers, s.Sessions), c.Bot().ChatID(), nil)
+	return nil
+}
+
+type Ban struct {
+	tbb.DefaultCommandHandler
+}
+
+// NewBan returns a new Ban command handler for /ban <chatID> and can be used as tbb.Command HandlerFn.
+func NewBan() tbb.CommandHandler {
+	return &Ban{}
+}
+
+func (c *Ban) Handle() tbb.StateFn {
+	chatID, ok := chatIDParam(c.Bot())
+	if !ok {
+		return nil
+	}
+	if err := c.Bot().TBot().BanUser(chatID); err != nil {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.failed", err), c.Bot().ChatID(), nil)
+		return nil
+	}
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.banned", chatID), c.Bot().ChatID(), nil)
+	return nil
+}
+
+type Unban struct {
+	tbb.DefaultCommandHandler
+}
+
+// NewUnban returns a new Unban command handler for /unban <chatID> and can be used as tbb.Command HandlerFn.
+func NewUnban() tbb.CommandHandler {
+	return &Unban{}
+}
+
+func (c *Unban) Handle() tbb.StateFn {
+	chatID, ok := chatIDParam(c.Bot())
+	if !ok {
+		return nil
+	}
+	if err := c.Bot().TBot().UnbanUser(chatID); err != nil {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.failed", err), c.Bot().ChatID(), nil)
+		return nil
+	}
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.unbanned", chatID), c.Bot().ChatID(), nil)
+	return nil
+}
+
+type SetRole struct {
+	tbb.DefaultCommandHandler
+}
+
+// NewSetRole returns a new SetRole command handler for /role <chatID> <role> and can be used as tbb.Command HandlerFn.
+func NewSetRole() tbb.CommandHandler {
+	return &SetRole{}
+}
+
+func (c *SetRole) Handle() tbb.StateFn {
+	params := c.Bot().Command().Params
+	if len(params) < 2 {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.roleUsage", c.Bot().Command().Name), c.Bot().ChatID(), nil)
+		return nil
+	}
+	chatID, ok := chatIDParam(c.Bot())
+	if !ok {
+		return nil
+	}
+
+	role := tbb.Role(strings.ToLower(params[1]))
+	if err := c.Bot().TBot().SetUserRole(chatID, role); err != nil {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.failed", err), c.Bot().ChatID(), nil)
+		return nil
+	}
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.roleChanged", chatID, role), c.Bot().ChatID(), nil)
+	return nil
+}
+
+type Broadcast struct {
+	tbb.DefaultCommandHandler
+}
+
+// NewBroadcast returns a new Broadcast command handler for /broadcast <text> and can be used as tbb.Command HandlerFn.
+// The broadcast runs in the background and the admin is notified as soon as it is finished.
+func NewBroadcast() tbb.CommandHandler {
+	return &Broadcast{}
+}
+
+func (c *Broadcast) Handle() tbb.StateFn {
+	text := c.Bot().Command().Args
+	if text == "" {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.broadcastUsage"), c.Bot().ChatID(), nil)
+		return nil
+	}
+
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("admin.broadcastStarted"), c.Bot().ChatID(), nil)
+	b := c.Bot()
+	b.TBot().BroadcastAsync(text, nil, func(bc *tbb.Broadcast, err error) {
+		if err != nil {
+			b.Log().Error("Broadcast failed", "error", err)
+			_, _ = b.LimitedAPI().SendMessage(b.T("admin.failed", err), b.ChatID(), nil)
+			return
+		}
+		_, _ = b.LimitedAPI().SendMessage(b.T("admin.broadcastFinished", bc.Sent, bc.Recipients, bc.Blocked, bc.Failed), b.ChatID(), nil)
+	})
+	return nil
+}
+
+// chatIDParam returns the chatID passed as first command parameter and replies with a usage hint if it is missing or invalid.
+func chatIDParam(b *tbb.Bot) (int64, bool) {
+	params := b.Command().Params
+	if len(params) > 0 {
+		if chatID, err := strconv.ParseInt(params[0], 10, 64); err == nil {
+			return chatID, true
+		}
+	}
+	_, _ = b.LimitedAPI().SendMessage(b.T("admin.chatIDUsage", b.Command().Name), b.ChatID(), nil)
+	return 0, false
+}
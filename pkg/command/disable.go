@@ -6,9 +6,16 @@ type Disable struct {
 	tbb.DefaultCommandHandler
 }
 
+// NewDisable returns a new Disable command handler and can be used as tbb.Command HandlerFn.
+func NewDisable() tbb.CommandHandler {
+	return &Disable{}
+}
+
 func (c *Disable) Handle() tbb.StateFn {
-	_, _ = c.Bot().API().SendMessage("You won't receive any updates anymore. Send /enable to enable updates again.", c.Bot().ChatID(), nil)
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("disable.message"), c.Bot().ChatID(), nil)
 	c.Bot().DisableUser()
-	c.Bot().DB().Save(c.Bot().User())
+	if err := c.Bot().SaveUser(); err != nil {
+		c.Bot().Log().Error("Error saving user", "error", err)
+	}
 	return nil
 }
@@ -1,72 +1,95 @@
 package command
 
 import (
-	"fmt"
 	"github.com/NicoNex/echotron/v3"
 	"github.com/apperia-de/tbb"
 )
 
+// The callback data of the buttons the Enable command sends.
+const (
+	enableAnswerUpdate = "update"
+	enableAnswerKeep   = "keep"
+	enableAnswerUTC    = "utc"
+)
+
 type Enable struct {
 	tbb.DefaultCommandHandler
 }
 
+// NewEnable returns a new Enable command handler and can be used as tbb.Command HandlerFn.
+func NewEnable() tbb.CommandHandler {
+	return &Enable{}
+}
+
+// States registers the named states of the Enable command, so that the conversation survives session timeouts.
+func (c *Enable) States() tbb.StateRegistry {
+	return tbb.StateRegistry{
+		"awaitUserAnswer":   c.awaitUserAnswer,
+		"awaitUserLocation": c.awaitUserLocation,
+	}
+}
+
 func (c *Enable) Handle() tbb.StateFn {
 	c.Bot().EnableUser()
-	c.Bot().DB().Save(c.Bot().User())
+	if err := c.Bot().SaveUser(); err != nil {
+		c.Bot().Log().Error("Error saving user", "error", err)
+	}
 
 	if c.Bot().User().UserInfo.ZoneName == "" {
 		var buttons [][]echotron.InlineKeyboardButton
 		buttons = append(buttons, tbb.BuildInlineKeyboardButtonRow(
 			[]tbb.InlineKeyboardButton{
-				{Text: "Yes", Data: "update"},
-				{Text: "No", Data: ""},
+				{Text: c.Bot().T("button.yes"), Data: enableAnswerUpdate},
+				{Text: c.Bot().T("button.no"), Data: enableAnswerUTC},
 			}),
 		)
-		_, _ = c.Bot().API().SendMessage("I don't have your current time zone for messaging. Do you want to send me your current location, so that I can figure out your current timezone settings?", c.Bot().ChatID(), &echotron.MessageOptions{ReplyMarkup: &echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
-		return c.awaitUserAnswer
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("enable.askLocation"), c.Bot().ChatID(), &echotron.MessageOptions{ReplyMarkup: &echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
+		return c.Bot().NextState("awaitUserAnswer")
 	}
 
 	var buttons [][]echotron.InlineKeyboardButton
 	buttons = append(buttons, tbb.BuildInlineKeyboardButtonRow(
 		[]tbb.InlineKeyboardButton{
-			{Text: "Yes", Data: "keep"},
-			{Text: "No", Data: "update"},
+			{Text: c.Bot().T("button.yes"), Data: enableAnswerKeep},
+			{Text: c.Bot().T("button.no"), Data: enableAnswerUpdate},
 		}),
 	)
 	userInfo := c.Bot().User().UserInfo
-	_, _ = c.Bot().API().SendLocation(c.Bot().ChatID(), userInfo.Latitude, userInfo.Longitude, nil)
-	_, _ = c.Bot().API().SendMessage("Is this location still correct", c.Bot().ChatID(), &echotron.MessageOptions{ReplyMarkup: &echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
-	return c.awaitUserAnswer
+	_, _ = c.Bot().LimitedAPI().SendLocation(c.Bot().ChatID(), userInfo.Latitude, userInfo.Longitude, nil)
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("enable.confirmLocation"), c.Bot().ChatID(), &echotron.MessageOptions{ReplyMarkup: &echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
+	return c.Bot().NextState("awaitUserAnswer")
 }
 
 func (c *Enable) awaitUserAnswer(u *echotron.Update) (state tbb.StateFn) {
 	if u.CallbackQuery == nil {
-		return c.awaitUserAnswer
+		return c.Bot().NextState("awaitUserAnswer")
 	}
+	c.answerCallbackQuery(u)
 	answer := u.CallbackQuery.Data
 	c.Bot().Log().Info("Answer:" + answer)
 
 	switch answer {
-	case "update":
-		_, _ = c.Bot().API().SendMessage("Ok, so than please send me a valid location point", u.ChatID(), nil)
-		state = c.awaitUserLocation
-	case "keep":
-		_, _ = c.Bot().API().SendMessage(fmt.Sprintf("Ok, then I'll keep your current time zone (%s)", c.Bot().User().UserInfo.ZoneName), u.ChatID(), nil)
+	case enableAnswerUpdate:
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("enable.sendLocation"), c.Bot().ChatID(), nil)
+		state = c.Bot().NextState("awaitUserLocation")
+	case enableAnswerKeep:
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("enable.keepTimezone", c.Bot().User().UserInfo.ZoneName), c.Bot().ChatID(), nil)
 	default:
-		_, _ = c.Bot().API().SendMessage("Ok, than I will use UTC timezone for your timezone. Your account is now enabled.", c.Bot().ChatID(), nil)
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("enable.useUTC"), c.Bot().ChatID(), nil)
 	}
 
 	return state
 }
 
 func (c *Enable) awaitUserLocation(u *echotron.Update) tbb.StateFn {
-	if u.Message != nil && u.Message.Location == nil {
-		_, _ = c.Bot().API().SendMessage("Please send a valid location point", u.ChatID(), nil)
-		return c.awaitUserLocation
+	if u.Message == nil || u.Message.Location == nil {
+		c.answerCallbackQuery(u)
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("location.invalid"), c.Bot().ChatID(), nil)
+		return c.Bot().NextState("awaitUserLocation")
 	}
 
 	loc := *u.Message.Location
-	_, _ = c.Bot().API().SendMessage(fmt.Sprintf("I receive your location update: Latitude = %f | Longitude = %f.\nYour notifications are now enabled.", loc.Latitude, loc.Longitude), u.ChatID(), nil)
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("enable.locationReceived", loc.Latitude, loc.Longitude), c.Bot().ChatID(), nil)
 
 	tzi, err := c.Bot().TBot().GetTimezoneInfo(loc.Latitude, loc.Longitude)
 	if err != nil {
@@ -74,14 +97,28 @@ func (c *Enable) awaitUserLocation(u *echotron.Update) tbb.StateFn {
 		return nil
 	}
 
-	user := c.Bot().User()
-	user.UserInfo.Latitude = tzi.Latitude
-	user.UserInfo.Longitude = tzi.Longitude
-	user.UserInfo.Location = tzi.Location
-	user.UserInfo.ZoneName = tzi.ZoneName
-	user.UserInfo.IsDST = tzi.IsDST
-	user.UserInfo.Offset = tzi.Offset
-	c.Bot().DB().Save(user)
+	err = c.Bot().UpdateUser(func(user *tbb.User) {
+		user.UserInfo.Latitude = tzi.Latitude
+		user.UserInfo.Longitude = tzi.Longitude
+		user.UserInfo.Location = tzi.Location
+		user.UserInfo.ZoneName = tzi.ZoneName
+		user.UserInfo.IsDST = tzi.IsDST
+		user.UserInfo.Offset = tzi.Offset
+	})
+	if err != nil {
+		c.Bot().Log().Error("Error saving user", "error", err)
+	}
 
 	return nil
 }
+
+// answerCallbackQuery answers the callback query of the update, if any, so that the client stops showing a spinner
+// on the pressed button.
+func (c *Enable) answerCallbackQuery(u *echotron.Update) {
+	if u.CallbackQuery == nil {
+		return
+	}
+	if _, err := c.Bot().LimitedAPI().AnswerCallbackQuery(u.CallbackQuery.ID, nil); err != nil {
+		c.Bot().Log().Warn("Cannot answer callback query", "error", err)
+	}
+}
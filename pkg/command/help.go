@@ -1,22 +1,16 @@
 package command
 
-import (
-	"fmt"
-	"github.com/apperia-de/tbb"
-)
-
-const helpMessage = `Hi %s 👋. This is an example help message which describes what your bot can do.
-
-Here is a list of available commands:
-
-/enable  Enables the notifications
-/disable Disables the notifications
-/help    Shows this help message`
+import "github.com/apperia-de/tbb"
 
 type Help struct {
 	tbb.DefaultCommandHandler
 }
 
+// NewHelp returns a new Help command handler and can be used as tbb.Command HandlerFn.
+func NewHelp() tbb.CommandHandler {
+	return &Help{}
+}
+
 // Handle function will be called on first command execution /start
 func (c *Help) Handle() tbb.StateFn {
 	name := c.Bot().User().Firstname
@@ -24,6 +18,6 @@ func (c *Help) Handle() tbb.StateFn {
 		name = c.Bot().User().Username
 	}
 
-	_, _ = c.Bot().API().SendMessage(fmt.Sprintf(helpMessage, name), c.Bot().ChatID(), nil)
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("help.message", name), c.Bot().ChatID(), nil)
 	return nil
 }
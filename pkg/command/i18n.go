@@ -0,0 +1,17 @@
+package command
+
+import (
+	"embed"
+	"github.com/apperia-de/tbb"
+)
+
+//go:embed locales
+var locales embed.FS
+
+// Register the translations of all commands in the tbb.DefaultCatalog.
+// They can be overridden by adding messages with the same keys.
+func init() {
+	if err := tbb.DefaultCatalog.LoadFS(locales, "locales"); err != nil {
+		panic(err)
+	}
+}
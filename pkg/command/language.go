@@ -0,0 +1,77 @@
+package command
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"slices"
+	"strings"
+)
+
+const languageAuto = "auto"
+
+type Language struct {
+	tbb.DefaultCommandHandler
+}
+
+// NewLanguage returns a new Language command handler and can be used as tbb.Command HandlerFn.
+// The language can be passed directly like /language de or chosen from a list of all available languages.
+func NewLanguage() tbb.CommandHandler {
+	return &Language{}
+}
+
+// States registers the named states of the Language command, so that the conversation survives session timeouts.
+func (c *Language) States() tbb.StateRegistry {
+	return tbb.StateRegistry{
+		"awaitLanguage": c.awaitLanguage,
+	}
+}
+
+func (c *Language) Handle() tbb.StateFn {
+	if params := c.Bot().Command().Params; len(params) > 0 {
+		c.setLanguage(strings.ToLower(params[0]))
+		return nil
+	}
+
+	tb := c.Bot().TBot()
+	var buttons [][]echotron.InlineKeyboardButton
+	for _, lang := range tb.Catalog().Languages() {
+		buttons = append(buttons, tbb.BuildInlineKeyboardButtonRow([]tbb.InlineKeyboardButton{
+			{Text: tb.T(lang, "language.name"), Data: lang},
+		}))
+	}
+	buttons = append(buttons, tbb.BuildInlineKeyboardButtonRow([]tbb.InlineKeyboardButton{
+		{Text: c.Bot().T("language.auto"), Data: languageAuto},
+	}))
+
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("language.choose"), c.Bot().ChatID(), &echotron.MessageOptions{ReplyMarkup: &echotron.InlineKeyboardMarkup{InlineKeyboard: buttons}})
+	return c.Bot().NextState("awaitLanguage")
+}
+
+func (c *Language) awaitLanguage(u *echotron.Update) tbb.StateFn {
+	if u.CallbackQuery == nil {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("language.choose"), c.Bot().ChatID(), nil)
+		return c.Bot().NextState("awaitLanguage")
+	}
+
+	_, _ = c.Bot().LimitedAPI().AnswerCallbackQuery(u.CallbackQuery.ID, nil)
+	c.setLanguage(u.CallbackQuery.Data)
+	return nil
+}
+
+// setLanguage stores the given language code for the current user or resets it to the language of the Telegram app.
+func (c *Language) setLanguage(lang string) {
+	if lang != languageAuto && !slices.Contains(c.Bot().TBot().Catalog().Languages(), lang) {
+		_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T("language.unknown", lang), c.Bot().ChatID(), nil)
+		return
+	}
+
+	msg := "language.changed"
+	if lang == languageAuto {
+		lang, msg = "", "language.automatic"
+	}
+	if err := c.Bot().SetLanguage(lang); err != nil {
+		c.Bot().Log().Error("Cannot save language", "error", err)
+	}
+
+	_, _ = c.Bot().LimitedAPI().SendMessage(c.Bot().T(msg), c.Bot().ChatID(), nil)
+}
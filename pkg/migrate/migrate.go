@@ -0,0 +1,107 @@
+// Package migrate provides the command line interface for the database migrations of tbb.
+// Applications with their own migrations can build their own migrate command by calling Run with them.
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apperia-de/tbb"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: migrate [-config config.yml] <command>
+
+Commands:
+  status     Show all migrations and whether they have been applied
+  up         Apply all pending migrations
+  down [n]   Roll back the last n applied migrations. Defaults to 1.
+
+Flags:
+`
+
+// Run executes the migrate command with the given arguments and writes its output to w.
+// The migrations of tbb are always included in addition to the given migrations.
+func Run(ctx context.Context, args []string, w io.Writer, ms ...tbb.Migration) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(w, usage)
+		fs.PrintDefaults()
+	}
+	cfgFile := fs.String("config", "config.yml", "tbb config file with the database connection")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("missing command")
+	}
+
+	cfg, err := tbb.LoadConfigE(*cfgFile)
+	if err != nil {
+		return err
+	}
+	db, err := tbb.NewDBE(cfg, nil)
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := db.DB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	m, err := tbb.NewMigrator(db, ms...)
+	if err != nil {
+		return err
+	}
+
+	switch cmd := fs.Arg(0); cmd {
+	case "status":
+		return status(m, w)
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			_, _ = fmt.Fprintf(w, "Applied %d %s\n", mig.Version, mig.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			_, _ = fmt.Fprintln(w, "No pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if fs.NArg() > 1 {
+			if steps, err = strconv.Atoi(fs.Arg(1)); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations: %s", fs.Arg(1))
+			}
+		}
+		rolledBack, err := m.Down(ctx, steps)
+		for _, mig := range rolledBack {
+			_, _ = fmt.Fprintf(w, "Rolled back %d %s\n", mig.Version, mig.Name)
+		}
+		return err
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+}
+
+func status(m *tbb.Migrator, w io.Writer) error {
+	res, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range res {
+		appliedAt := "pending"
+		if s.Applied() {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,48 @@
+package migrate_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/apperia-de/tbb/pkg/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "config.yml")
+	cfg := fmt.Sprintf("telegram:\n  botToken: token\ndatabase:\n  type: sqlite\n  filename: %q\n", filepath.Join(dir, "app.db"))
+	require.NoError(t, os.WriteFile(cfgFile, []byte(cfg), 0o600))
+
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := migrate.Run(context.Background(), append([]string{"-config", cfgFile}, args...), &out)
+		return out.String(), err
+	}
+
+	out, err := run("status")
+	require.NoError(t, err)
+	assert.Contains(t, out, "create_tables")
+	assert.Contains(t, out, "pending")
+
+	out, err = run("up")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Applied 20261017000000 create_tables")
+
+	out, err = run("status")
+	require.NoError(t, err)
+	assert.NotContains(t, out, "pending")
+
+	out, err = run("down")
+	require.NoError(t, err)
+	assert.Contains(t, out, "Rolled back 20261017000200 migrate_banned_users")
+
+	_, err = run("down", "zero")
+	assert.Error(t, err)
+	_, err = run("sideways")
+	assert.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package tbbtest
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Harness connects a tbb.TBot to a fake Bot API Server and feeds updates into it synchronously.
+type Harness struct {
+	t        testing.TB
+	Server   *Server
+	TBot     *tbb.TBot
+	mu       sync.Mutex
+	updateID int
+	msgID    int
+}
+
+// New creates a Harness with a new Server and a TBot, which uses a temporary sqlite database.
+// The given options are applied after the default test config, so WithConfig must not be used here.
+// Use NewWithConfig instead in order to provide a custom config.
+func New(t testing.TB, opts ...tbb.Option) *Harness {
+	return NewWithConfig(t, &tbb.Config{}, opts...)
+}
+
+// NewWithConfig is like New but uses the given config.
+// The Telegram api url is always set to the fake Server. The bot token and a temporary sqlite
+// database are only set if they are not already configured.
+//
+// Limits of outgoing messages, which are not configured, are disabled, so that tests never wait for them.
+// The given config is copied and not modified.
+func NewWithConfig(t testing.TB, cfg *tbb.Config, opts ...tbb.Option) *Harness {
+	t.Helper()
+
+	c := *cfg
+	cfg = &c
+	for _, limit := range []*float64{&cfg.RateLimit.Global, &cfg.RateLimit.Chat, &cfg.RateLimit.Group} {
+		if *limit == 0 {
+			*limit = -1
+		}
+	}
+
+	h := &Harness{
+		t:      t,
+		Server: NewServer(t),
+	}
+
+	cfg.Telegram.APIURL = h.Server.URL
+	if cfg.Telegram.BotToken == "" {
+		cfg.Telegram.BotToken = BotToken
+	}
+	if cfg.Database.Type == "" {
+		cfg.Database.Type = tbb.DB_TYPE_SQLITE
+		cfg.Database.Filename = filepath.Join(t.TempDir(), "tbbtest.db")
+	}
+	if cfg.BotSessionTimeout == 0 {
+		cfg.BotSessionTimeout = 15
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "error"
+	}
+
+	tbot, err := tbb.NewE(append([]tbb.Option{tbb.WithConfig(cfg)}, opts...)...)
+	if err != nil {
+		t.Fatalf("cannot create tbot: %s", err)
+	}
+	h.TBot = tbot
+	t.Cleanup(func() { _ = tbot.Shutdown() })
+
+	return h
+}
+
+// SendUpdate processes the given update synchronously and assigns an update ID if missing.
+func (h *Harness) SendUpdate(u *echotron.Update) *echotron.Update {
+	h.mu.Lock()
+	h.updateID++
+	if u.ID == 0 {
+		u.ID = h.updateID
+	}
+	h.mu.Unlock()
+
+	h.TBot.HandleUpdate(u)
+	return u
+}
+
+// SendMessage sends a text message from the private chat with the given chatID.
+func (h *Harness) SendMessage(chatID int64, text string) *echotron.Update {
+	return h.SendUpdate(&echotron.Update{Message: h.newMessage(chatID, text)})
+}
+
+// SendLocation sends a location from the private chat with the given chatID.
+func (h *Harness) SendLocation(chatID int64, lat, lon float64) *echotron.Update {
+	msg := h.newMessage(chatID, "")
+	msg.Location = &echotron.Location{Latitude: lat, Longitude: lon}
+	return h.SendUpdate(&echotron.Update{Message: msg})
+}
+
+// SendCallbackQuery presses an inline keyboard button with the given callback data in the private chat with the given chatID.
+func (h *Harness) SendCallbackQuery(chatID int64, data string) *echotron.Update {
+	return h.SendUpdate(&echotron.Update{
+		CallbackQuery: &echotron.CallbackQuery{
+			ID:      "callback",
+			From:    &echotron.User{ID: chatID, FirstName: "Test"},
+			Message: h.newMessage(chatID, ""),
+			Data:    data,
+		},
+	})
+}
+
+// Messages returns the texts of all messages sent or edited by the bot in the chat with the given chatID.
+func (h *Harness) Messages(chatID int64) []string {
+	var res []string
+	for _, r := range h.Server.Requests("") {
+		if (r.Method == "sendMessage" || r.Method == "editMessageText") && r.ChatID() == chatID {
+			res = append(res, r.Text())
+		}
+	}
+	return res
+}
+
+// AssertMessage asserts that the chat with the given chatID received a message matching the regular expression.
+func (h *Harness) AssertMessage(chatID int64, pattern string) bool {
+	h.t.Helper()
+	re := regexp.MustCompile(pattern)
+	for _, m := range h.Messages(chatID) {
+		if re.MatchString(m) {
+			return true
+		}
+	}
+	h.t.Errorf("chat %d did not receive a message matching %q, received: %q", chatID, pattern, h.Messages(chatID))
+	return false
+}
+
+// AssertNoMessage asserts that the chat with the given chatID did not receive a message matching the regular expression.
+func (h *Harness) AssertNoMessage(chatID int64, pattern string) bool {
+	h.t.Helper()
+	re := regexp.MustCompile(pattern)
+	for _, m := range h.Messages(chatID) {
+		if re.MatchString(m) {
+			h.t.Errorf("chat %d received an unexpected message matching %q: %q", chatID, pattern, m)
+			return false
+		}
+	}
+	return true
+}
+
+// AssertRequest asserts that the Bot API method has been called at least once and returns the matching requests.
+func (h *Harness) AssertRequest(method string) []Request {
+	h.t.Helper()
+	res := h.Server.Requests(method)
+	if len(res) == 0 {
+		h.t.Errorf("expected a %s request, received: %v", method, h.Server.Requests(""))
+	}
+	return res
+}
+
+func (h *Harness) newMessage(chatID int64, text string) *echotron.Message {
+	h.mu.Lock()
+	h.msgID++
+	id := h.msgID
+	h.mu.Unlock()
+
+	return &echotron.Message{
+		ID:   id,
+		Date: int(time.Now().Unix()),
+		From: &echotron.User{ID: chatID, FirstName: "Test", LanguageCode: "en"},
+		Chat: echotron.Chat{ID: chatID, Type: "private", FirstName: "Test"},
+		Text: text,
+	}
+}
@@ -0,0 +1,175 @@
+package tbbtest_test
+
+import (
+	"context"
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type echoCommand struct {
+	tbb.DefaultCommandHandler
+}
+
+func (c *echoCommand) States() tbb.StateRegistry {
+	return tbb.StateRegistry{"awaitText": c.awaitText}
+}
+
+func (c *echoCommand) Handle() tbb.StateFn {
+	_, _ = c.Bot().API().SendMessage("Echo: "+strings.Join(c.Bot().Command().Params, " "), c.Bot().ChatID(), nil)
+	_, _ = c.Bot().API().SendMessage("Send me another text", c.Bot().ChatID(), nil)
+	return c.Bot().NextState("awaitText")
+}
+
+func (c *echoCommand) awaitText(u *echotron.Update) tbb.StateFn {
+	_, _ = c.Bot().API().SendMessage("Echo again: "+u.Message.Text, c.Bot().ChatID(), nil)
+	return nil
+}
+
+var echoCommands = []tbb.Command{
+	{
+		Name:        "/echo",
+		Description: "Echo the given text",
+		HandlerFn:   func() tbb.CommandHandler { return &echoCommand{} },
+	},
+}
+
+func TestHarness(t *testing.T) {
+	h := tbbtest.New(t, tbb.WithCommands(echoCommands))
+
+	h.SendMessage(42, "/echo hello world")
+	h.AssertMessage(42, `^Echo: hello world$`)
+	h.AssertMessage(42, `another text`)
+	h.AssertNoMessage(43, `.*`)
+
+	h.SendMessage(42, "again")
+	h.AssertMessage(42, `^Echo again: again$`)
+	assert.Len(t, h.Messages(42), 3)
+
+	h.Server.Reset()
+	assert.Empty(t, h.Messages(42))
+}
+
+func TestHarness_Run(t *testing.T) {
+	h := tbbtest.New(t, tbb.WithCommands(echoCommands))
+	h.Server.QueueUpdate(&echotron.Update{
+		Message: &echotron.Message{
+			From: &echotron.User{ID: 42},
+			Chat: echotron.Chat{ID: 42, Type: "private"},
+			Text: "/echo polling",
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- h.TBot.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		for _, m := range h.Messages(42) {
+			if m == "Echo: polling" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+
+	cmds := h.AssertRequest("setMyCommands")
+	assert.Contains(t, cmds[0].Params.Get("commands"), "/echo")
+	h.AssertRequest("deleteWebhook")
+}
+
+func TestHarness_RunFailsOnAPIErrors(t *testing.T) {
+	h := tbbtest.New(t, tbb.WithCommands(echoCommands))
+	h.Server.Respond("getUpdates", func(tbbtest.Request) tbbtest.Response {
+		return tbbtest.Response{ErrorCode: 401, Description: "Unauthorized"}
+	})
+
+	done := make(chan error)
+	go func() { done <- h.TBot.Run(context.Background()) }()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, tbb.ErrGetUpdates)
+		assert.NotContains(t, err.Error(), tbbtest.BotToken)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not fail")
+	}
+}
+
+func TestHarness_RunRetriesTemporaryAPIErrors(t *testing.T) {
+	h := tbbtest.New(t, tbb.WithCommands(echoCommands))
+	var calls atomic.Int32
+	h.Server.Respond("getUpdates", func(tbbtest.Request) tbbtest.Response {
+		switch calls.Add(1) {
+		case 1:
+			return tbbtest.Response{ErrorCode: 429, Description: "Too Many Requests: retry after 1", RetryAfter: 1}
+		case 2:
+			return tbbtest.Response{Result: []*echotron.Update{
+				// Callback query of an inline message, which belongs to no chat
+				{ID: 1, CallbackQuery: &echotron.CallbackQuery{ID: "q1", From: &echotron.User{ID: 42}, InlineMessageID: "m1"}},
+				{ID: 2, Message: &echotron.Message{From: &echotron.User{ID: 42}, Chat: echotron.Chat{ID: 42, Type: "private"}, Text: "/echo retried"}},
+			}}
+		default:
+			time.Sleep(10 * time.Millisecond)
+			return tbbtest.Response{Result: []*echotron.Update{}}
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- h.TBot.Run(ctx) }()
+
+	assert.Eventually(t, func() bool {
+		for _, m := range h.Messages(42) {
+			if m == "Echo: retried" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
+
+func TestHarness_HandleUpdateWithoutChat(t *testing.T) {
+	h := tbbtest.New(t)
+	h.Server.Reset()
+
+	assert.NotPanics(t, func() {
+		h.TBot.HandleUpdate(&echotron.Update{ID: 1, CallbackQuery: &echotron.CallbackQuery{ID: "q1", From: &echotron.User{ID: 42}, InlineMessageID: "m1"}})
+		h.TBot.HandleUpdate(&echotron.Update{ID: 2, Poll: &echotron.Poll{ID: "p1"}})
+	})
+	assert.Empty(t, h.Server.Requests(""))
+}
+
+func TestHarness_DownloadFileFails(t *testing.T) {
+	h := tbbtest.New(t)
+	h.Server.Respond("getFile", func(tbbtest.Request) tbbtest.Response {
+		return tbbtest.Response{Result: echotron.File{FileID: "f1", FilePath: "files/missing"}}
+	})
+
+	_, err := h.TBot.DownloadFile("f1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+	assert.NotContains(t, err.Error(), tbbtest.BotToken)
+}
@@ -0,0 +1,296 @@
+// Package tbbtest provides an in-process fake of the Telegram Bot API and a test harness,
+// which allow writing end-to-end conversation tests for tbb bots without network access.
+package tbbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	BotID       = 100000001
+	BotUsername = "tbbtest_bot"
+	BotToken    = "100000001:TBBTEST"
+
+	maxPollWait = time.Second // Upper bound for long polling, so that closing the server never blocks for long
+)
+
+// Request is a recorded Bot API request.
+type Request struct {
+	Method string            // Bot API method, e.g. sendMessage
+	Params url.Values        // Query and form parameters of the request
+	Files  map[string][]byte // Uploaded files by parameter name, e.g. certificate
+}
+
+// ChatID returns the chat_id parameter of the request or zero if not available.
+func (r Request) ChatID() int64 {
+	id, _ := strconv.ParseInt(r.Params.Get("chat_id"), 10, 64)
+	return id
+}
+
+// Text returns the text parameter of the request.
+func (r Request) Text() string {
+	return r.Params.Get("text")
+}
+
+// Response is the response of a ResponderFunc. A non-zero ErrorCode results in a failed API response.
+type Response struct {
+	Result      any
+	ErrorCode   int
+	Description string
+	RetryAfter  int // Seconds to wait before retrying a failed request, e.g. with ErrorCode 429
+}
+
+// ResponderFunc returns the Response for a recorded Request.
+type ResponderFunc func(Request) Response
+
+// Server is a fake Telegram Bot API server, which records all requests and answers them with plausible results.
+type Server struct {
+	*httptest.Server
+	mu         sync.Mutex
+	requests   []Request
+	updates    []*echotron.Update
+	updateID   int
+	messageID  int
+	files      map[string][]byte
+	responders map[string]ResponderFunc
+	notify     chan struct{}
+}
+
+// NewServer starts a new fake Bot API Server, which is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		files:      map[string][]byte{},
+		responders: map[string]ResponderFunc{},
+		notify:     make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Respond overrides the response of the given Bot API method.
+func (s *Server) Respond(method string, fn ResponderFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responders[method] = fn
+}
+
+// AddFile registers a file, which can be requested with getFile by the given fileID and downloaded afterward.
+func (s *Server) AddFile(fileID string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[fileID] = data
+}
+
+// QueueUpdate queues the given update, so that it will be received by polling bots.
+func (s *Server) QueueUpdate(u *echotron.Update) {
+	s.mu.Lock()
+	s.updateID++
+	u.ID = s.updateID
+	s.updates = append(s.updates, u)
+	close(s.notify)
+	s.notify = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Requests returns all recorded requests of the given method or all requests if method is empty.
+func (s *Server) Requests(method string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []Request
+	for _, r := range s.requests {
+		if method == "" || r.Method == method {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Reset deletes all recorded requests.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(path, "file/") {
+		s.serveFile(w, path)
+		return
+	}
+
+	_, method, ok := strings.Cut(path, "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	method = strings.TrimSuffix(method, "/")
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := Request{Method: method, Params: r.Form}
+	if r.MultipartForm != nil {
+		req.Files = map[string][]byte{}
+		for name, fhs := range r.MultipartForm.File {
+			f, err := fhs[0].Open()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Files[name], err = io.ReadAll(f)
+			_ = f.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	fn, ok := s.responders[method]
+	s.mu.Unlock()
+
+	var res Response
+	if ok {
+		res = fn(req)
+	} else {
+		res = s.respond(r, req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.ErrorCode != 0 {
+		w.WriteHeader(res.ErrorCode)
+		body := map[string]any{"ok": false, "error_code": res.ErrorCode, "description": res.Description}
+		if res.RetryAfter > 0 {
+			body["parameters"] = map[string]any{"retry_after": res.RetryAfter}
+		}
+		_ = json.NewEncoder(w).Encode(body)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": res.Result})
+}
+
+// respond returns the default response for the given request.
+func (s *Server) respond(r *http.Request, req Request) Response {
+	switch req.Method {
+	case "getMe":
+		return Response{Result: echotron.User{ID: BotID, IsBot: true, FirstName: "Test Bot", Username: BotUsername}}
+	case "getUpdates":
+		return Response{Result: s.pendingUpdates(r, req)}
+	case "sendMessage", "sendLocation", "sendPhoto", "sendDocument", "copyMessage", "forwardMessage":
+		return Response{Result: s.newMessage(req)}
+	case "editMessageText":
+		msg := s.newMessage(req)
+		msg.ID, _ = strconv.Atoi(req.Params.Get("message_id"))
+		return Response{Result: msg}
+	case "getFile":
+		return s.getFile(req.Params.Get("file_id"))
+	case "getUserProfilePhotos":
+		return Response{Result: echotron.UserProfilePhotos{}}
+	case "getChat":
+		return Response{Result: echotron.ChatFullInfo{ID: req.ChatID()}}
+	case "getChatMemberCount":
+		return Response{Result: 1}
+	default:
+		return Response{Result: true}
+	}
+}
+
+func (s *Server) newMessage(req Request) echotron.Message {
+	s.mu.Lock()
+	s.messageID++
+	id := s.messageID
+	s.mu.Unlock()
+
+	return echotron.Message{
+		ID:   id,
+		Date: int(time.Now().Unix()),
+		Chat: echotron.Chat{ID: req.ChatID()},
+		From: &echotron.User{ID: BotID, IsBot: true, Username: BotUsername},
+		Text: req.Text(),
+	}
+}
+
+func (s *Server) getFile(fileID string) Response {
+	s.mu.Lock()
+	data, ok := s.files[fileID]
+	s.mu.Unlock()
+
+	if !ok {
+		return Response{ErrorCode: http.StatusBadRequest, Description: "Bad Request: invalid file_id"}
+	}
+	return Response{Result: echotron.File{
+		FileID:       fileID,
+		FileUniqueID: "unique-" + fileID,
+		FileSize:     int64(len(data)),
+		FilePath:     "files/" + fileID,
+	}}
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, path string) {
+	// Path format: file/bot<token>/files/<fileID>
+	_, fileID, _ := strings.Cut(path, "/files/")
+
+	s.mu.Lock()
+	data, ok := s.files[fileID]
+	s.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+// pendingUpdates returns all updates starting at the requested offset and waits shortly for new ones if there are none.
+func (s *Server) pendingUpdates(r *http.Request, req Request) []*echotron.Update {
+	offset, _ := strconv.Atoi(req.Params.Get("offset"))
+	timeout, _ := strconv.Atoi(req.Params.Get("timeout"))
+	wait := min(time.Duration(timeout)*time.Second, maxPollWait)
+	deadline := time.After(wait)
+
+	for {
+		s.mu.Lock()
+		var res []*echotron.Update
+		for _, u := range s.updates {
+			if u.ID >= offset {
+				res = append(res, u)
+			}
+		}
+		notify := s.notify
+		s.mu.Unlock()
+
+		if len(res) > 0 || wait == 0 {
+			return res
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return res
+		case <-r.Context().Done():
+			return res
+		}
+	}
+}
+
+// String returns a short description of the request for failure messages.
+func (r Request) String() string {
+	return fmt.Sprintf("%s(%s)", r.Method, r.Params.Encode())
+}
@@ -0,0 +1,445 @@
+package tbb
+
+import (
+	"context"
+	"errors"
+	"github.com/NicoNex/echotron/v3"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpdateBurst = 5         // Default number of updates a chat may send at once
+	defaultGlobalRate  = 30        // Telegram allows about 30 messages per second in total
+	defaultChatRate    = 1         // Telegram allows about one message per second in a private chat
+	defaultGroupRate   = 20.0 / 60 // Telegram allows about 20 messages per minute in a group
+
+	apiChatBurst       = 3               // Number of requests, which may be sent to a single chat at once
+	apiMaxAttempts     = 3               // Maximum number of attempts of a request failing with 429 Too Many Requests
+	apiMaxRetryWait    = time.Minute     // Requests with a longer retry_after are not retried, but fail immediately
+	apiRetryDelay      = time.Second * 3 // Delay before retrying a request if Telegram sent no retry_after
+	apiLimiterMaxChats = 10000           // Number of chat limiters, after which idle limiters are removed
+
+	echotronRequestInterval = time.Nanosecond // Interval of echotron's own limiters, which never delays a request
+
+	slowDownSilent = "-" // Config.RateLimit.Message, which disables the slow down reply
+)
+
+var retryAfterRegex = regexp.MustCompile(`retry after (\d+)`)
+
+// RateLimitMiddleware limits the incoming updates per chat to Config.RateLimit.Updates per second.
+// The first dropped update is answered with Config.RateLimit.Message or the translated message tbb.slowDown,
+// all further updates are dropped silently until the chat slows down.
+// Changes of the bot's own membership are never limited, because they are not sent by the users of the chat.
+func RateLimitMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		if u.MyChatMember != nil {
+			next(b, u)
+			return
+		}
+		if lim := b.updateLimiter(); lim != nil && !lim.Allow() {
+			b.Log().Debug("Rate limit exceeded, dropping update", "chatID", b.chatID, "updateID", u.ID)
+			if !b.throttled {
+				b.throttled = true
+				b.sendSlowDown()
+			}
+			return
+		}
+		b.throttled = false
+		next(b, u)
+	}
+}
+
+// updateLimiter returns the limiter of incoming updates of the session or nil if updates are not limited.
+func (b *Bot) updateLimiter() *rate.Limiter {
+	cfg := b.tbot.cfg.RateLimit
+	if cfg.Updates <= 0 {
+		return nil
+	}
+	if b.limiter == nil {
+		burst := cfg.UpdatesBurst
+		if burst <= 0 {
+			burst = defaultUpdateBurst
+		}
+		b.limiter = rate.NewLimiter(rate.Limit(cfg.Updates), burst)
+	}
+	return b.limiter
+}
+
+func (b *Bot) sendSlowDown() {
+	text := b.tbot.cfg.RateLimit.Message
+	switch text {
+	case slowDownSilent:
+		return
+	case "":
+		text = b.T("tbb.slowDown")
+	}
+	if _, err := b.LimitedAPI().SendMessage(text, b.chatID, nil); err != nil {
+		b.Log().Warn("Cannot send slow down message", "chatID", b.chatID, "error", err)
+	}
+}
+
+// API wraps echotron.API and throttles all requests, which send, edit or delete messages, according to
+// the global, per-chat and per-group limits of Config.RateLimit. Requests failing with 429 Too Many Requests are
+// retried after the retry_after duration sent by Telegram. All other methods are passed through unchanged.
+type API struct {
+	echotron.API
+	lim     *apiLimiter
+	ctx     func() context.Context
+	logger  *slog.Logger
+	onSent  func(method string, chatID int64, res any) // Called with the response of every successful request
+	metrics *metrics
+	tracer  trace.Tracer
+}
+
+// newAPI returns an API for the given echotron.API with its own limits, because Telegram limits every bot separately.
+// Sent messages are stored if Config.MessageStore is enabled.
+func (tb *TBot) newAPI(api echotron.API) API {
+	a := API{
+		API:     api,
+		lim:     newAPILimiter(tb.cfg),
+		ctx:     tb.Context,
+		logger:  tb.logger,
+		metrics: tb.metrics,
+		tracer:  tb.tracer,
+	}
+	if tb.cfg.MessageStore.Enabled {
+		a.onSent = tb.recordSent
+	}
+	return a
+}
+
+// WithContext returns a copy of the API, which stops waiting for the rate limits as soon as the context is done.
+// By default, the API uses the context of the running bot.
+func (a API) WithContext(ctx context.Context) API {
+	a.ctx = func() context.Context { return ctx }
+	return a
+}
+
+func (a API) SendMessage(text string, chatID int64, opts *echotron.MessageOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendMessage", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendMessage(text, chatID, opts) })
+}
+
+func (a API) ForwardMessage(chatID, fromChatID int64, messageID int, opts *echotron.ForwardOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "forwardMessage", chatID, func() (echotron.APIResponseMessage, error) {
+		return a.API.ForwardMessage(chatID, fromChatID, messageID, opts)
+	})
+}
+
+func (a API) ForwardMessages(chatID, fromChatID int64, messageIDs []int, opts *echotron.ForwardOptions) (echotron.APIResponseMessageIDs, error) {
+	return call(a, "forwardMessages", chatID, func() (echotron.APIResponseMessageIDs, error) {
+		return a.API.ForwardMessages(chatID, fromChatID, messageIDs, opts)
+	})
+}
+
+func (a API) CopyMessage(chatID, fromChatID int64, messageID int, opts *echotron.CopyOptions) (echotron.APIResponseMessageID, error) {
+	return call(a, "copyMessage", chatID, func() (echotron.APIResponseMessageID, error) {
+		return a.API.CopyMessage(chatID, fromChatID, messageID, opts)
+	})
+}
+
+func (a API) CopyMessages(chatID, fromChatID int64, messageIDs []int, opts *echotron.CopyMessagesOptions) (echotron.APIResponseMessageIDs, error) {
+	return call(a, "copyMessages", chatID, func() (echotron.APIResponseMessageIDs, error) {
+		return a.API.CopyMessages(chatID, fromChatID, messageIDs, opts)
+	})
+}
+
+func (a API) SendPhoto(file echotron.InputFile, chatID int64, opts *echotron.PhotoOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendPhoto", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendPhoto(file, chatID, opts) })
+}
+
+func (a API) SendAudio(file echotron.InputFile, chatID int64, opts *echotron.AudioOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendAudio", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendAudio(file, chatID, opts) })
+}
+
+func (a API) SendDocument(file echotron.InputFile, chatID int64, opts *echotron.DocumentOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendDocument", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendDocument(file, chatID, opts) })
+}
+
+func (a API) SendVideo(file echotron.InputFile, chatID int64, opts *echotron.VideoOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendVideo", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendVideo(file, chatID, opts) })
+}
+
+func (a API) SendAnimation(file echotron.InputFile, chatID int64, opts *echotron.AnimationOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendAnimation", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendAnimation(file, chatID, opts) })
+}
+
+func (a API) SendVoice(file echotron.InputFile, chatID int64, opts *echotron.VoiceOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendVoice", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendVoice(file, chatID, opts) })
+}
+
+func (a API) SendVideoNote(file echotron.InputFile, chatID int64, opts *echotron.VideoNoteOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendVideoNote", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendVideoNote(file, chatID, opts) })
+}
+
+func (a API) SendMediaGroup(chatID int64, media []echotron.GroupableInputMedia, opts *echotron.MediaGroupOptions) (echotron.APIResponseMessageArray, error) {
+	return call(a, "sendMediaGroup", chatID, func() (echotron.APIResponseMessageArray, error) { return a.API.SendMediaGroup(chatID, media, opts) })
+}
+
+func (a API) SendLocation(chatID int64, latitude, longitude float64, opts *echotron.LocationOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendLocation", chatID, func() (echotron.APIResponseMessage, error) {
+		return a.API.SendLocation(chatID, latitude, longitude, opts)
+	})
+}
+
+func (a API) SendVenue(chatID int64, latitude, longitude float64, title, address string, opts *echotron.VenueOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendVenue", chatID, func() (echotron.APIResponseMessage, error) {
+		return a.API.SendVenue(chatID, latitude, longitude, title, address, opts)
+	})
+}
+
+func (a API) SendContact(phoneNumber, firstName string, chatID int64, opts *echotron.ContactOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendContact", chatID, func() (echotron.APIResponseMessage, error) {
+		return a.API.SendContact(phoneNumber, firstName, chatID, opts)
+	})
+}
+
+func (a API) SendPoll(chatID int64, question string, options []echotron.InputPollOption, opts *echotron.PollOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendPoll", chatID, func() (echotron.APIResponseMessage, error) {
+		return a.API.SendPoll(chatID, question, options, opts)
+	})
+}
+
+func (a API) SendDice(chatID int64, emoji echotron.DiceEmoji, opts *echotron.BaseOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendDice", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendDice(chatID, emoji, opts) })
+}
+
+func (a API) SendSticker(stickerID string, chatID int64, opts *echotron.StickerOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "sendSticker", chatID, func() (echotron.APIResponseMessage, error) { return a.API.SendSticker(stickerID, chatID, opts) })
+}
+
+// EditMessageText only respects the global limit, because the chat of echotron.MessageIDOptions is not accessible.
+func (a API) EditMessageText(text string, msg echotron.MessageIDOptions, opts *echotron.MessageTextOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "editMessageText", 0, func() (echotron.APIResponseMessage, error) { return a.API.EditMessageText(text, msg, opts) })
+}
+
+// EditMessageCaption only respects the global limit, because the chat of echotron.MessageIDOptions is not accessible.
+func (a API) EditMessageCaption(msg echotron.MessageIDOptions, opts *echotron.MessageCaptionOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "editMessageCaption", 0, func() (echotron.APIResponseMessage, error) { return a.API.EditMessageCaption(msg, opts) })
+}
+
+// EditMessageMedia only respects the global limit, because the chat of echotron.MessageIDOptions is not accessible.
+func (a API) EditMessageMedia(msg echotron.MessageIDOptions, media echotron.InputMedia, opts *echotron.MessageMediaOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "editMessageMedia", 0, func() (echotron.APIResponseMessage, error) { return a.API.EditMessageMedia(msg, media, opts) })
+}
+
+// EditMessageReplyMarkup only respects the global limit, because the chat of echotron.MessageIDOptions is not accessible.
+func (a API) EditMessageReplyMarkup(msg echotron.MessageIDOptions, opts *echotron.MessageReplyMarkupOptions) (echotron.APIResponseMessage, error) {
+	return call(a, "editMessageReplyMarkup", 0, func() (echotron.APIResponseMessage, error) { return a.API.EditMessageReplyMarkup(msg, opts) })
+}
+
+func (a API) DeleteMessage(chatID int64, messageID int) (echotron.APIResponseBase, error) {
+	return call(a, "deleteMessage", chatID, func() (echotron.APIResponseBase, error) { return a.API.DeleteMessage(chatID, messageID) })
+}
+
+func (a API) SendChatAction(action echotron.ChatAction, chatID int64, opts *echotron.ChatActionOptions) (echotron.APIResponseBool, error) {
+	return call(a, "sendChatAction", chatID, func() (echotron.APIResponseBool, error) { return a.API.SendChatAction(action, chatID, opts) })
+}
+
+// GetChat is not rate limited, but guarded like every request to a chat, see echotronGuard.
+func (a API) GetChat(chatID int64) (echotron.APIResponseChat, error) {
+	return echotronRequest("getChat", chatID, func() (echotron.APIResponseChat, error) { return a.API.GetChat(chatID) })
+}
+
+// GetChatMemberCount is not rate limited, but guarded like every request to a chat, see echotronGuard.
+func (a API) GetChatMemberCount(chatID int64) (echotron.APIResponseInteger, error) {
+	return echotronRequest("getChatMemberCount", chatID, func() (echotron.APIResponseInteger, error) {
+		return a.API.GetChatMemberCount(chatID)
+	})
+}
+
+func (a API) AnswerCallbackQuery(callbackID string, opts *echotron.CallbackQueryOptions) (echotron.APIResponseBool, error) {
+	return call(a, "answerCallbackQuery", 0, func() (echotron.APIResponseBool, error) { return a.API.AnswerCallbackQuery(callbackID, opts) })
+}
+
+// call calls fn, which sends a request of the given Bot API method to the chat, within the rate limits.
+func call[T any](a API, method string, chatID int64, fn func() (T, error)) (T, error) {
+	span := a.startSpan(method, chatID)
+	res, err := throttle(a, chatID, func() (T, error) { return echotronRequest(method, chatID, fn) })
+	endSpan(span, err)
+	if err != nil {
+		a.metrics.countAPIError(method, err)
+	} else if a.onSent != nil {
+		a.onSent(method, chatID, res)
+	}
+	return res, err
+}
+
+// throttle waits for the rate limits of the chat and calls fn. A chatID of zero only waits for the global limit.
+// If fn fails with 429 Too Many Requests, it is called again after the retry_after duration sent by Telegram.
+func throttle[T any](a API, chatID int64, fn func() (T, error)) (T, error) {
+	if a.lim == nil {
+		return fn()
+	}
+
+	ctx := context.Background()
+	if a.ctx != nil {
+		ctx = a.ctx()
+	}
+	for attempt := 1; ; attempt++ {
+		if err := a.lim.wait(ctx, chatID); err != nil {
+			var res T
+			return res, err
+		}
+
+		res, err := fn()
+		var apiErr *echotron.APIError
+		if attempt >= apiMaxAttempts || !errors.As(err, &apiErr) || apiErr.ErrorCode() != http.StatusTooManyRequests {
+			return res, err
+		}
+		wait := retryAfter(apiErr.Description())
+		if wait > apiMaxRetryWait {
+			return res, err
+		}
+
+		if a.logger != nil {
+			a.logger.Warn("Too many requests, retrying", "chatID", chatID, "retryIn", wait, "attempt", attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// relaxEchotronLimits lifts the per process limits of echotron once, because the API applies the limits of
+// Config.RateLimit. The limits are set to echotronRequestInterval rather than 0, which echotron does not handle
+// as a special case.
+var relaxEchotronLimits = sync.OnceFunc(func() {
+	echotron.SetGlobalRequestLimit(echotronRequestInterval)
+	echotron.SetChatRequestLimit(echotronRequestInterval)
+})
+
+// echotronGuard protects the per-chat limiters of echotron, which adds the limiter of a new chat to a map while
+// holding only a read lock. The first request to a chat holds mu exclusively, all other requests share it.
+type echotronGuard struct {
+	mu    sync.RWMutex
+	chats sync.Map // Chats, which echotron has created a limiter for
+}
+
+var echotronChats echotronGuard
+
+// echotronEditMethods send the chat of echotron.MessageIDOptions, which is not accessible, so that they are always
+// guarded like the first request to a chat.
+var echotronEditMethods = map[string]bool{
+	"editMessageText":        true,
+	"editMessageCaption":     true,
+	"editMessageMedia":       true,
+	"editMessageReplyMarkup": true,
+}
+
+// echotronRequest calls fn, which sends a request of the given Bot API method to the chat, guarded by echotronChats.
+// A chatID of zero stands for a request without chat.
+func echotronRequest[T any](method string, chatID int64, fn func() (T, error)) (T, error) {
+	known := !echotronEditMethods[method]
+	if chatID != 0 {
+		_, known = echotronChats.chats.Load(chatID)
+	}
+	if known {
+		echotronChats.mu.RLock()
+		defer echotronChats.mu.RUnlock()
+		return fn()
+	}
+
+	echotronChats.mu.Lock()
+	defer echotronChats.mu.Unlock()
+	res, err := fn()
+	if chatID != 0 {
+		echotronChats.chats.Store(chatID, struct{}{})
+	}
+	return res, err
+}
+
+// retryAfter returns the duration to wait as requested by a "Too Many Requests: retry after N" error description.
+func retryAfter(description string) time.Duration {
+	m := retryAfterRegex.FindStringSubmatch(description)
+	if m == nil {
+		return apiRetryDelay
+	}
+	s, _ := strconv.Atoi(m[1])
+	return time.Duration(s) * time.Second
+}
+
+// apiLimiter limits the outgoing requests of a bot in total and per chat.
+type apiLimiter struct {
+	global *rate.Limiter
+	chat   rate.Limit // Limit of private chats
+	group  rate.Limit // Limit of groups and channels, which have negative chatIDs
+	mu     sync.Mutex
+	chats  map[int64]*rate.Limiter // Guarded by mu
+}
+
+func newAPILimiter(cfg *Config) *apiLimiter {
+	global, burst := rateLimit(cfg.RateLimit.Global, defaultGlobalRate), 1
+	if global != rate.Inf {
+		burst = max(1, int(global))
+	}
+	return &apiLimiter{
+		global: rate.NewLimiter(global, burst),
+		chat:   rateLimit(cfg.RateLimit.Chat, defaultChatRate),
+		group:  rateLimit(cfg.RateLimit.Group, defaultGroupRate),
+		chats:  map[int64]*rate.Limiter{},
+	}
+}
+
+func (l *apiLimiter) wait(ctx context.Context, chatID int64) error {
+	if lim := l.chatLimiter(chatID); lim != nil {
+		if err := lim.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return l.global.Wait(ctx)
+}
+
+// chatLimiter returns the limiter of the chat or nil if the requests to the chat are not limited.
+func (l *apiLimiter) chatLimiter(chatID int64) *rate.Limiter {
+	r := l.chat
+	if chatID < 0 {
+		r = l.group
+	}
+	if chatID == 0 || r == rate.Inf {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.chats[chatID]
+	if !ok {
+		if len(l.chats) >= apiLimiterMaxChats {
+			l.prune()
+		}
+		lim = rate.NewLimiter(r, apiChatBurst)
+		l.chats[chatID] = lim
+	}
+	return lim
+}
+
+// prune removes the limiters of all chats, which have been idle long enough to be fully replenished.
+func (l *apiLimiter) prune() {
+	now := time.Now()
+	for chatID, lim := range l.chats {
+		if lim.TokensAt(now) >= float64(lim.Burst()) {
+			delete(l.chats, chatID)
+		}
+	}
+}
+
+// rateLimit returns the configured limit per second, the default limit if not configured or rate.Inf if negative.
+func rateLimit(perSecond, def float64) rate.Limit {
+	switch {
+	case perSecond < 0:
+		return rate.Inf
+	case perSecond == 0:
+		return rate.Limit(def)
+	default:
+		return rate.Limit(perSecond)
+	}
+}
@@ -0,0 +1,112 @@
+package tbb_test
+
+import (
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	commands := tbb.WithCommands([]tbb.Command{{Name: "/help", HandlerFn: command.NewHelp}})
+
+	t.Run("should ask the user to slow down once", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.RateLimit.Updates = 0.001
+		cfg.RateLimit.UpdatesBurst = 2
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+
+		for range 5 {
+			h.SendMessage(42, "/help")
+		}
+		assert.Len(t, h.Messages(42), 3)
+		h.AssertMessage(42, `^You are sending too many messages\. Please slow down\.$`)
+
+		h.SendMessage(43, "/help")
+		h.AssertMessage(43, `list of available commands`)
+	})
+
+	t.Run("should use the configured message", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.RateLimit.Updates = 0.001
+		cfg.RateLimit.UpdatesBurst = 1
+		cfg.RateLimit.Message = "Easy, tiger!"
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+
+		h.SendMessage(42, "/help")
+		h.SendMessage(42, "/help")
+		h.AssertMessage(42, `^Easy, tiger!$`)
+	})
+}
+
+func TestAPIRateLimit(t *testing.T) {
+	t.Run("should limit the messages per chat", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.RateLimit.Chat = 20
+		h := tbbtest.NewWithConfig(t, cfg)
+
+		start := time.Now()
+		for range 5 {
+			_, err := h.TBot.LimitedAPI().SendMessage("Hello", 42, nil)
+			require.NoError(t, err)
+		}
+		// The first three messages are sent at once, the remaining ones every 50ms.
+		assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*90)
+
+		start = time.Now()
+		_, err := h.TBot.LimitedAPI().SendMessage("Hello", 43, nil)
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), time.Millisecond*50)
+	})
+
+	t.Run("should retry after too many requests", func(t *testing.T) {
+		h := tbbtest.New(t)
+		var calls atomic.Int32
+		h.Server.Respond("sendMessage", func(r tbbtest.Request) tbbtest.Response {
+			if calls.Add(1) == 1 {
+				return tbbtest.Response{ErrorCode: http.StatusTooManyRequests, Description: "Too Many Requests: retry after 1"}
+			}
+			return tbbtest.Response{Result: map[string]any{"message_id": 1, "chat": map[string]any{"id": r.ChatID()}}}
+		})
+
+		start := time.Now()
+		_, err := h.TBot.LimitedAPI().SendMessage("Hello", 42, nil)
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, calls.Load())
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+
+	t.Run("should give up after too many attempts", func(t *testing.T) {
+		h := tbbtest.New(t)
+		h.Server.Respond("sendMessage", func(tbbtest.Request) tbbtest.Response {
+			return tbbtest.Response{ErrorCode: http.StatusTooManyRequests, Description: "Too Many Requests: retry after 3600"}
+		})
+
+		_, err := h.TBot.LimitedAPI().SendMessage("Hello", 42, nil)
+		assert.ErrorContains(t, err, "retry after 3600")
+		assert.Len(t, h.AssertRequest("sendMessage"), 1)
+	})
+
+	t.Run("should send requests to new chats concurrently", func(t *testing.T) {
+		h := tbbtest.New(t)
+		var wg sync.WaitGroup
+		for chatID := range int64(20) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := h.TBot.LimitedAPI().SendMessage("Hello", 100+chatID, nil)
+				assert.NoError(t, err)
+				_, err = h.TBot.LimitedAPI().GetChat(200 + chatID)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, h.AssertRequest("sendMessage"), 20)
+	})
+}
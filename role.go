@@ -0,0 +1,202 @@
+package tbb
+
+import (
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"slices"
+	"strings"
+)
+
+// Role of a user, which determines the commands the user is allowed to use.
+// Apps may define additional roles like "moderator" and grant them with SetUserRole.
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"  // Receives admin notifications and may use admin commands
+	RoleMember Role = "member" // Default role of all users
+	RoleBanned Role = "banned" // The bot ignores all updates of banned users
+)
+
+// allows returns true if a user with the given role may use the command.
+// Commands without Roles can be used by all users, which are not banned.
+func (c *Command) allows(r Role) bool {
+	if r == RoleBanned {
+		return false
+	}
+	return len(c.Roles) == 0 || slices.Contains(c.Roles, r)
+}
+
+// roleOf returns the effective role of a user. Config.Admin.ChatIDs are always admins.
+func (tb *TBot) roleOf(chatID int64, ui *UserInfo) Role {
+	if slices.Contains(tb.cfg.Admin.ChatIDs, chatID) {
+		return RoleAdmin
+	}
+	if ui == nil || ui.Role == "" {
+		return RoleMember
+	}
+	return ui.Role
+}
+
+// UserRole returns the effective role of the user with the given chatID.
+// Users, which are unknown, have the RoleMember.
+func (tb *TBot) UserRole(chatID int64) Role {
+	if b, ok := tb.sessions.Get(chatID); ok {
+		return b.Role()
+	}
+
+	u, err := tb.db.FindUserByChatID(chatID)
+	if err != nil {
+		return tb.roleOf(chatID, nil)
+	}
+	return tb.roleOf(chatID, u.UserInfo)
+}
+
+// IsAdmin returns true if the user with the given chatID has the RoleAdmin.
+func (tb *TBot) IsAdmin(chatID int64) bool {
+	return tb.UserRole(chatID) == RoleAdmin
+}
+
+// knownRole returns true if the role is one of the predefined roles or a role of any registered command.
+func (tb *TBot) knownRole(r Role) bool {
+	if r == RoleAdmin || r == RoleMember || r == RoleBanned {
+		return true
+	}
+	for _, c := range tb.cmdReg {
+		if slices.Contains(c.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetUserRole stores the role of the user with the given chatID and updates the Telegram command menu of the user.
+// Banned users are disabled as well. It returns ErrUnknownRole if the role is neither predefined nor used by any
+// registered command.
+func (tb *TBot) SetUserRole(chatID int64, role Role) error {
+	if !tb.knownRole(role) {
+		return fmt.Errorf("%w: %q", ErrUnknownRole, role)
+	}
+	var lang string
+	err := tb.updateUserInfo(chatID, func(u *User) {
+		u.UserInfo.Role = role
+		if role == RoleBanned {
+			u.UserInfo.IsActive = false
+		}
+		lang = u.language()
+	})
+	if err != nil {
+		return err
+	}
+	return tb.setCommandMenu(chatID, tb.roleOf(chatID, &UserInfo{Role: role}), lang)
+}
+
+// BanUser bans the user with the given chatID, so that the bot ignores all updates of the user, and disables the user.
+func (tb *TBot) BanUser(chatID int64) error {
+	return tb.SetUserRole(chatID, RoleBanned)
+}
+
+// UnbanUser lifts the ban of the user with the given chatID. The user has to enable the notifications again.
+func (tb *TBot) UnbanUser(chatID int64) error {
+	return tb.SetUserRole(chatID, RoleMember)
+}
+
+// Role returns the effective role of the current user.
+func (b *Bot) Role() Role {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tbot.roleOf(b.chatID, b.user.UserInfo)
+}
+
+// IsAdmin returns true if the current user has the RoleAdmin.
+func (b *Bot) IsAdmin() bool {
+	return b.Role() == RoleAdmin
+}
+
+// IsUserBanned returns true if the current user has the RoleBanned.
+func (b *Bot) IsUserBanned() bool {
+	return b.Role() == RoleBanned
+}
+
+// RoleMiddleware ignores all updates of banned users.
+func RoleMiddleware(next UpdateFunc) UpdateFunc {
+	return func(b *Bot, u *echotron.Update) {
+		if b.IsUserBanned() {
+			b.Log().Info("Ignoring update of banned user", "chatID", b.chatID)
+			return
+		}
+		next(b, u)
+	}
+}
+
+// commandsForRole returns the Telegram command list of all commands with a description the role may use.
+// The descriptions are translated into the given language with the key command.<name>, e.g. command.help for /help.
+// It returns whether any description has been translated into exactly the given language.
+func (tb *TBot) commandsForRole(role Role, lang string) ([]echotron.BotCommand, bool) {
+	var (
+		bc         []echotron.BotCommand
+		translated bool
+	)
+	for _, c := range tb.cmdReg {
+		if c.Name == "" || c.Description == "" || !c.allows(role) {
+			continue
+		}
+
+		desc := c.Description
+		if m, ok := tb.lookupMessage(lang, "command."+strings.TrimPrefix(c.Name, "/")); ok {
+			desc, translated = m.Text, true
+		}
+		bc = append(bc, echotron.BotCommand{Command: c.Name, Description: desc})
+	}
+	slices.SortFunc(bc, func(a, b echotron.BotCommand) int { return strings.Compare(a.Command, b.Command) })
+	return bc, translated
+}
+
+// setCommandMenu sets the Telegram command menu of the chat to the commands the role may use.
+// Members and banned users get the default command menu.
+func (tb *TBot) setCommandMenu(chatID int64, role Role, lang string) error {
+	opts := &echotron.CommandOptions{Scope: echotron.BotCommandScope{Type: echotron.BCSTChat, ChatID: chatID}}
+	if role == RoleMember || role == RoleBanned {
+		_, err := tb.api.DeleteMyCommands(opts)
+		return err
+	}
+
+	lang = normalizeLanguage(lang)
+	bc, translated := tb.commandsForRole(role, lang)
+	if base, _, _ := strings.Cut(lang, "-"); !translated && base != lang {
+		bc, _ = tb.commandsForRole(role, base)
+	}
+	if len(bc) == 0 {
+		_, err := tb.api.DeleteMyCommands(opts)
+		return err
+	}
+	_, err := tb.api.SetMyCommands(opts, bc...)
+	return err
+}
+
+// setRoleCommandMenus sets the command menus of all users with a role other than RoleMember or RoleBanned.
+func (tb *TBot) setRoleCommandMenus() error {
+	type menu struct {
+		role Role
+		lang string
+	}
+	menus := map[int64]menu{}
+	for _, chatID := range tb.cfg.Admin.ChatIDs {
+		menus[chatID] = menu{role: RoleAdmin}
+	}
+
+	var users []User
+	withRole := tb.db.Model(&UserInfo{}).Select("user_id").Where("role NOT IN ?", []Role{"", RoleMember, RoleBanned})
+	if err := tb.db.Preload("UserInfo").Where("id IN (?)", withRole).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		menus[u.ChatID] = menu{role: tb.roleOf(u.ChatID, u.UserInfo), lang: u.language()}
+	}
+
+	for chatID, m := range menus {
+		if err := tb.setCommandMenu(chatID, m.role, m.lang); err != nil {
+			return err
+		}
+	}
+	return nil
+}
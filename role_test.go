@@ -0,0 +1,102 @@
+package tbb_test
+
+import (
+	"context"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+const roleModerator tbb.Role = "moderator"
+
+func newRoleHarness(t *testing.T) *tbbtest.Harness {
+	cfg := &tbb.Config{}
+	cfg.Admin.ChatIDs = []int64{1}
+	return tbbtest.NewWithConfig(t, cfg, tbb.WithCommands([]tbb.Command{
+		{Name: "/help", Description: "Show the help message", HandlerFn: command.NewHelp},
+		{Name: "/stats", Description: "Show the stats", HandlerFn: command.NewStats, Roles: []tbb.Role{roleModerator, tbb.RoleAdmin}},
+		{Name: "/role", Description: "Change the role of a user", HandlerFn: command.NewSetRole, Roles: []tbb.Role{tbb.RoleAdmin}},
+	}))
+}
+
+func TestRoles(t *testing.T) {
+	t.Run("should gate commands by role", func(t *testing.T) {
+		h := newRoleHarness(t)
+		h.SendMessage(42, "/stats")
+		h.AssertNoMessage(42, `Users: \d+`)
+		assert.Equal(t, tbb.RoleMember, h.TBot.UserRole(42))
+		assert.True(t, h.TBot.IsAdmin(1))
+
+		require.NoError(t, h.TBot.SetUserRole(42, roleModerator))
+		assert.Equal(t, roleModerator, h.TBot.UserRole(42))
+		h.SendMessage(42, "/stats")
+		h.AssertMessage(42, `Users: \d+`)
+
+		h.SendMessage(42, "/role 43 admin")
+		h.AssertNoMessage(42, `role`)
+	})
+
+	t.Run("should change roles with the role command", func(t *testing.T) {
+		h := newRoleHarness(t)
+		h.SendMessage(42, "/help")
+
+		h.SendMessage(1, "/role 42")
+		h.AssertMessage(1, `^Usage: /role <chatID> <role>$`)
+
+		h.SendMessage(1, "/role 42 superuser")
+		h.AssertMessage(1, `unknown role: "superuser"`)
+		assert.Equal(t, tbb.RoleMember, h.TBot.UserRole(42))
+		assert.ErrorIs(t, h.TBot.SetUserRole(42, "superuser"), tbb.ErrUnknownRole)
+
+		h.SendMessage(1, "/role 42 Moderator")
+		h.AssertMessage(1, `^The role of user 42 is now moderator\.$`)
+		assert.Equal(t, roleModerator, h.TBot.UserRole(42))
+	})
+
+	t.Run("should set the command menu of the role", func(t *testing.T) {
+		h := newRoleHarness(t)
+		h.SendMessage(42, "/help")
+		h.Server.Reset()
+
+		require.NoError(t, h.TBot.SetUserRole(42, roleModerator))
+		reqs := h.AssertRequest("setMyCommands")
+		require.Len(t, reqs, 1)
+		assert.Contains(t, reqs[0].Params.Get("scope"), `"chat_id":42`)
+		assert.Contains(t, reqs[0].Params.Get("commands"), "/stats")
+		assert.NotContains(t, reqs[0].Params.Get("commands"), "/role")
+
+		require.NoError(t, h.TBot.SetUserRole(42, tbb.RoleMember))
+		h.AssertRequest("deleteMyCommands")
+	})
+
+	t.Run("should set the command menus of admins on startup", func(t *testing.T) {
+		h := newRoleHarness(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.NoError(t, h.TBot.Run(ctx))
+
+		var found bool
+		for _, r := range h.AssertRequest("setMyCommands") {
+			if strings.Contains(r.Params.Get("scope"), `"chat_id":1`) {
+				found = true
+				assert.Contains(t, r.Params.Get("commands"), "/role")
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("should ignore banned users", func(t *testing.T) {
+		h := newRoleHarness(t)
+		h.SendMessage(42, "/help")
+		require.NoError(t, h.TBot.BanUser(42))
+		assert.Equal(t, tbb.RoleBanned, h.TBot.UserRole(42))
+		h.Server.Reset()
+
+		h.SendMessage(42, "/help")
+		h.AssertNoMessage(42, `.*`)
+	})
+}
@@ -0,0 +1,326 @@
+package tbb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pollTimeout     = 120                              // Long polling timeout in seconds
+	pollRetryDelay  = time.Second * 3                  // Delay before polling again after a network error
+	pollMaxDelay    = time.Minute                      // Maximum delay before polling again after repeated errors
+	shutdownTimeout = time.Second * 30                 // Maximum duration to wait for servers and in-flight updates on shutdown
+	pollHTTPTimeout = time.Second * (pollTimeout + 30) // Timeout of a long polling request
+
+	serverReadHeaderTimeout = time.Second * 10 // Timeout for reading the request headers of the webhook server
+)
+
+// Run starts the Telegram bot and blocks until the given context is cancelled or receiving updates fails.
+// Updates are received via webhook if the WithWebhook option is set or by polling otherwise. Polling is retried after
+// network errors, 429 Too Many Requests and server errors and only fails with ErrGetUpdates, if the bot token is invalid
+// or another instance of the bot receives the updates.
+// Scheduled jobs registered with WithJobs are executed while the bot is running.
+// On shutdown, Run stops receiving updates, waits for in-flight updates to finish, stops all Bot sessions,
+// saves their users to the database and finally closes the database connection.
+func (tb *TBot) Run(ctx context.Context) error {
+	bc, _ := tb.commandsForRole(RoleMember, "")
+	if err := tb.SetBotCommands(bc); err != nil {
+		return fmt.Errorf("%w: %w", ErrSetBotCommands, err)
+	}
+	if err := tb.setLocalizedBotCommands(); err != nil {
+		return fmt.Errorf("%w: %w", ErrSetBotCommands, err)
+	}
+	if err := tb.setRoleCommandMenus(); err != nil {
+		return fmt.Errorf("%w: %w", ErrSetBotCommands, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tb.ctx = ctx
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 8)
+	)
+	run := func(fn func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(ctx); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+
+	if tb.whURL != "" {
+		tb.logger.Info(fmt.Sprintf("Start server with webhook: %q", tb.whURL))
+		run(tb.listenWebhook)
+	} else {
+		tb.logger.Info("Start polling")
+		run(tb.poll)
+		if tb.srv == nil && tb.cfg.Metrics.Listen != "" {
+			tb.srv = &http.Server{Addr: tb.cfg.Metrics.Listen, ReadHeaderTimeout: serverReadHeaderTimeout}
+		}
+		if tb.srv != nil {
+			tb.logger.Info("Start server")
+			tb.srv.Handler = tb.handler("")
+			run(func(ctx context.Context) error { return serve(ctx, tb.srv, "", "") })
+		}
+	}
+
+	run(tb.sessions.run)
+	run(tb.users.run)
+	if len(tb.jobs) > 0 {
+		tb.logger.Info("Start scheduler")
+		run(tb.schedule)
+	}
+	if tb.cfg.MessageStore.Enabled && tb.cfg.MessageStore.RetentionDays > 0 {
+		run(tb.pruneMessages)
+	}
+
+	tb.ready.Store(true)
+	<-ctx.Done()
+	tb.ready.Store(false)
+	wg.Wait()
+	close(errs)
+
+	var err error
+	for e := range errs {
+		err = errors.Join(err, e)
+	}
+	return errors.Join(err, tb.Shutdown())
+}
+
+// poll receives updates via long polling until the context is cancelled.
+func (tb *TBot) poll(ctx context.Context) error {
+	// Deletes the webhook if present to run in long polling mode
+	if _, err := tb.api.DeleteWebhook(true); err != nil {
+		return err
+	}
+
+	opts := echotron.UpdateOptions{Timeout: pollTimeout}
+	delay := pollRetryDelay
+	for {
+		res, err := tb.getUpdates(ctx, opts)
+		if ctx.Err() != nil {
+			tb.confirmUpdates(opts.Offset)
+			return nil
+		}
+
+		if err != nil {
+			wait := delay
+			var pollErr *getUpdatesError
+			if errors.As(err, &pollErr) {
+				if pollErr.fatal() {
+					return err
+				}
+				if pollErr.retryAfter > 0 {
+					wait = pollErr.retryAfter
+				}
+			}
+			tb.logger.Error("Polling failed", "error", err, "retryIn", wait)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+			// Back off while the errors persist
+			delay = min(delay*2, pollMaxDelay)
+			continue
+		}
+		delay = pollRetryDelay
+
+		for _, u := range res.Result {
+			tb.dispatch(u)
+		}
+		if l := len(res.Result); l > 0 {
+			opts.Offset = res.Result[l-1].ID + 1
+		}
+	}
+}
+
+// getUpdatesError is an error returned by Telegram for a getUpdates request.
+type getUpdatesError struct {
+	code        int
+	description string
+	retryAfter  time.Duration // Duration to wait as requested by Telegram or zero
+}
+
+func (e *getUpdatesError) Error() string {
+	return fmt.Sprintf("%s: %d %s", ErrGetUpdates, e.code, e.description)
+}
+
+func (e *getUpdatesError) Unwrap() error {
+	return ErrGetUpdates
+}
+
+// fatal returns true if polling cannot succeed without intervention, i.e. the bot token is invalid or another
+// instance receives the updates. All other errors like 429 Too Many Requests or server errors are temporary.
+func (e *getUpdatesError) fatal() bool {
+	switch e.code {
+	case http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict:
+		return true
+	default:
+		return false
+	}
+}
+
+// getUpdates requests updates via long polling like echotron.API.GetUpdates, but returns as soon as the context is
+// cancelled. Errors returned by Telegram are returned as getUpdatesError, which wraps ErrGetUpdates.
+func (tb *TBot) getUpdates(ctx context.Context, opts echotron.UpdateOptions) (echotron.APIResponseUpdate, error) {
+	var res struct {
+		echotron.APIResponseUpdate
+		Parameters *echotron.ResponseParameters `json:"parameters,omitempty"`
+	}
+
+	q := url.Values{}
+	q.Set("offset", strconv.Itoa(opts.Offset))
+	q.Set("timeout", strconv.Itoa(opts.Timeout))
+	u := fmt.Sprintf("%s/bot%s/getUpdates?%s", strings.TrimSuffix(tb.cfg.Telegram.APIURL, "/"), tb.cfg.Telegram.BotToken, q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return res.APIResponseUpdate, err
+	}
+	resp, err := tb.pollc.Do(req)
+	if err != nil {
+		// Network errors contain the request url with the bot token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return res.APIResponseUpdate, err
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res.APIResponseUpdate, err
+	}
+	if !res.Ok {
+		pollErr := &getUpdatesError{code: res.ErrorCode, description: res.Description}
+		if res.Parameters != nil {
+			pollErr.retryAfter = time.Duration(res.Parameters.RetryAfter) * time.Second
+		}
+		return res.APIResponseUpdate, pollErr
+	}
+	return res.APIResponseUpdate, nil
+}
+
+// confirmUpdates marks all updates before offset as received on Telegram,
+// so that they are not delivered again after a restart.
+func (tb *TBot) confirmUpdates(offset int) {
+	if offset == 0 {
+		return
+	}
+	if _, err := tb.api.GetUpdates(&echotron.UpdateOptions{Offset: offset, Limit: 1}); err != nil {
+		tb.logger.Warn("Cannot confirm received updates", "error", err)
+	}
+}
+
+// HandleUpdate processes the given update synchronously in the Bot session of its chat.
+// It can be used to feed updates from custom sources into the bot, e.g. in tests.
+// Updates, which belong to no chat like callback queries of inline messages, are skipped.
+func (tb *TBot) HandleUpdate(u *echotron.Update) {
+	chatID := tb.updateChatID(u)
+	if chatID == 0 {
+		return
+	}
+	tb.wg.Add(1)
+	defer tb.wg.Done()
+	tb.session(chatID).Update(u)
+}
+
+// dispatch passes the update to the Bot session of its chat, which is created if necessary.
+func (tb *TBot) dispatch(u *echotron.Update) {
+	chatID := tb.updateChatID(u)
+	if chatID == 0 {
+		return
+	}
+	b := tb.session(chatID)
+	tb.wg.Add(1)
+	go func() {
+		defer tb.wg.Done()
+		b.Update(u)
+	}()
+}
+
+// updateChatID returns the chatID of the Bot session, which processes the update, or 0 if the update belongs to no
+// chat. Unlike echotron.Update.ChatID, it does not panic for callback queries of inline messages.
+func (tb *TBot) updateChatID(u *echotron.Update) int64 {
+	var chatID int64
+	if u.CallbackQuery == nil || u.CallbackQuery.Message != nil {
+		chatID = u.ChatID()
+	}
+	if chatID == 0 {
+		tb.logger.Debug("Skipping update without chat", "updateID", u.ID, "type", parseUpdate(u).Type)
+	}
+	return chatID
+}
+
+// session returns the Bot session for the given chatID and creates a new one if none exists.
+func (tb *TBot) session(chatID int64) *Bot {
+	return tb.sessions.session(chatID)
+}
+
+// Shutdown waits for in-flight updates, stops all Bot sessions, saves their users and closes the database.
+// It is called by Run automatically and only needs to be called if updates are fed in via HandleUpdate.
+func (tb *TBot) Shutdown() error {
+	tb.logger.Info("Shutting down")
+	tb.ready.Store(false)
+
+	done := make(chan struct{})
+	go func() {
+		tb.wg.Wait()
+		close(done)
+	}()
+	timedOut := false
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		tb.logger.Warn("Timeout while waiting for in-flight updates")
+		timedOut = true
+	}
+
+	err := errors.Join(tb.sessions.endAll(EvictReasonShutdown, timedOut), tb.users.Flush())
+
+	sqlDB, dbErr := tb.db.DB.DB()
+	if dbErr != nil {
+		return errors.Join(err, dbErr)
+	}
+	return errors.Join(err, sqlDB.Close())
+}
+
+// serve runs the given http.Server until the context is cancelled and shuts it down gracefully afterward.
+// The server serves TLS if certFile and keyFile are given.
+func serve(ctx context.Context, srv *http.Server, certFile, keyFile string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if certFile != "" && keyFile != "" {
+			errCh <- srv.ListenAndServeTLS(certFile, keyFile)
+			return
+		}
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(sctx)
+}
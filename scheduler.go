@@ -0,0 +1,195 @@
+package tbb
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"slices"
+	"time"
+)
+
+const (
+	schedulerInterval     = time.Second * 30 // Interval for checking due jobs
+	schedulerSyncInterval = time.Minute * 5  // Interval for creating the runs of new users and users with a new location
+	schedulerGrace        = time.Hour        // Runs which are overdue by more than this, e.g. after a downtime, are skipped
+)
+
+// JobFunc is called for each active user when a scheduled Job is due in the time zone of the user.
+type JobFunc func(ctx context.Context, tb *TBot, u *User) error
+
+// Job is a recurring per-user notification, which is due at the given local time of each user.
+// The time zone is taken from UserInfo.Location, so that daylight saving time transitions are respected.
+// Users without a location are notified at the given time in UTC.
+type Job struct {
+	Name     string         // Unique name of the job, which is used to persist its runs in the database
+	Hour     int            // Hour of the day in local time of the user
+	Minute   int            // Minute of the hour
+	Weekdays []time.Weekday // Weekdays on which the job is due, or every day if empty
+	Handler  JobFunc
+}
+
+// ScheduledRun stores the next run of a Job for a single user, so that schedules survive restarts.
+type ScheduledRun struct {
+	Job       string    `gorm:"primaryKey"`                     // Name of the Job
+	ChatID    int64     `gorm:"primaryKey;autoIncrement:false"` // Telegram chatID of the user
+	Location  string    // Time zone location the next run has been calculated for
+	NextRunAt time.Time `gorm:"index"` // Next run in UTC
+	LastRunAt *time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Daily returns a Job, which is due every day at the given local time.
+func Daily(name string, hour, minute int, fn JobFunc) Job {
+	return Job{Name: name, Hour: hour, Minute: minute, Handler: fn}
+}
+
+// Weekly returns a Job, which is due every week on the given weekday at the given local time.
+func Weekly(name string, weekday time.Weekday, hour, minute int, fn JobFunc) Job {
+	return Job{Name: name, Hour: hour, Minute: minute, Weekdays: []time.Weekday{weekday}, Handler: fn}
+}
+
+// WithJobs option registers jobs, which are executed by Run for all active users at their local time.
+func WithJobs(jobs ...Job) Option {
+	return func(app *TBot) {
+		app.jobs = append(app.jobs, jobs...)
+	}
+}
+
+// next returns the first time after the given time, at which the job is due in the given location.
+func (j Job) next(after time.Time, loc *time.Location) time.Time {
+	t := after.In(loc)
+	for d := 0; d <= 7; d++ {
+		day := t.AddDate(0, 0, d)
+		// time.Date normalizes local times, which do not exist due to daylight saving time transitions
+		c := time.Date(day.Year(), day.Month(), day.Day(), j.Hour, j.Minute, 0, 0, loc)
+		if c.After(after) && (len(j.Weekdays) == 0 || slices.Contains(j.Weekdays, c.Weekday())) {
+			return c.UTC()
+		}
+	}
+	return after.AddDate(0, 0, 7).UTC()
+}
+
+// schedule runs all due jobs periodically until the context is cancelled.
+func (tb *TBot) schedule(ctx context.Context) error {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := tb.runDueJobs(ctx, time.Now()); err != nil {
+			tb.logger.Error("Cannot run scheduled jobs", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDueJobs executes all jobs, which are due at the given time.
+func (tb *TBot) runDueJobs(ctx context.Context, now time.Time) error {
+	now = now.UTC()
+	sync := now.Sub(tb.jobsSyncedAt) >= schedulerSyncInterval
+	for _, j := range tb.jobs {
+		if sync {
+			if err := tb.syncScheduledRuns(j, now); err != nil {
+				return err
+			}
+		}
+
+		var due []ScheduledRun
+		if err := tb.db.Where("job = ? AND next_run_at <= ?", j.Name, now).Order("next_run_at").Find(&due).Error; err != nil {
+			return err
+		}
+
+		for _, r := range due {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := tb.runJob(ctx, j, r, now); err != nil {
+				return err
+			}
+		}
+	}
+	if sync {
+		tb.jobsSyncedAt = now
+	}
+	return nil
+}
+
+// runJob executes the job for the user of the given ScheduledRun and calculates its next run.
+func (tb *TBot) runJob(ctx context.Context, j Job, r ScheduledRun, now time.Time) error {
+	u, err := tb.db.FindUserByChatID(r.ChatID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tb.db.Delete(&r).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !u.UserInfo.IsActive:
+		tb.logger.Debug("Skipping scheduled job for inactive user", "job", j.Name, "chatID", r.ChatID)
+	case now.Sub(r.NextRunAt) > schedulerGrace:
+		tb.logger.Warn("Skipping overdue scheduled job", "job", j.Name, "chatID", r.ChatID, "due", r.NextRunAt)
+	default:
+		if err = j.Handler(ctx, tb, u); err != nil {
+			tb.logger.Error("Scheduled job failed", "job", j.Name, "chatID", r.ChatID, "error", err)
+		}
+		r.LastRunAt = &now
+	}
+
+	r.Location = u.UserInfo.Location
+	r.NextRunAt = j.next(now, loadLocation(r.Location))
+	return tb.db.Save(&r).Error
+}
+
+// syncScheduledRuns creates the ScheduledRun of the job for all active users, which do not have one yet,
+// and recalculates the next run of users, whose location has changed. Only these users are queried.
+func (tb *TBot) syncScheduledRuns(j Job, now time.Time) error {
+	type outdated struct {
+		ChatID   int64
+		Location string
+		HasRun   bool
+	}
+
+	for {
+		var rows []outdated
+		err := tb.db.Table("users").
+			Select("users.chat_id, user_infos.location, scheduled_runs.chat_id IS NOT NULL AS has_run").
+			Joins("JOIN user_infos ON user_infos.user_id = users.id").
+			Joins("LEFT JOIN scheduled_runs ON scheduled_runs.chat_id = users.chat_id AND scheduled_runs.job = ?", j.Name).
+			Where("user_infos.is_active = ? AND (scheduled_runs.chat_id IS NULL OR scheduled_runs.location <> user_infos.location)", true).
+			Limit(broadcastBatchSize).
+			Find(&rows).Error
+		if err != nil {
+			return err
+		}
+
+		for _, o := range rows {
+			r := ScheduledRun{Job: j.Name, ChatID: o.ChatID, Location: o.Location, NextRunAt: j.next(now, loadLocation(o.Location))}
+			if o.HasRun {
+				err = tb.db.Model(&r).Select("location", "next_run_at").Updates(&r).Error
+			} else {
+				err = tb.db.Create(&r).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// Synced users no longer match the query, so that the next batch starts with the remaining ones
+		if len(rows) < broadcastBatchSize {
+			return nil
+		}
+	}
+}
+
+// loadLocation returns the time zone location with the given name or UTC if the name is empty or unknown.
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
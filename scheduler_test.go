@@ -0,0 +1,94 @@
+package tbb
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJob_next(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	t.Run("should respect daylight saving time transitions", func(t *testing.T) {
+		j := Daily("morning", 8, 0, nil)
+		// The clocks in Berlin are set forward on 2024-03-31 at 02:00
+		after := time.Date(2024, 3, 30, 9, 0, 0, 0, berlin)
+		assert.Equal(t, time.Date(2024, 3, 31, 6, 0, 0, 0, time.UTC), j.next(after, berlin))
+
+		after = time.Date(2024, 3, 29, 7, 59, 0, 0, berlin)
+		assert.Equal(t, time.Date(2024, 3, 29, 7, 0, 0, 0, time.UTC), j.next(after, berlin))
+	})
+
+	t.Run("should only be due on the given weekdays", func(t *testing.T) {
+		j := Weekly("weekly", time.Monday, 18, 30, nil)
+		after := time.Date(2024, 10, 16, 12, 0, 0, 0, time.UTC) // Wednesday
+		assert.Equal(t, time.Date(2024, 10, 21, 18, 30, 0, 0, time.UTC), j.next(after, time.UTC))
+	})
+}
+
+func TestTBot_runDueJobs(t *testing.T) {
+	cfg := LoadConfig("test/data/test.config.yml")
+	cfg.Database.Filename = filepath.Join(t.TempDir(), "scheduler.db")
+
+	var notified []int64
+	job := Daily("morning", 8, 0, func(ctx context.Context, tb *TBot, u *User) error {
+		notified = append(notified, u.ChatID)
+		return nil
+	})
+	tbot := New(WithConfig(cfg), WithJobs(job))
+
+	users := []*User{
+		{ChatID: 1, UserInfo: &UserInfo{IsActive: true, TimeZoneInfo: TimeZoneInfo{Location: "Europe/Berlin"}}},
+		{ChatID: 2, UserInfo: &UserInfo{IsActive: true, TimeZoneInfo: TimeZoneInfo{Location: "America/New_York"}}},
+		{ChatID: 3, UserInfo: &UserInfo{IsActive: false, TimeZoneInfo: TimeZoneInfo{Location: "Europe/Berlin"}}},
+	}
+	for _, u := range users {
+		u.UserPhoto = &UserPhoto{}
+		require.NoError(t, tbot.DB().Create(u).Error)
+	}
+
+	ctx := context.Background()
+	now := time.Date(2024, 10, 16, 5, 0, 0, 0, time.UTC)
+	require.NoError(t, tbot.runDueJobs(ctx, now))
+	assert.Empty(t, notified)
+
+	// 08:00 in Berlin
+	require.NoError(t, tbot.runDueJobs(ctx, now.Add(time.Hour*1)))
+	assert.Equal(t, []int64{1}, notified)
+
+	// 08:00 in New York
+	require.NoError(t, tbot.runDueJobs(ctx, now.Add(time.Hour*7)))
+	assert.Equal(t, []int64{1, 2}, notified)
+
+	// Runs survive a restart and are not repeated on the same day
+	tbot = New(WithConfig(cfg), WithJobs(job))
+	require.NoError(t, tbot.runDueJobs(ctx, now.Add(time.Hour*8)))
+	assert.Equal(t, []int64{1, 2}, notified)
+
+	// Overdue runs are skipped, e.g. after a downtime of a whole day
+	require.NoError(t, tbot.runDueJobs(ctx, now.Add(time.Hour*30)))
+	assert.Equal(t, []int64{1, 2}, notified)
+
+	var r ScheduledRun
+	require.NoError(t, tbot.DB().First(&r, "job = ? AND chat_id = ?", "morning", 1).Error)
+	assert.Equal(t, time.Date(2024, 10, 18, 6, 0, 0, 0, time.UTC), r.NextRunAt.UTC())
+
+	// Runs are only synced periodically and recalculated if the location of the user has changed
+	require.NoError(t, tbot.DB().Model(&UserInfo{}).Where("user_id = ?", users[0].ID).Update("location", "Asia/Tokyo").Error)
+	require.NoError(t, tbot.runDueJobs(ctx, now.Add(time.Hour*30+schedulerSyncInterval/2)))
+	require.NoError(t, tbot.DB().First(&r, "job = ? AND chat_id = ?", "morning", 1).Error)
+	assert.Equal(t, "Europe/Berlin", r.Location)
+
+	require.NoError(t, tbot.runDueJobs(ctx, now.Add(time.Hour*30+schedulerSyncInterval)))
+	require.NoError(t, tbot.DB().First(&r, "job = ? AND chat_id = ?", "morning", 1).Error)
+	assert.Equal(t, "Asia/Tokyo", r.Location)
+	assert.Equal(t, time.Date(2024, 10, 17, 23, 0, 0, 0, time.UTC), r.NextRunAt.UTC())
+
+	var count int64
+	require.NoError(t, tbot.DB().Model(&ScheduledRun{}).Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+}
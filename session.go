@@ -0,0 +1,316 @@
+package tbb
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const sessionJanitorInterval = time.Minute // Maximum interval, in which idle Bot sessions are ended
+
+// EvictReason describes why a Bot session has been ended.
+type EvictReason string
+
+const (
+	EvictReasonTimeout  EvictReason = "timeout"  // The session has been idle for Config.BotSessionTimeout
+	EvictReasonCapacity EvictReason = "capacity" // The session was the least recently used one when Config.MaxSessions was exceeded
+	EvictReasonEnded    EvictReason = "ended"    // The session has been ended by SessionManager.End
+	EvictReasonShutdown EvictReason = "shutdown" // The bot has been shut down
+)
+
+// SessionInfo describes an active Bot session.
+type SessionInfo struct {
+	ChatID     int64
+	CreatedAt  time.Time
+	LastActive time.Time // Time the session has received or finished its last update
+}
+
+type session struct {
+	SessionInfo
+	bot *Bot
+}
+
+// SessionManager holds the Bot sessions of a TBot. Sessions are created for the first update of a chat and ended
+// after Config.BotSessionTimeout without updates. If Config.MaxSessions is set, the least recently used sessions are
+// ended as soon as the limit is exceeded. The user of an ended session is saved to the database.
+type SessionManager struct {
+	tb       *TBot
+	mu       sync.Mutex
+	sessions map[int64]*list.Element // Elements of lru by chatID, guarded by mu
+	lru      *list.List              // Sessions ordered from the most to the least recently used one, guarded by mu
+	onCreate []func(b *Bot)
+	onEvict  []func(b *Bot, reason EvictReason)
+}
+
+func newSessionManager(tb *TBot) *SessionManager {
+	return &SessionManager{
+		tb:       tb,
+		sessions: map[int64]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// WithSessionCreateHook registers a function, which is called with every new Bot session before it processes
+// its first update and before it is returned by SessionManager.Get. If the first updates of a chat arrive concurrently,
+// the hooks may be called with a session, which is discarded afterward.
+func WithSessionCreateHook(fn func(b *Bot)) Option {
+	return func(tb *TBot) {
+		tb.sessions.onCreate = append(tb.sessions.onCreate, fn)
+	}
+}
+
+// WithSessionEvictHook registers a function, which is called with every ended Bot session and the reason.
+// It is called before the user of the session is saved, so that changes of the user are persisted.
+// Sessions are never ended while processing an update.
+func WithSessionEvictHook(fn func(b *Bot, reason EvictReason)) Option {
+	return func(tb *TBot) {
+		tb.sessions.onEvict = append(tb.sessions.onEvict, fn)
+	}
+}
+
+// Sessions returns the SessionManager holding the active Bot sessions.
+func (tb *TBot) Sessions() *SessionManager {
+	return tb.sessions
+}
+
+// Len returns the number of active Bot sessions.
+func (sm *SessionManager) Len() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.lru.Len()
+}
+
+// List returns the active Bot sessions ordered from the most to the least recently used one.
+func (sm *SessionManager) List() []SessionInfo {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	res := make([]SessionInfo, 0, sm.lru.Len())
+	for e := sm.lru.Front(); e != nil; e = e.Next() {
+		res = append(res, e.Value.(*session).SessionInfo)
+	}
+	return res
+}
+
+// Get returns the Bot session of the given chat, if there is one.
+func (sm *SessionManager) Get(chatID int64) (*Bot, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	e, ok := sm.sessions[chatID]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*session).bot, true
+}
+
+// End ends the Bot session of the given chat and saves its user. The next update of the chat creates a new session,
+// which resumes a persisted conversation. It returns ErrSessionNotFound if the chat has no session.
+// A session, which is processing an update, e.g. the one calling End, is ended in the background afterward.
+func (sm *SessionManager) End(chatID int64) error {
+	sm.mu.Lock()
+	e, ok := sm.sessions[chatID]
+	if ok {
+		sm.remove(e)
+	}
+	sm.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrSessionNotFound, chatID)
+	}
+	s := e.Value.(*session)
+	if s.bot.umu.TryLock() {
+		return sm.end(EvictReasonEnded, s)
+	}
+
+	sm.tb.wg.Add(1)
+	go func() {
+		defer sm.tb.wg.Done()
+		s.bot.umu.Lock()
+		if err := sm.end(EvictReasonEnded, s); err != nil {
+			sm.tb.logger.Error("Cannot end bot session", "chatID", chatID, "error", err)
+		}
+	}()
+	return nil
+}
+
+// session returns the Bot session of the given chat, which is created if necessary, and marks it as recently used.
+func (sm *SessionManager) session(chatID int64) *Bot {
+	if b, ok := sm.touch(chatID, nil); ok {
+		return b
+	}
+
+	// The session is created outside the lock, since loading the user queries the database, and only published after
+	// the create hooks have been called
+	b := sm.tb.newBot(chatID, sm.tb.logger, sm.tb.hFn)
+	for _, fn := range sm.onCreate {
+		fn(b)
+	}
+
+	now := time.Now()
+	sm.mu.Lock()
+	if e, ok := sm.sessions[chatID]; ok {
+		// Another update of the chat has created the session meanwhile
+		s := e.Value.(*session)
+		s.LastActive = now
+		sm.lru.MoveToFront(e)
+		sm.mu.Unlock()
+		sm.tb.users.forget(b.user)
+		return s.bot
+	}
+	sm.sessions[chatID] = sm.lru.PushFront(&session{SessionInfo: SessionInfo{ChatID: chatID, CreatedAt: now, LastActive: now}, bot: b})
+
+	// Sessions, which are processing an update, are skipped and ended later on
+	var evicted []*session
+	limit := sm.tb.cfg.MaxSessions
+	for e := sm.lru.Back(); e != nil && limit > 0 && sm.lru.Len() > limit; {
+		prev := e.Prev()
+		if s := e.Value.(*session); s.bot != b && s.bot.umu.TryLock() {
+			sm.remove(e)
+			evicted = append(evicted, s)
+		}
+		e = prev
+	}
+	sm.mu.Unlock()
+
+	if len(evicted) > 0 {
+		// Do not delay the update of the new session by saving the users of the evicted ones
+		sm.tb.wg.Add(1)
+		go func() {
+			defer sm.tb.wg.Done()
+			if err := sm.end(EvictReasonCapacity, evicted...); err != nil {
+				sm.tb.logger.Error("Cannot end evicted bot sessions", "error", err)
+			}
+		}()
+	}
+	return b
+}
+
+// touch marks the session of the given chat as recently used and returns its Bot. If b is not nil, the session is only
+// marked if it still belongs to b, e.g. after b has processed an update.
+func (sm *SessionManager) touch(chatID int64, b *Bot) (*Bot, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	e, ok := sm.sessions[chatID]
+	if !ok {
+		return nil, false
+	}
+	s := e.Value.(*session)
+	if b != nil && s.bot != b {
+		return nil, false
+	}
+	s.LastActive = time.Now()
+	sm.lru.MoveToFront(e)
+	return s.bot, true
+}
+
+// remove removes the given element of a session. The caller must hold mu.
+func (sm *SessionManager) remove(e *list.Element) {
+	sm.lru.Remove(e)
+	delete(sm.sessions, e.Value.(*session).ChatID)
+}
+
+// run ends idle Bot sessions until the context is cancelled.
+func (sm *SessionManager) run(ctx context.Context) error {
+	t := time.NewTicker(min(sessionJanitorInterval, sm.timeout()/2))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-t.C:
+			if err := sm.endIdle(now); err != nil {
+				sm.tb.logger.Error("Cannot end idle bot sessions", "error", err)
+			}
+		}
+	}
+}
+
+// endIdle ends all Bot sessions, which have been idle for Config.BotSessionTimeout at the given time.
+func (sm *SessionManager) endIdle(now time.Time) error {
+	timeout := sm.timeout()
+
+	sm.mu.Lock()
+	var idle []*session
+	for e := sm.lru.Back(); e != nil; {
+		s := e.Value.(*session)
+		if now.Sub(s.LastActive) < timeout {
+			// All remaining sessions have been used more recently
+			break
+		}
+		prev := e.Prev()
+		// Sessions, which are still processing an update, are not idle
+		if s.bot.umu.TryLock() {
+			sm.remove(e)
+			idle = append(idle, s)
+		}
+		e = prev
+	}
+	sm.mu.Unlock()
+
+	return sm.end(EvictReasonTimeout, idle...)
+}
+
+// endAll ends all Bot sessions after they have processed their current update. If skipBusy is true, sessions,
+// which are still processing an update, are dropped without saving their users, because the users may still be modified.
+func (sm *SessionManager) endAll(reason EvictReason, skipBusy bool) error {
+	sm.mu.Lock()
+	all := make([]*session, 0, sm.lru.Len())
+	for e := sm.lru.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*session))
+	}
+	sm.sessions = map[int64]*list.Element{}
+	sm.lru.Init()
+	sm.mu.Unlock()
+
+	// The sessions are locked outside mu, since Bot.Update takes mu while holding umu
+	locked := all[:0]
+	for _, s := range all {
+		if !skipBusy {
+			s.bot.umu.Lock()
+		} else if !s.bot.umu.TryLock() {
+			sm.tb.logger.Warn(fmt.Sprintf("Dropping busy bot session with ChatID=%d without saving its user", s.ChatID))
+			continue
+		}
+		locked = append(locked, s)
+	}
+	return sm.end(reason, locked...)
+}
+
+// end calls the evict hooks of the given removed sessions, saves their users and unlocks their umu, which must be
+// locked by the caller, so that sessions are never ended while processing an update.
+func (sm *SessionManager) end(reason EvictReason, ss ...*session) error {
+	var err error
+	for _, s := range ss {
+		b := s.bot
+		for _, fn := range sm.onEvict {
+			fn(b, reason)
+		}
+
+		// Only users which have already been stored are saved, so that group chats do not end up as users
+		b.mu.Lock()
+		if b.user.ID != 0 {
+			err = errors.Join(err, b.saveUser())
+		}
+		sm.tb.users.forget(b.user)
+		b.mu.Unlock()
+		b.ended = true
+		b.umu.Unlock()
+		b.Log().Info(fmt.Sprintf("Ended bot session with ChatID=%d", b.chatID), "reason", reason)
+	}
+	return err
+}
+
+// timeout returns the duration, after which idle sessions are ended.
+func (sm *SessionManager) timeout() time.Duration {
+	timeout := sm.tb.cfg.BotSessionTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionTimout
+	}
+	return time.Duration(timeout) * time.Minute
+}
@@ -0,0 +1,195 @@
+package tbb
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionManager(t *testing.T) {
+	type eviction struct {
+		chatID int64
+		reason EvictReason
+	}
+
+	newTBot := func(t *testing.T, maxSessions int) (*TBot, *[]int64, func() []eviction) {
+		cfg := LoadConfig("test/data/test.config.yml")
+		cfg.Database.Filename = filepath.Join(t.TempDir(), "session.db")
+		cfg.LogLevel = "error"
+		cfg.MaxSessions = maxSessions
+
+		var (
+			mu      sync.Mutex
+			created []int64
+			evicted []eviction
+		)
+		tbot := New(WithConfig(cfg),
+			WithSessionCreateHook(func(b *Bot) {
+				mu.Lock()
+				defer mu.Unlock()
+				created = append(created, b.ChatID())
+			}),
+			WithSessionEvictHook(func(b *Bot, reason EvictReason) {
+				mu.Lock()
+				defer mu.Unlock()
+				b.User().Firstname = "evicted"
+				evicted = append(evicted, eviction{b.ChatID(), reason})
+			}),
+		)
+		t.Cleanup(func() { _ = tbot.Shutdown() })
+		return tbot, &created, func() []eviction {
+			tbot.wg.Wait()
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]eviction(nil), evicted...)
+		}
+	}
+
+	chatIDs := func(infos []SessionInfo) []int64 {
+		res := make([]int64, len(infos))
+		for i, info := range infos {
+			res[i] = info.ChatID
+		}
+		return res
+	}
+
+	t.Run("should end the least recently used sessions if the limit is exceeded", func(t *testing.T) {
+		tbot, created, evicted := newTBot(t, 2)
+		sm := tbot.Sessions()
+
+		b1 := sm.session(1)
+		sm.session(2)
+		assert.Same(t, b1, sm.session(1))
+		sm.session(3)
+
+		assert.Equal(t, []int64{1, 2, 3}, *created)
+		assert.Equal(t, []eviction{{2, EvictReasonCapacity}}, evicted())
+		assert.Equal(t, []int64{3, 1}, chatIDs(sm.List()))
+		_, ok := sm.Get(2)
+		assert.False(t, ok)
+	})
+
+	t.Run("should end idle sessions and save their users", func(t *testing.T) {
+		tbot, _, evicted := newTBot(t, 0)
+		sm := tbot.Sessions()
+		require.NoError(t, tbot.DB().Create(&User{ChatID: 1, UserInfo: &UserInfo{}, UserPhoto: &UserPhoto{}}).Error)
+
+		sm.session(1)
+		sm.session(2)
+		sm.mu.Lock()
+		sm.sessions[1].Value.(*session).LastActive = time.Now().Add(-sm.timeout())
+		sm.mu.Unlock()
+
+		require.NoError(t, sm.endIdle(time.Now()))
+		assert.Equal(t, []eviction{{1, EvictReasonTimeout}}, evicted())
+		assert.Equal(t, []int64{2}, chatIDs(sm.List()))
+
+		u, err := tbot.DB().FindUserByChatID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "evicted", u.Firstname)
+	})
+
+	t.Run("should end sessions on demand and on shutdown", func(t *testing.T) {
+		tbot, created, evicted := newTBot(t, 0)
+		sm := tbot.Sessions()
+		sm.session(1)
+		sm.session(2)
+
+		require.NoError(t, sm.End(1))
+		assert.ErrorIs(t, sm.End(1), ErrSessionNotFound)
+		assert.Equal(t, 1, sm.Len())
+
+		// A new session is created for the next update
+		sm.session(1)
+		assert.Equal(t, []int64{1, 2, 1}, *created)
+
+		require.NoError(t, tbot.Shutdown())
+		assert.Zero(t, sm.Len())
+		assert.ElementsMatch(t, []eviction{{1, EvictReasonEnded}, {1, EvictReasonShutdown}, {2, EvictReasonShutdown}}, evicted())
+	})
+	t.Run("should not end sessions while they process an update", func(t *testing.T) {
+		tbot, _, evicted := newTBot(t, 1)
+		sm := tbot.Sessions()
+
+		b1 := sm.session(1)
+		b1.umu.Lock()
+		sm.session(2)
+		assert.Empty(t, evicted(), "busy sessions are not evicted")
+		assert.Equal(t, []int64{2, 1}, chatIDs(sm.List()))
+
+		sm.mu.Lock()
+		for _, e := range sm.sessions {
+			e.Value.(*session).LastActive = time.Now().Add(-sm.timeout())
+		}
+		sm.mu.Unlock()
+		require.NoError(t, sm.endIdle(time.Now()))
+		assert.Equal(t, []eviction{{2, EvictReasonTimeout}}, evicted())
+
+		// The session is ended after its update
+		require.NoError(t, sm.End(1))
+		assert.Zero(t, sm.Len())
+		b1.umu.Unlock()
+		assert.Equal(t, []eviction{{2, EvictReasonTimeout}, {1, EvictReasonEnded}}, evicted())
+	})
+
+	t.Run("should pass updates of ended sessions to a new session", func(t *testing.T) {
+		tbot, _, evicted := newTBot(t, 0)
+		sm := tbot.Sessions()
+
+		b1 := sm.session(1)
+		require.NoError(t, sm.End(1))
+		assert.Equal(t, []eviction{{1, EvictReasonEnded}}, evicted())
+
+		b1.Update(&echotron.Update{ID: 1})
+		b2, ok := sm.Get(1)
+		require.True(t, ok)
+		assert.NotSame(t, b1, b2)
+	})
+
+	t.Run("should mark sessions as active after their updates", func(t *testing.T) {
+		tbot, _, _ := newTBot(t, 0)
+		sm := tbot.Sessions()
+		b := sm.session(1)
+		sm.mu.Lock()
+		sm.sessions[1].Value.(*session).LastActive = time.Now().Add(-sm.timeout())
+		sm.mu.Unlock()
+
+		b.Update(&echotron.Update{ID: 1})
+		assert.WithinDuration(t, time.Now(), sm.List()[0].LastActive, time.Second)
+	})
+
+	t.Run("should call the create hooks before the session is published", func(t *testing.T) {
+		tbot, _, _ := newTBot(t, 0)
+		sm := tbot.Sessions()
+		var published bool
+		sm.onCreate = append(sm.onCreate, func(b *Bot) {
+			_, published = sm.Get(b.ChatID())
+		})
+		sm.session(1)
+		assert.False(t, published)
+	})
+
+	t.Run("should create a single session for concurrent updates", func(t *testing.T) {
+		tbot, _, _ := newTBot(t, 0)
+		sm := tbot.Sessions()
+
+		var wg sync.WaitGroup
+		bots := make([]*Bot, 5)
+		for i := range bots {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				bots[i] = sm.session(1)
+			}()
+		}
+		wg.Wait()
+		for _, b := range bots {
+			assert.Same(t, bots[0], b)
+		}
+		assert.Equal(t, 1, sm.Len())
+	})
+}
@@ -5,56 +5,111 @@
 package tbb
 
 import (
+	"bytes"
 	"context"
-	"crypto/md5"
-	"errors"
+	"crypto/sha256"
 	"fmt"
 	"github.com/NicoNex/echotron/v3"
 	timezone "github.com/evanoberholster/timezoneLookup/v2"
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type TBot struct {
-	db     *DB
-	dsp    *echotron.Dispatcher
-	ctx    context.Context
-	cfg    *Config
-	logger *slog.Logger
-	cmdReg CommandRegistry
-	hFn    UpdateHandlerFn
-	api    echotron.API // Telegram api
-	tzc    *timezone.Timezonecache
-	srv    *http.Server
+	db           *DB
+	dsp          *echotron.Dispatcher
+	ctx          context.Context
+	cfg          *Config
+	logger       *slog.Logger
+	cmdReg       CommandRegistry
+	hFn          UpdateHandlerFn
+	mws          []Middleware
+	noDMws       bool       // Whether the DefaultMiddlewares are omitted
+	updFn        UpdateFunc // Update processing chain of all middlewares
+	api          API        // Rate limited Telegram api
+	tzc          *timezone.Timezonecache
+	srv          *http.Server
+	whURL        string               // Webhook url, if the bot receives updates via webhook instead of polling
+	sessions     *SessionManager      // Active Bot sessions
+	users        *UserRepository      // Loads and saves the users of Bot sessions
+	wg           sync.WaitGroup       // In-flight updates and background user updates
+	me           *echotron.User       // The bot user itself as returned by getMe
+	meMu         sync.Mutex           // Guards me
+	cbRoutes     []callbackRoute      // Callback query routes ordered by precedence
+	cbSecret     []byte               // Secret for signing callback data
+	bcRate       float64              // Maximum broadcast messages per second
+	jobs         []Job                // Scheduled per-user jobs
+	jobsSyncedAt time.Time            // Time of the last sync of the scheduled runs, which is only accessed by the scheduler
+	catalog      *Catalog             // Translations of bot messages
+	adminAPI     *API                 // Rate limited Telegram api of the admin bot, if configured
+	files        FileStore            // Store of the data of downloaded files
+	filesMu      sync.Mutex           // Serializes the checks for shared file data of StoreFile and DeleteFile
+	httpc        *http.Client         // HTTP client for downloading files
+	pollc        *http.Client         // HTTP client for long polling, which is not limited by the download timeout
+	migrations   []Migration          // Database migrations of the application
+	mux          *http.ServeMux       // Handlers of the http.Server
+	whSecret     string               // Secret token of the webhook
+	metrics      *metrics             // Prometheus metrics, if enabled
+	metricsReg   *prometheus.Registry // Registry of the metrics set by WithMetricsRegistry
+	ready        atomic.Bool          // Whether the bot is running and ready to receive updates
+	tp           trace.TracerProvider // Provider of the tracer set by WithTracerProvider
+	tracer       trace.Tracer
 }
 
 type Option func(*TBot)
 
 // New creates a new Telegram bot based on the given configuration.
-// It uses functional options for configuration.
+// It uses functional options for configuration and panics on error.
 func New(opts ...Option) *TBot {
+	tbot, err := NewE(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return tbot
+}
+
+// NewE is like New but returns an error instead of panicking,
+// which is ErrMissingConfig if the WithConfig option is missing.
+func NewE(opts ...Option) (_ *TBot, err error) {
 	tbot := &TBot{
-		ctx:    context.Background(),
-		cmdReg: CommandRegistry{},
-		hFn:    func() UpdateHandler { return &DefaultUpdateHandler{} },
-		logger: nil,
-		tzc:    loadTimezoneCache(),
+		ctx:     context.Background(),
+		cmdReg:  CommandRegistry{},
+		hFn:     func() UpdateHandler { return &DefaultUpdateHandler{} },
+		logger:  nil,
+		catalog: DefaultCatalog,
 	}
 
+	tbot.sessions = newSessionManager(tbot)
+
 	// Loop through each option
 	for _, opt := range opts {
 		opt(tbot)
 	}
 
 	if tbot.cfg == nil {
-		panic("tbot config is missing")
+		return nil, ErrMissingConfig
+	}
+
+	if tbot.tzc, err = loadTimezoneCache(); err != nil {
+		return nil, err
+	}
+
+	if !tbot.noDMws {
+		tbot.mws = append(DefaultMiddlewares(), tbot.mws...)
 	}
+	tbot.updFn = chainMiddlewares(tbot.mws, (*Bot).handleUpdate)
 
 	if tbot.logger == nil {
 		tbot.logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -63,19 +118,67 @@ func New(opts ...Option) *TBot {
 		}))
 	}
 
-	tbot.db = NewDB(tbot.cfg, &gorm.Config{FullSaveAssociations: true})
-	tbot.api = echotron.NewAPI(tbot.cfg.Telegram.BotToken)
+	if tbot.db, err = NewDBE(tbot.cfg, &gorm.Config{FullSaveAssociations: true}); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Do not leak the database connection if the bot cannot be created
+		if err != nil {
+			if sqlDB, dbErr := tbot.db.DB.DB(); dbErr == nil {
+				_ = sqlDB.Close()
+			}
+		}
+	}()
+	tbot.mux = http.NewServeMux()
+	if tbot.srv != nil && tbot.srv.Handler != nil {
+		tbot.mux.Handle("/", tbot.srv.Handler)
+	}
+	if err = tbot.initMetrics(); err != nil {
+		return nil, err
+	}
+	if err = tbot.initTracing(); err != nil {
+		return nil, err
+	}
+	if tbot.users, err = newUserRepository(tbot); err != nil {
+		return nil, err
+	}
+	if tbot.cfg.Telegram.APIURL == "" {
+		tbot.cfg.Telegram.APIURL = defaultAPIURL
+	}
+	if tbot.httpc == nil {
+		tbot.httpc = newHTTPClient(tbot.cfg)
+	}
+	relaxEchotronLimits()
+	tbot.api = tbot.newAPI(echotron.NewLocalAPI(fmt.Sprintf("%s/bot%s/", strings.TrimSuffix(tbot.cfg.Telegram.APIURL, "/"), tbot.cfg.Telegram.BotToken), tbot.cfg.Telegram.BotToken))
+	if token := tbot.cfg.Admin.BotToken; token != "" {
+		api := tbot.newAPI(echotron.NewLocalAPI(fmt.Sprintf("%s/bot%s/", strings.TrimSuffix(tbot.cfg.Telegram.APIURL, "/"), token), token))
+		tbot.adminAPI = &api
+	}
+	tbot.pollc = &http.Client{Timeout: pollHTTPTimeout}
 	tbot.dsp = echotron.NewDispatcher(tbot.cfg.Telegram.BotToken, tbot.buildBot(tbot.hFn))
 	if tbot.srv != nil {
 		tbot.dsp.SetHTTPServer(tbot.srv)
 	}
+	if tbot.whURL == "" {
+		tbot.whURL = tbot.cfg.Webhook.URL
+	}
 
 	// Initialize database tables
-	if err := tbot.db.AutoMigrate(&User{}, &UserInfo{}, &UserPhoto{}); err != nil {
-		panic(err)
+	if err = tbot.migrate(); err != nil {
+		return nil, err
+	}
+	if tbot.files == nil {
+		if tbot.files, err = tbot.newFileStore(); err != nil {
+			return nil, err
+		}
+	}
+	if !tbot.cfg.Database.SkipMigrations {
+		if err = tbot.moveLegacyUserPhotos(tbot.ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	return tbot
+	return tbot, nil
 }
 
 // WithConfig is the only required option because it provides the config for the tbot to function properly.
@@ -86,7 +189,7 @@ func WithConfig(cfg *Config) Option {
 }
 
 // WithCommands is used for providing and registering custom bot commands.
-// Bot commands always start with a / like /start and a Handler, which implements the CommandHandler interface.
+// Bot commands always start with a / like /start and a HandlerFn, which returns a new CommandHandler for each Bot session.
 // If you want a command to be available in the command list on Telegram,
 // the provided Command must contain a Description.
 func WithCommands(commands []Command) Option {
@@ -102,6 +205,31 @@ func WithHandlerFunc(hFn UpdateHandlerFn) Option {
 	}
 }
 
+// WithMiddleware option adds the given middlewares to the update processing chain.
+// Middlewares are applied in the given order after the DefaultMiddlewares.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(app *TBot) {
+		app.mws = append(app.mws, mws...)
+	}
+}
+
+// WithoutDefaultMiddlewares option removes the DefaultMiddlewares from the update processing chain.
+// This drops the panic recovery, the chat and user refresh, ignoring banned users, the rate limit, the message store and
+// Config.AllowedChatIDs. They can be added again selectively and in a different order with WithMiddleware.
+// Metrics and tracing are not part of the chain, so they always cover the whole processing of an update.
+func WithoutDefaultMiddlewares() Option {
+	return func(app *TBot) {
+		app.noDMws = true
+	}
+}
+
+// WithWebhook option lets Run receive updates via the given webhook url instead of polling.
+func WithWebhook(webhookURL string) Option {
+	return func(app *TBot) {
+		app.whURL = webhookURL
+	}
+}
+
 // WithLogger option can be used to override the default logger with a custom one.
 func WithLogger(l *slog.Logger) Option {
 	return func(app *TBot) {
@@ -109,71 +237,68 @@ func WithLogger(l *slog.Logger) Option {
 	}
 }
 
-// WithServer option can be used add a custom http.Server to the dispatcher
+// WithServer option sets the http.Server, which serves the webhook and the ServeMux.
+// The ServeMux handles the health checks and the metrics, while the handler of the server serves all remaining paths.
+// Set Config.Metrics.HealthzPath and ReadyzPath to move or disable health checks, which collide with the handler.
 func WithServer(s *http.Server) Option {
 	return func(app *TBot) {
 		app.srv = s
 	}
 }
 
-// Start starts the Telegram bot server in poll mode
-func (tb *TBot) Start() {
-	var err error
-	if err = tb.SetBotCommands(tb.buildTelegramCommands()); err != nil {
-		tb.logger.Error("Cannot set bot commands!")
-		panic(err)
+// WithHTTPClient option overrides the HTTP client used for downloading files from Telegram.
+// By default, a client with the timeout of Config.Telegram.DownloadTimeout is used.
+func WithHTTPClient(c *http.Client) Option {
+	return func(app *TBot) {
+		app.httpc = c
 	}
+}
 
-	if tb.srv == nil {
-		tb.logger.Info("Start dispatcher")
-		tb.logger.Error(tb.dsp.Poll().Error())
-		return
+// Start starts the Telegram bot server in poll mode and panics on error.
+// It shuts down gracefully on SIGINT or SIGTERM.
+func (tb *TBot) Start() {
+	if err := tb.StartE(); err != nil {
+		panic(err)
 	}
+}
 
-	// If we have a custom web server, we run the polling in a separate go routine.
-	go func() {
-		tb.logger.Info("Start dispatcher")
-		tb.logger.Error(tb.dsp.Poll().Error())
-	}()
-
-	go shutdownServerOnSignal(tb.srv)
-
-	tb.logger.Info("Start server")
-	err = tb.srv.ListenAndServe()
-	if !errors.Is(err, http.ErrServerClosed) {
-		tb.logger.Error(err.Error())
-		return
-	}
-	tb.logger.Info("Server closed")
+// StartE is like Start but returns an error instead of panicking.
+func (tb *TBot) StartE() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return tb.Run(ctx)
 }
 
-// StartWithWebhook starts the Telegram bot server with a given webhook url.
+// StartWithWebhook starts the Telegram bot server with a given webhook url and panics on error.
+// It shuts down gracefully on SIGINT or SIGTERM.
 func (tb *TBot) StartWithWebhook(webhookURL string) {
-	var err error
-	if err = tb.SetBotCommands(tb.buildTelegramCommands()); err != nil {
-		tb.logger.Error("Cannot set bot commands!")
+	if err := tb.StartWithWebhookE(webhookURL); err != nil {
 		panic(err)
 	}
-	if webhookURL == "" {
-		panic("webhook url is empty")
-	}
-
-	tb.logger.Info(fmt.Sprintf("Start dispatcher and server with webhook: %q", webhookURL))
+}
 
-	if tb.srv != nil {
-		go shutdownServerOnSignal(tb.srv)
+// StartWithWebhookE is like StartWithWebhook but returns an error instead of panicking.
+func (tb *TBot) StartWithWebhookE(webhookURL string) error {
+	if webhookURL == "" {
+		return ErrMissingWebhookURL
 	}
+	tb.whURL = webhookURL
+	return tb.StartE()
+}
 
-	err = tb.dsp.ListenWebhook(webhookURL)
-	if !errors.Is(err, http.ErrServerClosed) {
-		tb.logger.Error(err.Error())
-		return
-	}
-	tb.logger.Info("Server closed")
+// Context returns the context of the running bot, which is cancelled as soon as the bot shuts down.
+func (tb *TBot) Context() context.Context {
+	return tb.ctx
 }
 
-// API returns the reference to the echotron.API.
+// API returns the reference to the echotron.API. Its requests are not rate limited, see LimitedAPI.
+// Concurrent first requests to different chats race within echotron v3.37.0, which LimitedAPI guards against.
 func (tb *TBot) API() echotron.API {
+	return tb.api.API
+}
+
+// LimitedAPI returns the rate limited Telegram api. See the API type for details.
+func (tb *TBot) LimitedAPI() API {
 	return tb.api
 }
 
@@ -188,6 +313,9 @@ func (tb *TBot) DB() *DB {
 }
 
 // Dispatcher returns the echotron.Dispatcher.
+//
+// Deprecated: Run receives the updates itself and does not use the echotron.Dispatcher, whose sessions are independent
+// of the Bot sessions of the TBot.
 func (tb *TBot) Dispatcher() *echotron.Dispatcher {
 	return tb.dsp
 }
@@ -197,25 +325,47 @@ func (tb *TBot) Server() *http.Server {
 	return tb.srv
 }
 
-// DownloadFile downloads a file from Telegram by a given fileID
+// Me returns the Telegram user of the bot itself.
+// It is requested via getMe on first use and cached afterward.
+func (tb *TBot) Me() (*echotron.User, error) {
+	tb.meMu.Lock()
+	defer tb.meMu.Unlock()
+
+	if tb.me == nil {
+		res, err := tb.api.GetMe()
+		if err != nil {
+			return nil, err
+		}
+		tb.me = res.Result
+	}
+	return tb.me, nil
+}
+
+// DownloadFile downloads a file from Telegram by a given fileID into memory without storing it.
+// Use StoreFile in order to persist files. Files larger than Config.Files.MaxSize are rejected with ErrFileTooLarge.
 func (tb *TBot) DownloadFile(fileID string) (*File, error) {
 	fileIDRes, err := tb.API().GetFile(fileID)
 	if err != nil {
 		return nil, err
 	}
 	tb.logger.Debug(fileIDRes.Description)
+	if fileIDRes.Result.FileSize > tb.maxFileSize() {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFileTooLarge, fileIDRes.Result.FileSize)
+	}
 
-	fileData, err := tb.API().DownloadFile(fileIDRes.Result.FilePath)
-	if err != nil {
+	var buf bytes.Buffer
+	if err = tb.download(tb.Context(), fileIDRes.Result.FilePath, &buf); err != nil {
 		return nil, err
 	}
+	fileData := buf.Bytes()
 
 	mime := mimetype.Detect(fileData)
 	f := &File{
+		Name:      path.Base(fileIDRes.Result.FilePath),
 		UniqueID:  fileIDRes.Result.FileUniqueID,
 		Extension: mime.Extension(),
 		MimeType:  mime.String(),
-		Hash:      fmt.Sprintf("%x", md5.Sum(fileData)),
+		Hash:      fmt.Sprintf("%x", sha256.Sum256(fileData)),
 		Size:      fileIDRes.Result.FileSize,
 		Data:      fileData,
 	}
@@ -234,11 +384,17 @@ func (tb *TBot) SetBotCommands(bc []echotron.BotCommand) error {
 	return err
 }
 
+// fileURL returns the download url of a file with the given path as returned by GetFile.
+func (tb *TBot) fileURL(filePath string) string {
+	return fmt.Sprintf("%s/file/bot%s/%s", strings.TrimSuffix(tb.cfg.Telegram.APIURL, "/"), tb.cfg.Telegram.BotToken, filePath)
+}
+
 func (tb *TBot) newBot(chatID int64, l *slog.Logger, hFn UpdateHandlerFn) *Bot {
 	b := &Bot{
-		tbot:   tb,
-		chatID: chatID,
-		logger: l.WithGroup("Bot"),
+		tbot:        tb,
+		chatID:      chatID,
+		cmdHandlers: map[string]CommandHandler{},
+		logger:      l.WithGroup("Bot"),
 	}
 
 	if b.chatID == 0 {
@@ -246,19 +402,19 @@ func (tb *TBot) newBot(chatID int64, l *slog.Logger, hFn UpdateHandlerFn) *Bot {
 	}
 
 	var err error
-	b.user, err = tb.DB().FindUserByChatID(b.chatID)
+	b.user, err = tb.users.Find(b.chatID)
 	if err != nil {
-		b.logger.Warn(err.Error())
-		b.logger.Info(fmt.Sprintf("Creating new user with ChatID=%d", b.chatID))
+		b.Log().Warn(err.Error())
+		b.Log().Info(fmt.Sprintf("Creating new user with ChatID=%d", b.chatID))
 		b.user = &User{ChatID: b.chatID, UserInfo: &UserInfo{}, UserPhoto: &UserPhoto{}}
 	}
 
 	// Create tb new UpdateHandler and set Bot reference back on handler
 	b.handler = hFn()
 	b.handler.SetBot(b)
-	// Set the self-destruction timer
-	b.dTimer = time.AfterFunc(time.Duration(tb.cfg.BotSessionTimeout)*time.Minute, b.destruct)
-	b.logger.Debug(fmt.Sprintf("New Bot instance started with ChatID=%d", b.chatID))
+	// Resume a persisted conversation if there is one
+	b.restoreState()
+	b.Log().Debug(fmt.Sprintf("New Bot instance started with ChatID=%d", b.chatID))
 
 	return b
 }
@@ -269,6 +425,17 @@ func (tb *TBot) buildBot(h UpdateHandlerFn) echotron.NewBotFn {
 	}
 }
 
+// isOwnUsername returns true if the given username is the one of the bot.
+// If the bot username cannot be determined, all usernames are accepted.
+func (tb *TBot) isOwnUsername(username string) bool {
+	me, err := tb.Me()
+	if err != nil {
+		tb.logger.Warn("Cannot verify bot username", "error", err)
+		return true
+	}
+	return strings.EqualFold(me.Username, username)
+}
+
 func (tb *TBot) getRegistryCommand(name string) *Command {
 	c, ok := tb.cmdReg[name]
 	if !ok {
@@ -276,28 +443,3 @@ func (tb *TBot) getRegistryCommand(name string) *Command {
 	}
 	return &c
 }
-
-func (tb *TBot) buildTelegramCommands() []echotron.BotCommand {
-	var bc []echotron.BotCommand
-	for _, c := range tb.cmdReg {
-		if c.Name != "" && c.Description != "" {
-			bc = append(bc, echotron.BotCommand{
-				Command:     c.Name,
-				Description: c.Description,
-			})
-		}
-	}
-	return bc
-}
-
-// shutdownServerOnSignal gracefully shuts down server on SIGINT or SIGTERM
-func shutdownServerOnSignal(srv *http.Server) {
-	termChan := make(chan os.Signal, 1) // Channel for terminating the tbot via os.Interrupt signal
-	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
-
-	<-termChan
-	// Perform some cleanup...
-	if err := srv.Shutdown(context.Background()); err != nil {
-		panic(err)
-	}
-}
@@ -42,6 +42,29 @@ func TestNew(t *testing.T) {
 	})
 }
 
+func TestNewE(t *testing.T) {
+	t.Run("should return ErrMissingConfig without config", func(t *testing.T) {
+		tbot, err := tbb.NewE()
+		assert.Nil(t, tbot)
+		assert.ErrorIs(t, err, tbb.ErrMissingConfig)
+	})
+
+	t.Run("should return ErrUnsupportedDatabase for unknown database types", func(t *testing.T) {
+		cfg := tbb.LoadConfig("test/data/test.config.yml")
+		cfg.Database.Type = "oracle"
+		tbot, err := tbb.NewE(tbb.WithConfig(cfg))
+		assert.Nil(t, tbot)
+		assert.ErrorIs(t, err, tbb.ErrUnsupportedDatabase)
+	})
+
+	t.Run("should create new tbot", func(t *testing.T) {
+		cfg := tbb.LoadConfig("test/data/test.config.yml")
+		tbot, err := tbb.NewE(tbb.WithConfig(cfg))
+		assert.NoError(t, err)
+		assert.NotNil(t, tbot)
+	})
+}
+
 func ExampleNew() {
 	type CustomConfig struct {
 		Version   string   `yaml:"version"`
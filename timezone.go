@@ -20,7 +20,7 @@ type TimeZoneInfo struct {
 	IsDST     bool    `json:"isDST,omitempty"`     // Whether the offset is in daylight saving time or normal time
 }
 
-func loadTimezoneCache() *timezone.Timezonecache {
+func loadTimezoneCache() (*timezone.Timezonecache, error) {
 	var (
 		f, tempF *os.File
 		tzc      timezone.Timezonecache
@@ -30,30 +30,30 @@ func loadTimezoneCache() *timezone.Timezonecache {
 
 	tempF, err = os.CreateTemp("", "timezone.data")
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %w", ErrTimezoneData, err)
 	}
 	defer os.Remove(tempF.Name())
 
 	data, err = efs.ReadFile("assets/timezone.data")
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %w", ErrTimezoneData, err)
 	}
 
 	_, err = tempF.Write(data)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %w", ErrTimezoneData, err)
 	}
 
 	f, err = os.Open(tempF.Name())
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %w", ErrTimezoneData, err)
 	}
 
 	if err = tzc.Load(f); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: %w", ErrTimezoneData, err)
 	}
 
-	return &tzc
+	return &tzc, nil
 }
 
 // GetTimezoneInfo returns the time zone info for the given coordinates if available.
@@ -0,0 +1,195 @@
+package tbb
+
+import (
+	"context"
+	"errors"
+	"github.com/NicoNex/echotron/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"log/slog"
+	"net/url"
+)
+
+const (
+	tracerName = "github.com/apperia-de/tbb"
+
+	dbSpanKey = "tbb:tracing_span" // Statement instance key of the span of a database operation
+)
+
+// Span attributes
+const (
+	attrChatID        = attribute.Key("tbb.chat.id")
+	attrUpdateID      = attribute.Key("tbb.update.id")
+	attrUpdateType    = attribute.Key("tbb.update.type")
+	attrCommand       = attribute.Key("tbb.command")
+	attrState         = attribute.Key("tbb.state")
+	attrCallbackRoute = attribute.Key("tbb.callback.route")
+	attrMethod        = attribute.Key("telegram.method")
+	attrDBOp          = attribute.Key("db.operation")
+	attrDBTable       = attribute.Key("db.sql.table")
+	attrDBQuery       = attribute.Key("db.statement")
+	attrDBRows        = attribute.Key("db.rows_affected")
+)
+
+// updateScope is the context and logger of the update, which is currently processed by a Bot session.
+type updateScope struct {
+	ctx    context.Context
+	logger *slog.Logger
+}
+
+// WithTracerProvider sets the OpenTelemetry TracerProvider, which records a span for each update with child spans
+// for commands, states, Telegram api calls and database queries. Defaults to the global TracerProvider,
+// which does not record anything unless it is set by the application.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(tb *TBot) {
+		tb.tp = tp
+	}
+}
+
+// initTracing creates the tracer and instruments the database.
+func (tb *TBot) initTracing() error {
+	if tb.tp == nil {
+		tb.tp = otel.GetTracerProvider()
+	}
+	tb.tracer = tb.tp.Tracer(tracerName)
+	return registerDBCallbacks(tb.db.DB, "tbb:tracing", tb.startDBSpan, endDBSpan)
+}
+
+// Context returns the context of the update, which is currently processed, and the context of the TBot otherwise.
+// It carries the span of the update and should be passed on to traced operations of the application.
+// Like DB, LimitedAPI and Log, it must only be called by the handlers of the update. Goroutines started by handlers
+// must get the context beforehand and pass it on, since the session may process another update meanwhile.
+func (b *Bot) Context() context.Context {
+	return b.currentScope().ctx
+}
+
+// currentScope returns the scope of the update, which is currently processed, or the scope of the TBot otherwise.
+// Goroutines started while processing an update get the scope beforehand and use it instead of the scope of the Bot.
+func (b *Bot) currentScope() *updateScope {
+	if s := b.scope.Load(); s != nil {
+		return s
+	}
+	return &updateScope{ctx: b.tbot.Context(), logger: b.logger}
+}
+
+// db returns the database, whose queries are traced within the context of the scope.
+func (s *updateScope) db(tb *TBot) *DB {
+	return &DB{DB: tb.db.WithContext(s.ctx)}
+}
+
+// traceUpdate starts the span of the given update and returns the function ending it.
+func (b *Bot) traceUpdate(u *echotron.Update) func() {
+	ctx, span := b.tbot.tracer.Start(b.tbot.Context(), "tbb.update",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrChatID.Int64(b.chatID), attrUpdateID.Int(u.ID), attrUpdateType.String(parseUpdate(u).Type)),
+	)
+	b.scope.Store(b.newScope(ctx))
+	return func() {
+		b.scope.Store(nil)
+		span.End()
+	}
+}
+
+// traceSpan calls fn within a child span of the current update with the given name.
+func (b *Bot) traceSpan(name string, fn func(), attrs ...attribute.KeyValue) {
+	parent := b.scope.Load()
+	if parent == nil {
+		fn()
+		return
+	}
+	ctx, span := b.tbot.tracer.Start(parent.ctx, name, trace.WithAttributes(attrs...))
+	defer span.End()
+	b.scope.Store(b.newScope(ctx))
+	defer b.scope.Store(parent)
+	fn()
+}
+
+// traceAttributes adds the given attributes to the span of the current update.
+func (b *Bot) traceAttributes(attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(b.Context()).SetAttributes(attrs...)
+}
+
+// traceError marks the span of the current update as failed.
+func (b *Bot) traceError(err error) {
+	span := trace.SpanFromContext(b.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// newScope returns the scope of the given context, whose logger contains the trace and span ID if it is traced.
+func (b *Bot) newScope(ctx context.Context) *updateScope {
+	s := &updateScope{ctx: ctx, logger: b.logger}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		s.logger = b.logger.With("traceID", sc.TraceID().String(), "spanID", sc.SpanID().String())
+	}
+	return s
+}
+
+// startSpan starts the span of a Telegram api request, if the context of the API is traced.
+func (a API) startSpan(method string, chatID int64) trace.Span {
+	if a.tracer == nil || a.ctx == nil {
+		return nil
+	}
+	ctx := a.ctx()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	_, span := a.tracer.Start(ctx, "telegram."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrMethod.String(method), attrChatID.Int64(chatID)),
+	)
+	return span
+}
+
+// endSpan ends the span of a Telegram api request.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		// Network errors contain the request url with the bot token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startDBSpan returns a gorm callback, which starts the span of a database operation within a traced context.
+func (tb *TBot) startDBSpan(op string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		ctx := tx.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		_, span := tb.tracer.Start(ctx, "gorm."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrDBOp.String(op)))
+		tx.InstanceSet(dbSpanKey, span)
+	}
+}
+
+// endDBSpan returns a gorm callback, which ends the span of a database operation.
+func endDBSpan(string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		v, ok := tx.InstanceGet(dbSpanKey)
+		if !ok {
+			return
+		}
+		span := v.(trace.Span)
+		span.SetAttributes(
+			attrDBTable.String(tx.Statement.Table),
+			attrDBQuery.String(tx.Statement.SQL.String()),
+			attrDBRows.Int64(tx.Statement.RowsAffected),
+		)
+		if err := tx.Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
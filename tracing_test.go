@@ -0,0 +1,170 @@
+package tbb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/NicoNex/echotron/v3"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type traceHandler struct {
+	tbb.DefaultCommandHandler
+}
+
+func (h *traceHandler) Handle() tbb.StateFn {
+	b := h.Bot()
+	b.Log().Info("Handling traced command")
+	_, _ = b.LimitedAPI().SendMessage("traced", b.ChatID(), nil)
+	var users []tbb.User
+	b.DB().Find(&users)
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer, which may be written concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// findSpan returns the first span with the given name.
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("missing span %q", name)
+	return tracetest.SpanStub{}
+}
+
+func TestTracing(t *testing.T) {
+	commands := tbb.WithCommands([]tbb.Command{
+		{Name: "/trace", HandlerFn: func() tbb.CommandHandler { return &traceHandler{} }},
+		{Name: "/panic", HandlerFn: func() tbb.CommandHandler { return &panicHandler{} }},
+	})
+	newHarness := func(t *testing.T) (*tbbtest.Harness, *tracetest.InMemoryExporter, *syncBuffer) {
+		exp := tracetest.NewInMemoryExporter()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+		t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+		logs := &syncBuffer{}
+		logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		h := tbbtest.New(t, commands, tbb.WithTracerProvider(tp), tbb.WithLogger(logger))
+		return h, exp, logs
+	}
+
+	t.Run("should trace updates with commands, api calls and queries", func(t *testing.T) {
+		h, exp, logs := newHarness(t)
+		h.SendMessage(42, "/trace")
+
+		spans := exp.GetSpans()
+		update := findSpan(t, spans, "tbb.update")
+		assert.False(t, update.Parent.IsValid())
+		assert.Subset(t, update.Attributes, []attribute.KeyValue{
+			attribute.Int64("tbb.chat.id", 42),
+			attribute.String("tbb.update.type", "message"),
+			attribute.String("tbb.command", "/trace"),
+		})
+
+		cmd := findSpan(t, spans, "tbb.command")
+		assert.Equal(t, update.SpanContext.SpanID(), cmd.Parent.SpanID())
+
+		send := findSpan(t, spans, "telegram.sendMessage")
+		assert.Equal(t, cmd.SpanContext.SpanID(), send.Parent.SpanID())
+		assert.Contains(t, send.Attributes, attribute.String("telegram.method", "sendMessage"))
+
+		var query *tracetest.SpanStub
+		for _, s := range spans {
+			if s.Name == "gorm.query" && s.Parent.SpanID() == cmd.SpanContext.SpanID() {
+				query = &s
+			}
+		}
+		require.NotNil(t, query, "missing query of the command")
+		assert.Contains(t, query.Attributes, attribute.String("db.sql.table", "users"))
+
+		var entry map[string]any
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "Handling traced command") {
+				require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			}
+		}
+		require.NotNil(t, entry, "missing log entry")
+		group, _ := entry["Bot"].(map[string]any)
+		assert.Equal(t, update.SpanContext.TraceID().String(), group["traceID"])
+		assert.Equal(t, cmd.SpanContext.SpanID().String(), group["spanID"])
+	})
+
+	t.Run("should record errors of api calls and recovered panics", func(t *testing.T) {
+		h, exp, _ := newHarness(t)
+		h.Server.Respond("sendMessage", func(tbbtest.Request) tbbtest.Response {
+			return tbbtest.Response{ErrorCode: 403, Description: "Forbidden: bot was blocked by the user"}
+		})
+		h.SendMessage(42, "/trace")
+		send := findSpan(t, exp.GetSpans(), "telegram.sendMessage")
+		assert.Equal(t, codes.Error, send.Status.Code)
+		assert.NotContains(t, send.Status.Description, tbbtest.BotToken)
+
+		exp.Reset()
+		h.SendMessage(43, "/panic")
+		update := findSpan(t, exp.GetSpans(), "tbb.update")
+		assert.Equal(t, codes.Error, update.Status.Code)
+		assert.Contains(t, update.Status.Description, "test panic")
+	})
+
+	t.Run("should trace background refreshes within the span of their update", func(t *testing.T) {
+		h, exp, _ := newHarness(t)
+		h.Server.Respond("getChatMemberCount", func(tbbtest.Request) tbbtest.Response {
+			// Respond after the update has been processed
+			time.Sleep(time.Millisecond * 100)
+			return tbbtest.Response{Result: 42}
+		})
+		h.SendUpdate(myChatMember(echotron.Chat{ID: groupChatID, Type: "supergroup"}, echotron.ChatMember{Status: "member"}))
+
+		var refresh *tracetest.SpanStub
+		require.Eventually(t, func() bool {
+			for _, s := range exp.GetSpans() {
+				for _, a := range s.Attributes {
+					if s.Name == "gorm.update" && a.Key == "db.statement" && strings.Contains(a.Value.AsString(), "SET `member_count`") {
+						refresh = &s
+					}
+				}
+			}
+			return refresh != nil
+		}, time.Second*5, time.Millisecond*10)
+		update := findSpan(t, exp.GetSpans(), "tbb.update")
+		assert.Equal(t, update.SpanContext.TraceID(), refresh.SpanContext.TraceID())
+	})
+
+	t.Run("should not trace outside of updates", func(t *testing.T) {
+		h, exp, _ := newHarness(t)
+		_, err := h.TBot.LimitedAPI().SendMessage("untraced", 42, nil)
+		require.NoError(t, err)
+		var users []tbb.User
+		h.TBot.DB().Find(&users)
+		assert.Empty(t, exp.GetSpans())
+	})
+}
@@ -0,0 +1,352 @@
+package tbb
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"log/slog"
+	"maps"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const userBatchSize = 500 // Number of queued user changes, which are written without waiting for Config.UserWriteDelay
+
+// UserRepository loads and saves users. It keeps a snapshot of every loaded or saved user, so that only the changed
+// columns are written and the UserPhoto is only written if the photo has changed.
+//
+// If Config.UserWriteDelay is set, changes are queued and written in batches by a single transaction. Multiple changes
+// of a user within the delay are merged into a single write. Writes are serialized, so that changes of the same user
+// are never written concurrently or out of order. Changes, which cannot be written, are queued again.
+type UserRepository struct {
+	db         *DB
+	logger     *slog.Logger
+	delay      time.Duration
+	userSchema *schema.Schema
+	infoSchema *schema.Schema
+	mu         sync.Mutex
+	snapshots  map[*User]*userSnapshot // Last written state of loaded users, guarded by mu
+	pending    map[int64]*userChange   // Queued changes by chatID, guarded by mu
+	wmu        sync.Mutex              // Serializes writes
+	flush      chan struct{}           // Signals that the queue is full
+}
+
+// userSnapshot is a copy of the last written state of a user.
+type userSnapshot struct {
+	user  User // Copy without associations
+	info  *UserInfo
+	photo *UserPhoto
+}
+
+// userChange holds the changes of a user, which have not been written yet.
+type userChange struct {
+	id       uint64
+	user     map[string]any // Changed columns of the user
+	info     *UserInfo      // Copy of the latest UserInfo
+	infoCols map[string]any // Changed columns of the UserInfo
+	newInfo  bool           // Whether the UserInfo is written as a whole, because it has not been stored before
+	photo    *UserPhoto     // Copy of the changed UserPhoto or nil if the photo is unchanged
+}
+
+func newUserRepository(tb *TBot) (*UserRepository, error) {
+	cache := &sync.Map{}
+	us, err := schema.Parse(&User{}, cache, tb.db.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+	is, err := schema.Parse(&UserInfo{}, cache, tb.db.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+	return &UserRepository{
+		db:         tb.db,
+		logger:     tb.logger,
+		delay:      time.Duration(tb.cfg.UserWriteDelay) * time.Second,
+		userSchema: us,
+		infoSchema: is,
+		snapshots:  map[*User]*userSnapshot{},
+		pending:    map[int64]*userChange{},
+		flush:      make(chan struct{}, 1),
+	}, nil
+}
+
+// Users returns the UserRepository, which saves the users of Bot sessions.
+func (tb *TBot) Users() *UserRepository {
+	return tb.users
+}
+
+// Find loads the user with the given chatID including the UserInfo and UserPhoto. Queued changes of the user are
+// written before. Changes of the returned user should be saved with Save.
+func (r *UserRepository) Find(chatID int64) (*User, error) {
+	r.mu.Lock()
+	_, ok := r.pending[chatID]
+	r.mu.Unlock()
+	if ok {
+		if err := r.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	u, err := r.db.FindUserByChatID(chatID)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.snapshots[u] = newUserSnapshot(u)
+	r.mu.Unlock()
+	return u, nil
+}
+
+// Save writes the changes of the given user since it has been loaded by Find or saved the last time. New users and
+// users, which have not been loaded by Find, are written as a whole including their associations.
+// The user must not be modified concurrently, e.g. the user of a Bot session should be saved with Bot.SaveUser.
+func (r *UserRepository) Save(u *User) error {
+	r.mu.Lock()
+	snap, ok := r.snapshots[u]
+	if !ok || u.ID == 0 {
+		r.mu.Unlock()
+		return r.create(u)
+	}
+
+	c := r.diff(u, snap)
+	r.snapshots[u] = newUserSnapshot(u)
+	if c == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	if r.delay > 0 {
+		if p, ok := r.pending[u.ChatID]; ok {
+			p.merge(c)
+		} else {
+			r.pending[u.ChatID] = c
+		}
+		if len(r.pending) >= userBatchSize {
+			select {
+			case r.flush <- struct{}{}:
+			default:
+			}
+		}
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	if err := r.write(map[int64]*userChange{u.ChatID: c}); err != nil {
+		// Write the user as a whole the next time it is saved
+		r.forget(u)
+		return err
+	}
+	return nil
+}
+
+// Flush writes all queued changes. If the changes cannot be written, they are queued again.
+func (r *UserRepository) Flush() error {
+	// Take the queued changes while holding wmu, so that batches are written in the order in which they were queued
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.mu.Lock()
+	changes := r.pending
+	r.pending = map[int64]*userChange{}
+	r.mu.Unlock()
+
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := r.write(changes); err != nil {
+		r.requeue(changes)
+		return err
+	}
+	return nil
+}
+
+// run writes the queued changes every Config.UserWriteDelay until the context is cancelled.
+func (r *UserRepository) run(ctx context.Context) error {
+	if r.delay <= 0 {
+		return nil
+	}
+	t := time.NewTicker(r.delay)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return r.Flush()
+		case <-t.C:
+		case <-r.flush:
+		}
+		if err := r.Flush(); err != nil {
+			r.logger.Error("Cannot write users", "error", err)
+		}
+	}
+}
+
+// forget drops the snapshot of the given user, which is no longer used.
+func (r *UserRepository) forget(u *User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.snapshots, u)
+}
+
+// create writes the given user as a whole.
+func (r *UserRepository) create(u *User) error {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if err := r.db.Save(u).Error; err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.snapshots[u] = newUserSnapshot(u)
+	r.mu.Unlock()
+	return nil
+}
+
+// write writes the given changes within a single transaction. The caller must hold wmu.
+func (r *UserRepository) write(changes map[int64]*userChange) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		for _, c := range changes {
+			if err := c.write(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot write %d users: %w", len(changes), err)
+	}
+	return nil
+}
+
+// requeue queues the given changes again, which could not be written. Changes queued in the meantime are newer, so
+// they are merged on top. The snapshots of the users are kept, since they include the queued changes.
+func (r *UserRepository) requeue(changes map[int64]*userChange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for chatID, c := range changes {
+		if newer, ok := r.pending[chatID]; ok {
+			c.merge(newer)
+		}
+		r.pending[chatID] = c
+	}
+}
+
+// diff returns the changes of the given user since the snapshot or nil if it is unchanged.
+func (r *UserRepository) diff(u *User, snap *userSnapshot) *userChange {
+	c := &userChange{id: u.ID, user: changedColumns(r.userSchema, u, &snap.user)}
+	if u.UserInfo != nil {
+		c.info = copyPtr(u.UserInfo)
+		c.info.UserID = u.ID
+		if snap.info == nil {
+			c.newInfo = true
+		} else {
+			c.infoCols = changedColumns(r.infoSchema, u.UserInfo, snap.info)
+		}
+	}
+	if u.UserPhoto != nil && (snap.photo == nil || !samePhoto(u.UserPhoto, snap.photo)) {
+		c.photo = copyPtr(u.UserPhoto)
+		c.photo.UserID = u.ID
+	}
+
+	if len(c.user) == 0 && len(c.infoCols) == 0 && !c.newInfo && c.photo == nil {
+		return nil
+	}
+	return c
+}
+
+// merge adds the given later change of the same user.
+func (c *userChange) merge(later *userChange) {
+	if c.user == nil {
+		c.user = map[string]any{}
+	}
+	maps.Copy(c.user, later.user)
+	if later.info != nil {
+		c.info = later.info
+		c.newInfo = c.newInfo || later.newInfo
+		if c.infoCols == nil {
+			c.infoCols = map[string]any{}
+		}
+		maps.Copy(c.infoCols, later.infoCols)
+	}
+	if later.photo != nil {
+		c.photo = later.photo
+	}
+}
+
+// write writes the change within the given transaction.
+func (c *userChange) write(tx *gorm.DB) error {
+	if len(c.user) > 0 {
+		if err := tx.Model(&User{ID: c.id}).Updates(c.user).Error; err != nil {
+			return err
+		}
+	}
+	switch {
+	case c.newInfo:
+		if err := tx.Save(c.info).Error; err != nil {
+			return err
+		}
+	case len(c.infoCols) > 0:
+		if err := tx.Model(&UserInfo{UserID: c.id}).Updates(c.infoCols).Error; err != nil {
+			return err
+		}
+	}
+	if c.photo != nil {
+		if err := tx.Save(c.photo).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newUserSnapshot(u *User) *userSnapshot {
+	s := &userSnapshot{user: *u}
+	s.user.UserInfo, s.user.UserPhoto = nil, nil
+	if u.UserInfo != nil {
+		s.info = copyPtr(u.UserInfo)
+	}
+	if u.UserPhoto != nil {
+		s.photo = copyPtr(u.UserPhoto)
+	}
+	return s
+}
+
+// changedColumns returns the values of the columns of cur, which differ from prev. Primary keys and creation times
+// are skipped.
+func changedColumns(s *schema.Schema, cur, prev any) map[string]any {
+	var (
+		ctx = context.Background()
+		cv  = reflect.ValueOf(cur).Elem()
+		pv  = reflect.ValueOf(prev).Elem()
+		res map[string]any
+	)
+	for _, f := range s.Fields {
+		if f.DBName == "" || f.PrimaryKey || f.AutoCreateTime > 0 {
+			continue
+		}
+		v, _ := f.ValueOf(ctx, cv)
+		if old, _ := f.ValueOf(ctx, pv); reflect.DeepEqual(v, old) {
+			continue
+		}
+		if res == nil {
+			res = map[string]any{}
+		}
+		res[f.DBName] = v
+	}
+	return res
+}
+
+// samePhoto returns true if both photos are equal apart from their timestamps.
+func samePhoto(a, b *UserPhoto) bool {
+	x, y := *a, *b
+	x.CreatedAt, x.UpdatedAt, y.CreatedAt, y.UpdatedAt = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	return x == y
+}
+
+func copyPtr[T any](v *T) *T {
+	c := *v
+	return &c
+}
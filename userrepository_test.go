@@ -0,0 +1,153 @@
+package tbb
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUserRepository(t *testing.T) {
+	// newTBot returns a TBot with a stored user and a function returning the tables written since the last call.
+	newTBot := func(t *testing.T, writeDelay int) (*TBot, func() []string) {
+		cfg := LoadConfig("test/data/test.config.yml")
+		cfg.Database.Filename = filepath.Join(t.TempDir(), "users.db")
+		cfg.LogLevel = "error"
+		cfg.UserWriteDelay = writeDelay
+		tbot := New(WithConfig(cfg))
+		t.Cleanup(func() { _ = tbot.Shutdown() })
+
+		require.NoError(t, tbot.Users().Save(&User{ChatID: 1, Firstname: "Jane", UserInfo: &UserInfo{}, UserPhoto: &UserPhoto{FileUniqueID: "a"}}))
+
+		var (
+			mu     sync.Mutex
+			tables []string
+		)
+		record := func(tx *gorm.DB) {
+			mu.Lock()
+			defer mu.Unlock()
+			tables = append(tables, tx.Statement.Table)
+		}
+		require.NoError(t, tbot.db.Callback().Create().After("gorm:create").Register("test:create", record))
+		require.NoError(t, tbot.db.Callback().Update().After("gorm:update").Register("test:update", record))
+		return tbot, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			res := tables
+			tables = nil
+			return res
+		}
+	}
+
+	t.Run("should only write changed users", func(t *testing.T) {
+		tbot, written := newTBot(t, 0)
+		r := tbot.Users()
+		u, err := r.Find(1)
+		require.NoError(t, err)
+
+		require.NoError(t, r.Save(u))
+		assert.Empty(t, written())
+
+		u.Firstname = "John"
+		require.NoError(t, r.Save(u))
+		assert.Equal(t, []string{"users"}, written())
+
+		u.UserInfo.Language = "de"
+		require.NoError(t, r.Save(u))
+		assert.Equal(t, []string{"user_infos"}, written())
+
+		u.UserPhoto = &UserPhoto{UserID: u.ID, FileUniqueID: "b"}
+		require.NoError(t, r.Save(u))
+		assert.Equal(t, []string{"user_photos"}, written())
+
+		stored, err := tbot.DB().FindUserByChatID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "John", stored.Firstname)
+		assert.Equal(t, "de", stored.UserInfo.Language)
+		assert.Equal(t, "b", stored.UserPhoto.FileUniqueID)
+	})
+
+	t.Run("should merge queued changes into a single write", func(t *testing.T) {
+		tbot, written := newTBot(t, 60)
+		r := tbot.Users()
+		u, err := r.Find(1)
+		require.NoError(t, err)
+
+		u.Firstname = "John"
+		require.NoError(t, r.Save(u))
+		u.Lastname = "Doe"
+		u.UserInfo.IsActive = true
+		require.NoError(t, r.Save(u))
+		assert.Empty(t, written())
+
+		stored, err := tbot.DB().FindUserByChatID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "Jane", stored.Firstname)
+
+		// Loading a user writes its queued changes
+		stored, err = r.Find(1)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"users", "user_infos"}, written())
+		assert.Equal(t, "John", stored.Firstname)
+		assert.Equal(t, "Doe", stored.Lastname)
+		assert.True(t, stored.UserInfo.IsActive)
+
+		u.Username = "jdoe"
+		require.NoError(t, r.Save(u))
+		require.NoError(t, tbot.Shutdown())
+		assert.Equal(t, []string{"users"}, written())
+	})
+
+	t.Run("should queue the changes of a failed write again", func(t *testing.T) {
+		tbot, written := newTBot(t, 60)
+		r := tbot.Users()
+		u, err := r.Find(1)
+		require.NoError(t, err)
+
+		var fail atomic.Bool
+		require.NoError(t, tbot.db.Callback().Update().Before("gorm:update").Register("test:fail", func(tx *gorm.DB) {
+			if fail.Load() {
+				_ = tx.AddError(errors.New("write failed"))
+			}
+		}))
+
+		u.Firstname = "John"
+		u.UserInfo.IsActive = true
+		require.NoError(t, r.Save(u))
+		fail.Store(true)
+		require.Error(t, r.Flush())
+		written()
+
+		// Newer changes are merged on top of the failed ones
+		u.Firstname = "Jim"
+		u.Lastname = "Doe"
+		require.NoError(t, r.Save(u))
+		fail.Store(false)
+		require.NoError(t, r.Flush())
+		assert.ElementsMatch(t, []string{"users", "user_infos"}, written())
+
+		stored, err := tbot.DB().FindUserByChatID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "Jim", stored.Firstname)
+		assert.Equal(t, "Doe", stored.Lastname)
+		assert.True(t, stored.UserInfo.IsActive)
+	})
+
+	t.Run("should save the user of a session", func(t *testing.T) {
+		tbot, _ := newTBot(t, 0)
+		b := tbot.sessions.session(1)
+
+		require.NoError(t, b.UpdateUser(func(u *User) { u.UserInfo.ZoneName = "Europe/Berlin" }))
+		b.DisableUser()
+		require.NoError(t, b.SaveUser())
+
+		stored, err := tbot.DB().FindUserByChatID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "Europe/Berlin", stored.UserInfo.ZoneName)
+		assert.Equal(t, memberStatusLeave, stored.UserInfo.Status)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/NicoNex/echotron/v3"
 	"log/slog"
 	"strings"
+	"unicode"
 )
 
 const (
@@ -22,69 +23,73 @@ type InlineKeyboardButton struct {
 	Data string `json:"data"`
 }
 
-// GetUserFromUpdate returns the echotron.User from a given echotron.Update
-func GetUserFromUpdate(u *echotron.Update) echotron.User {
+// updateInfo contains the type of an update and its fields, which are named differently for every update type.
+type updateInfo struct {
+	Type    string            // Telegram name of the update type, e.g. "message" or "callback_query"
+	Message *echotron.Message // Message of message and channel post updates or nil
+	Chat    *echotron.Chat    // Chat the update belongs to or nil if unknown
+	From    *echotron.User    // Sender of the update or nil if unknown
+}
+
+// parseUpdate returns the updateInfo of the update in the order of handleInitialState.
+func parseUpdate(u *echotron.Update) updateInfo {
 	switch {
 	case u.Message != nil:
-		return *u.Message.From
+		return updateInfo{Type: "message", Message: u.Message, Chat: &u.Message.Chat, From: u.Message.From}
 	case u.EditedMessage != nil:
-		return *u.EditedMessage.From
+		return updateInfo{Type: "edited_message", Message: u.EditedMessage, Chat: &u.EditedMessage.Chat, From: u.EditedMessage.From}
 	case u.ChannelPost != nil:
-		return *u.ChannelPost.From
+		return updateInfo{Type: "channel_post", Message: u.ChannelPost, Chat: &u.ChannelPost.Chat, From: u.ChannelPost.From}
 	case u.EditedChannelPost != nil:
-		return *u.EditedChannelPost.From
+		return updateInfo{Type: "edited_channel_post", Message: u.EditedChannelPost, Chat: &u.EditedChannelPost.Chat, From: u.EditedChannelPost.From}
 	case u.InlineQuery != nil:
-		return *u.InlineQuery.From
+		return updateInfo{Type: "inline_query", From: u.InlineQuery.From}
 	case u.ChosenInlineResult != nil:
-		return *u.ChosenInlineResult.From
+		return updateInfo{Type: "chosen_inline_result", From: u.ChosenInlineResult.From}
 	case u.CallbackQuery != nil:
-		return *u.CallbackQuery.From
+		info := updateInfo{Type: "callback_query", From: u.CallbackQuery.From}
+		if u.CallbackQuery.Message != nil {
+			info.Chat = &u.CallbackQuery.Message.Chat
+		}
+		return info
 	case u.ShippingQuery != nil:
-		return u.ShippingQuery.From
+		return updateInfo{Type: "shipping_query", From: &u.ShippingQuery.From}
 	case u.PreCheckoutQuery != nil:
-		return u.PreCheckoutQuery.From
-	case u.MyChatMember != nil:
-		return u.MyChatMember.From
+		return updateInfo{Type: "pre_checkout_query", From: &u.PreCheckoutQuery.From}
 	case u.ChatMember != nil:
-		return u.ChatMember.From
+		return updateInfo{Type: "chat_member", Chat: &u.ChatMember.Chat, From: &u.ChatMember.From}
 	case u.ChatJoinRequest != nil:
-		return u.ChatJoinRequest.From
+		return updateInfo{Type: "chat_join_request", Chat: &u.ChatJoinRequest.Chat, From: &u.ChatJoinRequest.From}
+	case u.MyChatMember != nil:
+		return updateInfo{Type: "my_chat_member", Chat: &u.MyChatMember.Chat, From: &u.MyChatMember.From}
 	default:
-		return echotron.User{ID: u.ChatID()}
+		return updateInfo{Type: "unknown"}
 	}
 }
 
+// GetUserFromUpdate returns the echotron.User from a given echotron.Update
+func GetUserFromUpdate(u *echotron.Update) echotron.User {
+	if from := parseUpdate(u).From; from != nil {
+		return *from
+	}
+	return echotron.User{ID: u.ChatID()}
+}
+
 // GetChatTypeFromUpdate returns the ChatType from a given echotron.Update
 func GetChatTypeFromUpdate(u *echotron.Update) ChatType {
-	convertToChatType := func(input string) ChatType {
-		switch ChatType(input) {
-		case ChatTypeChannel, ChatTypeGroup, ChatTypeSuperGroup, ChatTypePrivate:
-			return ChatType(input)
-		default:
-			return ChatTypeUnknown
-		}
+	var ct string
+	if c := parseUpdate(u).Chat; c != nil {
+		ct = c.Type
+	} else if u.InlineQuery != nil {
+		ct = u.InlineQuery.ChatType
 	}
 
-	var ct = ChatTypeUnknown
-	switch {
-	case u.Message != nil:
-		ct = convertToChatType(u.Message.Chat.Type)
-	case u.EditedMessage != nil:
-		ct = convertToChatType(u.EditedMessage.Chat.Type)
-	case u.ChannelPost != nil:
-		ct = convertToChatType(u.ChannelPost.Chat.Type)
-	case u.EditedChannelPost != nil:
-		ct = convertToChatType(u.EditedChannelPost.Chat.Type)
-	case u.InlineQuery != nil:
-		ct = convertToChatType(u.InlineQuery.ChatType)
-	case u.MyChatMember != nil:
-		ct = convertToChatType(u.MyChatMember.Chat.Type)
-	case u.ChatMember != nil:
-		ct = convertToChatType(u.ChatMember.Chat.Type)
-	case u.ChatJoinRequest != nil:
-		ct = convertToChatType(u.ChatJoinRequest.Chat.Type)
+	switch ChatType(ct) {
+	case ChatTypeChannel, ChatTypeGroup, ChatTypeSuperGroup, ChatTypePrivate:
+		return ChatType(ct)
+	default:
+		return ChatTypeUnknown
 	}
-	return ct
 }
 
 // BuildInlineKeyboardButtonRow helper function for creating Telegram inline keyboards
@@ -108,6 +113,78 @@ func PrintAsJson(v any, indent bool) string {
 	return string(jsonStr)
 }
 
+// commandText is the parsed text of a bot command message like "/start@my_bot payload".
+type commandText struct {
+	Name     string   // Command name including the leading slash, e.g. /start
+	Username string   // Username of the bot the command is addressed to or empty if not addressed to a specific bot
+	Args     string   // Unparsed arguments of the command
+	Params   []string // Arguments split by whitespace, where quoted arguments count as one
+}
+
+// parseCommandText parses the given message text and returns false if the text is not a bot command.
+func parseCommandText(text string) (commandText, bool) {
+	var ct commandText
+
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return ct, false
+	}
+
+	name, args, _ := strings.Cut(text, " ")
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], name[i:]+" "+args
+	}
+	ct.Name, ct.Username, _ = strings.Cut(name, "@")
+	ct.Args = strings.TrimSpace(args)
+	ct.Params = splitArgs(ct.Args)
+
+	return ct, true
+}
+
+// splitArgs splits the given string by whitespace, but keeps arguments in single or double quotes together.
+// Within double quotes and outside of quotes, a backslash escapes the following character.
+func splitArgs(s string) []string {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
 func buildCommandRegistry(commands []Command) CommandRegistry {
 	cmdReg := CommandRegistry{}
 	for _, c := range commands {
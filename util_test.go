@@ -0,0 +1,67 @@
+package tbb
+
+import (
+	"github.com/NicoNex/echotron/v3"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseCommandText(t *testing.T) {
+	tests := []struct {
+		text     string
+		ok       bool
+		expected commandText
+	}{
+		{text: "hello", ok: false},
+		{text: "/help", ok: true, expected: commandText{Name: "/help"}},
+		{text: "  /help@my_bot  ", ok: true, expected: commandText{Name: "/help", Username: "my_bot"}},
+		{text: "/start abc-123", ok: true, expected: commandText{Name: "/start", Args: "abc-123", Params: []string{"abc-123"}}},
+		{text: "/cmd\tone", ok: true, expected: commandText{Name: "/cmd", Args: "one", Params: []string{"one"}}},
+		{text: "/remind@my_bot \"buy  milk\" tomorrow   'at 8'", ok: true, expected: commandText{
+			Name:     "/remind",
+			Username: "my_bot",
+			Args:     "\"buy  milk\" tomorrow   'at 8'",
+			Params:   []string{"buy  milk", "tomorrow", "at 8"},
+		}},
+	}
+
+	for _, tt := range tests {
+		ct, ok := parseCommandText(tt.text)
+		assert.Equal(t, tt.ok, ok, tt.text)
+		assert.Equal(t, tt.expected, ct, tt.text)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	assert.Nil(t, splitArgs(""))
+	assert.Equal(t, []string{"a", "b"}, splitArgs(" a  b "))
+	assert.Equal(t, []string{"a b", "c"}, splitArgs(`"a b" c`))
+	assert.Equal(t, []string{`say "hi"`}, splitArgs(`'say "hi"'`))
+	assert.Equal(t, []string{`a"b`, "c d"}, splitArgs(`a\"b c\ d`))
+	assert.Equal(t, []string{""}, splitArgs(`""`))
+	assert.Equal(t, []string{"unterminated quote"}, splitArgs(`"unterminated quote`))
+}
+
+func TestParseUpdate(t *testing.T) {
+	user := &echotron.User{ID: 7}
+	group := echotron.Chat{ID: -1, Type: "group"}
+	tests := []struct {
+		update   echotron.Update
+		typ      string
+		chatType ChatType
+		userID   int64
+	}{
+		{update: echotron.Update{Message: &echotron.Message{Chat: echotron.Chat{ID: 7, Type: "private"}, From: user}}, typ: "message", chatType: ChatTypePrivate, userID: 7},
+		{update: echotron.Update{ChannelPost: &echotron.Message{Chat: echotron.Chat{ID: -2, Type: "channel"}}}, typ: "channel_post", chatType: ChatTypeChannel, userID: -2},
+		{update: echotron.Update{CallbackQuery: &echotron.CallbackQuery{From: user, Message: &echotron.Message{Chat: group}}}, typ: "callback_query", chatType: ChatTypeGroup, userID: 7},
+		{update: echotron.Update{InlineQuery: &echotron.InlineQuery{From: user, ChatType: "sender"}}, typ: "inline_query", chatType: ChatTypeUnknown, userID: 7},
+		{update: echotron.Update{MyChatMember: &echotron.ChatMemberUpdated{Chat: group, From: *user}}, typ: "my_chat_member", chatType: ChatTypeGroup, userID: 7},
+		{update: echotron.Update{}, typ: "unknown", chatType: ChatTypeUnknown},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.typ, parseUpdate(&tt.update).Type)
+		assert.Equal(t, tt.chatType, GetChatTypeFromUpdate(&tt.update), tt.typ)
+		assert.Equal(t, tt.userID, GetUserFromUpdate(&tt.update).ID, tt.typ)
+	}
+}
@@ -0,0 +1,248 @@
+package tbb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/NicoNex/echotron/v3"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token" // Header of webhook requests containing the secret token
+	maxWebhookBodySize  = 1 << 20                           // Maximum size of webhook requests, which is far more than any update
+)
+
+// webhookSecretRegexp matches the characters allowed by Telegram for secret tokens.
+var webhookSecretRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// ServeMux returns the http.ServeMux of the http.Server, which is started by Run in webhook mode or if the WithServer
+// option is set. Additional handlers can be registered on it, while the handler of a server set by WithServer serves
+// all remaining paths.
+func (tb *TBot) ServeMux() *http.ServeMux {
+	return tb.mux
+}
+
+// handler returns the root handler of the http.Server, which serves the webhook at the given path, if not empty,
+// and the ServeMux otherwise.
+func (tb *TBot) handler(webhookPath string) http.Handler {
+	root := http.NewServeMux()
+	root.Handle("/", tb.mux)
+	switch webhookPath {
+	case "":
+	case "/":
+		// Only the root path itself, since all other paths are served by the ServeMux
+		root.HandleFunc("/{$}", tb.handleWebhook)
+	default:
+		root.HandleFunc(webhookPath, tb.handleWebhook)
+	}
+	return root
+}
+
+// listenWebhook registers the webhook on Telegram and receives updates until the context is cancelled.
+// The webhook is deleted on shutdown unless Config.Webhook.KeepOnShutdown is set.
+func (tb *TBot) listenWebhook(ctx context.Context) error {
+	wh := tb.cfg.Webhook
+	u, err := url.Parse(tb.whURL)
+	if err != nil {
+		return err
+	}
+
+	if err = tb.initWebhookSecret(); err != nil {
+		return err
+	}
+	if wh.SelfSigned && wh.CertFile == "" {
+		return ErrMissingWebhookCert
+	}
+
+	path, err := webhookPath(wh.Path, u)
+	if err != nil {
+		return err
+	}
+
+	srv := tb.srv
+	if srv == nil {
+		srv = &http.Server{Addr: webhookAddr(u, wh.Listen), ReadHeaderTimeout: serverReadHeaderTimeout}
+	}
+	srv.Handler = tb.handler(path)
+
+	if err = tb.setWebhook(ctx); err != nil {
+		return err
+	}
+	err = serve(ctx, srv, wh.CertFile, wh.KeyFile)
+
+	if !wh.KeepOnShutdown {
+		if _, dErr := tb.api.DeleteWebhook(false); dErr != nil {
+			tb.logger.Warn("Cannot delete webhook", "error", dErr)
+		}
+	}
+	return err
+}
+
+// initWebhookSecret validates the configured secret token or generates a random one.
+func (tb *TBot) initWebhookSecret() error {
+	if tb.whSecret = tb.cfg.Webhook.SecretToken; tb.whSecret != "" {
+		if !webhookSecretRegexp.MatchString(tb.whSecret) {
+			return ErrInvalidWebhookSecret
+		}
+		return nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	tb.whSecret = hex.EncodeToString(b)
+	return nil
+}
+
+// setWebhook registers the webhook with the options of Config.Webhook on Telegram.
+// It uploads the certificate itself, since echotron does not support uploading it.
+func (tb *TBot) setWebhook(ctx context.Context) error {
+	wh := tb.cfg.Webhook
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fields := [][2]string{
+		{"url", tb.whURL},
+		{"secret_token", tb.whSecret},
+		{"drop_pending_updates", strconv.FormatBool(wh.DropPendingUpdates)},
+	}
+	if wh.MaxConnections > 0 {
+		fields = append(fields, [2]string{"max_connections", strconv.Itoa(wh.MaxConnections)})
+	}
+	if wh.AllowedUpdates != nil {
+		allowed, err := json.Marshal(wh.AllowedUpdates)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, [2]string{"allowed_updates", string(allowed)})
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	if wh.SelfSigned {
+		if err := writeFormFile(mw, "certificate", wh.CertFile); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tb.methodURL("setWebhook"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := tb.httpc.Do(req)
+	if err != nil {
+		// Do not leak the bot token, which is part of the url
+		return fmt.Errorf("cannot set webhook: %w", errors.Unwrap(err))
+	}
+	defer res.Body.Close()
+
+	var r echotron.APIResponseBase
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("cannot set webhook: %s", res.Status)
+	}
+	if !r.Ok {
+		return fmt.Errorf("cannot set webhook: %d %s", r.ErrorCode, r.Description)
+	}
+	return nil
+}
+
+// handleWebhook is the http.HandlerFunc receiving updates from Telegram.
+// Requests without the secret token are rejected, so that nobody else can inject updates.
+func (tb *TBot) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(tb.whSecret)) != 1 {
+		tb.logger.Warn("Rejected webhook request with invalid secret token", "remoteAddr", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var u echotron.Update
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBodySize)).Decode(&u); err != nil {
+		tb.logger.Error("Cannot decode webhook update", "error", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	tb.dispatch(&u)
+}
+
+// webhookPath returns the path of the webhook handler, which is the configured path or the path of the webhook url.
+// A missing leading "/" is added, while paths containing patterns of the http.ServeMux are rejected.
+func webhookPath(path string, u *url.URL) (string, error) {
+	if path == "" {
+		path = u.EscapedPath()
+	}
+	if strings.ContainsAny(path, "{} \t\r\n") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidWebhookPath, path)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, nil
+}
+
+// methodURL returns the url of the given Bot API method.
+func (tb *TBot) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", strings.TrimSuffix(tb.cfg.Telegram.APIURL, "/"), tb.cfg.Telegram.BotToken, method)
+}
+
+// webhookAddr returns the listen address of the webhook server, which defaults to the port of the webhook url.
+func webhookAddr(u *url.URL, listen string) string {
+	if listen != "" {
+		return listen
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort("", port)
+}
+
+// writeFormFile adds the file with the given name to the multipart form.
+func writeFormFile(mw *multipart.Writer, field, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := mw.CreateFormFile(field, filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,218 @@
+package tbb_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/apperia-de/tbb"
+	"github.com/apperia-de/tbb/pkg/command"
+	"github.com/apperia-de/tbb/pkg/tbbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const webhookUpdate = `{"update_id":1,"message":{"message_id":1,"date":1,"chat":{"id":42,"type":"private"},"from":{"id":42,"first_name":"Test"},"text":"/help"}}`
+
+// freePort returns a currently unused local port.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// selfSignedCert writes a self-signed certificate for 127.0.0.1 and its key to the temp dir.
+func selfSignedCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// runBot runs the bot until the test finishes and returns a function, which stops it and returns the error of Run.
+func runBot(t *testing.T, h *tbbtest.Harness) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- h.TBot.Run(ctx) }()
+	return func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Second * 10):
+			t.Fatal("Run did not return after the context was cancelled")
+			return nil
+		}
+	}
+}
+
+func postUpdate(t *testing.T, client *http.Client, url, secret string) int {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(webhookUpdate))
+	require.NoError(t, err)
+	if secret != "" {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+	}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	return res.StatusCode
+}
+
+func TestWebhook(t *testing.T) {
+	commands := tbb.WithCommands([]tbb.Command{{Name: "/help", HandlerFn: command.NewHelp}})
+
+	t.Run("should register the webhook and verify the secret token", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Webhook.URL = "https://bot.example.com/telegram"
+		cfg.Webhook.Listen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		cfg.Webhook.Path = "/hook"
+		cfg.Webhook.SecretToken = "s3cret"
+		cfg.Webhook.AllowedUpdates = []string{"message", "callback_query"}
+		cfg.Webhook.MaxConnections = 10
+		cfg.Webhook.DropPendingUpdates = true
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+		h.TBot.ServeMux().HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("pong")) })
+		stop := runBot(t, h)
+
+		require.Eventually(t, func() bool { return len(h.Server.Requests("setWebhook")) > 0 }, time.Second*5, time.Millisecond*10)
+		params := h.Server.Requests("setWebhook")[0].Params
+		assert.Equal(t, "https://bot.example.com/telegram", params.Get("url"))
+		assert.Equal(t, "s3cret", params.Get("secret_token"))
+		assert.Equal(t, `["message","callback_query"]`, params.Get("allowed_updates"))
+		assert.Equal(t, "10", params.Get("max_connections"))
+		assert.Equal(t, "true", params.Get("drop_pending_updates"))
+
+		url := "http://" + cfg.Webhook.Listen
+		require.Eventually(t, func() bool {
+			res, err := http.Get(url + "/ping")
+			if err == nil {
+				_ = res.Body.Close()
+			}
+			return err == nil && res.StatusCode == http.StatusOK
+		}, time.Second*5, time.Millisecond*10)
+
+		assert.Equal(t, http.StatusUnauthorized, postUpdate(t, http.DefaultClient, url+"/hook", ""))
+		assert.Equal(t, http.StatusUnauthorized, postUpdate(t, http.DefaultClient, url+"/hook", "wrong"))
+		assert.Empty(t, h.Messages(42))
+
+		assert.Equal(t, http.StatusOK, postUpdate(t, http.DefaultClient, url+"/hook", "s3cret"))
+		assert.Eventually(t, func() bool { return len(h.Messages(42)) > 0 }, time.Second*5, time.Millisecond*10)
+
+		require.NoError(t, stop())
+		h.AssertRequest("deleteWebhook")
+	})
+
+	t.Run("should serve TLS and upload self-signed certificates", func(t *testing.T) {
+		certFile, keyFile := selfSignedCert(t)
+		port := freePort(t)
+		cfg := &tbb.Config{}
+		cfg.Webhook.URL = fmt.Sprintf("https://127.0.0.1:%d/telegram", port)
+		cfg.Webhook.CertFile = certFile
+		cfg.Webhook.KeyFile = keyFile
+		cfg.Webhook.SelfSigned = true
+		cfg.Webhook.KeepOnShutdown = true
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+		stop := runBot(t, h)
+
+		require.Eventually(t, func() bool { return len(h.Server.Requests("setWebhook")) > 0 }, time.Second*5, time.Millisecond*10)
+		req := h.Server.Requests("setWebhook")[0]
+		cert, err := os.ReadFile(certFile)
+		require.NoError(t, err)
+		assert.Equal(t, cert, req.Files["certificate"])
+		secret := req.Params.Get("secret_token")
+		assert.Len(t, secret, 64)
+
+		pool := x509.NewCertPool()
+		require.True(t, pool.AppendCertsFromPEM(cert))
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		require.Eventually(t, func() bool {
+			conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{RootCAs: pool})
+			if err == nil {
+				_ = conn.Close()
+			}
+			return err == nil
+		}, time.Second*5, time.Millisecond*10)
+		assert.Equal(t, http.StatusOK, postUpdate(t, client, cfg.Webhook.URL, secret))
+		assert.Eventually(t, func() bool { return len(h.Messages(42)) > 0 }, time.Second*5, time.Millisecond*10)
+
+		require.NoError(t, stop())
+		assert.Empty(t, h.Server.Requests("deleteWebhook"))
+	})
+
+	t.Run("should reject invalid secret tokens", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Webhook.URL = "https://bot.example.com/telegram"
+		cfg.Webhook.Listen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		cfg.Webhook.SecretToken = "not allowed!"
+		h := tbbtest.NewWithConfig(t, cfg)
+		assert.ErrorIs(t, h.TBot.Run(context.Background()), tbb.ErrInvalidWebhookSecret)
+	})
+
+	t.Run("should add a missing leading slash to the path and limit the request size", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Webhook.URL = "https://bot.example.com/telegram"
+		cfg.Webhook.Listen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		cfg.Webhook.Path = "hook"
+		cfg.Webhook.SecretToken = "s3cret"
+		h := tbbtest.NewWithConfig(t, cfg, commands)
+		stop := runBot(t, h)
+
+		url := "http://" + cfg.Webhook.Listen + "/hook"
+		require.Eventually(t, func() bool {
+			res, err := http.Get(url)
+			if err == nil {
+				_ = res.Body.Close()
+			}
+			return err == nil && res.StatusCode == http.StatusMethodNotAllowed
+		}, time.Second*5, time.Millisecond*10)
+		assert.Equal(t, http.StatusOK, postUpdate(t, http.DefaultClient, url, "s3cret"))
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(bytes.Repeat([]byte(" "), 2<<20)))
+		require.NoError(t, err)
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "s3cret")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+		require.NoError(t, stop())
+	})
+
+	t.Run("should reject invalid paths", func(t *testing.T) {
+		cfg := &tbb.Config{}
+		cfg.Webhook.URL = "https://bot.example.com/telegram"
+		cfg.Webhook.Listen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		cfg.Webhook.Path = "/hook/{id}"
+		h := tbbtest.NewWithConfig(t, cfg)
+		assert.ErrorIs(t, h.TBot.Run(context.Background()), tbb.ErrInvalidWebhookPath)
+	})
+}